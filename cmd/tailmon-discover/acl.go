@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale/apitype"
+
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+// peerAllowed reports whether a tailnet peer is in allow, by login name,
+// one of its node's tags, or its MagicDNS name.
+func peerAllowed(who *apitype.WhoIsResponse, allow []string) bool {
+	for _, a := range allow {
+		if who.UserProfile != nil && who.UserProfile.LoginName == a {
+			return true
+		}
+		if who.Node == nil {
+			continue
+		}
+		for _, tag := range who.Node.Tags {
+			if tag == a {
+				return true
+			}
+		}
+		name := strings.TrimSuffix(who.Node.Name, ".")
+		if name == a || strings.HasPrefix(name, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowPeers limits tailnet requests to the peers in allow, since the
+// targets are an inventory of the fleet.  The peer comes from the
+// tshttp.Identify middleware.  Requests on a -listen interface and
+// through Funnel have no tailnet identity and are left to -bearer or
+// -basic-auth.  Paths in exempt check callers some other way.
+func allowPeers(logger *zap.Logger, allow []string, next http.Handler, exempt ...string) http.Handler {
+	if len(allow) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		id, err := tshttp.IdentityFrom(r)
+		if errors.Is(err, tshttp.ErrNoIdentity) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil || !peerAllowed(id.WhoIs, allow) {
+			logger.Debug("denied", zap.String("addr", r.RemoteAddr), zap.String("path", r.URL.Path), zap.Error(err))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// alertmanagersPath lists the Alertmanagers on the tailnet in HTTP SD
+// format, for the http_sd_configs of Prometheus alerting.alertmanagers.
+const alertmanagersPath = "/alertmanagers"
+
+// alertmanagerPrefix marks Alertmanagers named like
+// "alertmanager/NODE" or "alertmanager/NODE/PORT".
+const alertmanagerPrefix = "alertmanager/"
+
+// alertmanager reports whether v runs Alertmanager, by name or tag, and
+// where.
+func (d *discoverer) alertmanager(v *ipnstate.PeerStatus) (node string, port int, ok bool) {
+	port = d.alertmanagerPort
+	if rest, found := strings.CutPrefix(v.HostName, alertmanagerPrefix); found && rest != "" {
+		node, portStr, _ := strings.Cut(rest, "/")
+		if p, err := strconv.Atoi(portStr); err == nil && p > 0 && p <= 65535 {
+			port = p
+		}
+		return node, port, true
+	}
+	if v.Tags != nil {
+		for i := 0; i < v.Tags.Len(); i++ {
+			for _, tag := range d.alertmanagerTags {
+				if v.Tags.At(i) == tag {
+					return v.HostName, port, true
+				}
+			}
+		}
+	}
+	return "", 0, false
+}
+
+func (d *discoverer) alertmanagerEndpoint(status *ipnstate.Status, via *tailnet, v *ipnstate.PeerStatus, node string, port int) *Endpoint {
+	ip := d.addresses(v.TailscaleIPs)[0]
+	ep := &Endpoint{
+		ip:      ip,
+		via:     via,
+		node:    node,
+		Targets: []string{net.JoinHostPort(ip.String(), strconv.Itoa(port))},
+		Labels: map[string]string{
+			d.label("node_name"):  node,
+			"__meta_tailscale_ip": ip.String(),
+		},
+	}
+	if dnsName := strings.TrimSuffix(v.DNSName, "."); d.magicDNS && dnsName != "" {
+		ep.Targets[0] = net.JoinHostPort(dnsName, strconv.Itoa(port))
+	}
+	maps.Copy(ep.Labels, peerLabels(status, v))
+	maps.Copy(ep.Labels, d.staticLabels)
+	if via.name != "" {
+		ep.Labels[d.label("tailnet")] = via.name
+	}
+	return ep
+}
+
+func newAlertmanagersHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap, err := d.endpoints(r.Context())
+		if err != nil {
+			logger.Error("endpoints", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := encodeEndpoints(w, snap.alertmanagers); err != nil {
+			logger.Debug("encode", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// adminAPI reads the tailnet's devices from the Tailscale API.  Their
+// authorization and key expiry label the targets, and tailmon nodes
+// that the API knows but this node cannot see, such as ones hidden by
+// ACLs, are logged and exported.
+type adminAPI struct {
+	logger   *zap.Logger
+	d        *discoverer
+	client   *http.Client
+	base     string // like https://api.tailscale.com
+	tailnet  string // "-" for the key's own
+	interval time.Duration
+
+	// deleteAfter, if set, deletes tailmon devices offline longer.
+	deleteAfter time.Duration
+
+	// key is an API access token, or an OAuth client's ID:SECRET.
+	key string
+
+	tokenMu sync.Mutex
+	token   string
+	expires time.Time
+
+	mu      sync.Mutex
+	devices map[tailcfg.StableNodeID]apiDevice
+	unseen  []apiDevice
+	deleted int
+}
+
+// apiDevice is the part of the API's device we use.
+type apiDevice struct {
+	NodeID            tailcfg.StableNodeID `json:"nodeId"`
+	Name              string               `json:"name"`
+	Hostname          string               `json:"hostname"`
+	Tags              []string             `json:"tags"`
+	Authorized        bool                 `json:"authorized"`
+	Expires           time.Time            `json:"expires"`
+	KeyExpiryDisabled bool                 `json:"keyExpiryDisabled"`
+	LastSeen          time.Time            `json:"lastSeen"`
+	Connected         bool                 `json:"connectedToControl"`
+}
+
+func (a *adminAPI) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		if err := a.check(ctx); err != nil && ctx.Err() == nil {
+			a.logger.Error("devices", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check fetches the devices and compares them with the peers this node
+// sees.
+func (a *adminAPI) check(ctx context.Context) error {
+	devices, err := a.fetchDevices(ctx)
+	if err != nil {
+		return err
+	}
+	lc, err := a.d.tailnets[0].srv.LocalClient()
+	if err != nil {
+		return err
+	}
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return err
+	}
+	visible := map[tailcfg.StableNodeID]bool{}
+	if status.Self != nil {
+		visible[status.Self.ID] = true
+	}
+	for _, v := range status.Peer {
+		visible[v.ID] = true
+	}
+
+	byID := make(map[tailcfg.StableNodeID]apiDevice, len(devices))
+	var unseen []apiDevice
+	for _, dev := range devices {
+		byID[dev.NodeID] = dev
+		if !visible[dev.NodeID] && a.wanted(dev) {
+			unseen = append(unseen, dev)
+		}
+	}
+	sort.Slice(unseen, func(i, j int) bool { return unseen[i].Name < unseen[j].Name })
+
+	a.mu.Lock()
+	was := map[tailcfg.StableNodeID]bool{}
+	for _, dev := range a.unseen {
+		was[dev.NodeID] = true
+	}
+	a.devices, a.unseen = byID, unseen
+	a.mu.Unlock()
+	for _, dev := range unseen {
+		if !was[dev.NodeID] {
+			a.logger.Warn("tailmon node not visible", zap.String("name", dev.Name), zap.String("hostname", dev.Hostname))
+		}
+	}
+	if a.deleteAfter > 0 {
+		var self tailcfg.StableNodeID
+		if status.Self != nil {
+			self = status.Self.ID
+		}
+		return a.deleteOffline(ctx, devices, self)
+	}
+	return nil
+}
+
+// deleteOffline deletes the tailmon devices that have been offline
+// longer than deleteAfter, so that dead nodes do not pile up in the
+// admin console.  Only tailmon/ hostnames and -tags count, even with
+// -all-peers, and never this node.
+func (a *adminAPI) deleteOffline(ctx context.Context, devices []apiDevice, self tailcfg.StableNodeID) error {
+	now := time.Now()
+	for _, dev := range devices {
+		switch {
+		case dev.NodeID == self, dev.Connected, dev.LastSeen.IsZero():
+			continue
+		case now.Sub(dev.LastSeen) <= a.deleteAfter:
+			continue
+		case !a.tailmonDevice(dev):
+			continue
+		}
+		if err := a.deleteDevice(ctx, dev.NodeID); err != nil {
+			return fmt.Errorf("delete %s: %w", dev.Name, err)
+		}
+		a.logger.Info("deleted offline device", zap.String("name", dev.Name), zap.String("hostname", dev.Hostname), zap.Time("last_seen", dev.LastSeen))
+		a.mu.Lock()
+		a.deleted++
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// tailmonDevice is wanted without -all-peers.
+func (a *adminAPI) tailmonDevice(dev apiDevice) bool {
+	if !a.d.hostnameWanted(dev.Hostname) {
+		return false
+	}
+	if a.d.matchHostname && strings.HasPrefix(dev.Hostname, hostnamePrefix) {
+		return true
+	}
+	for _, tag := range dev.Tags {
+		if slices.Contains(a.d.tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAPI) deleteDevice(ctx context.Context, id tailcfg.StableNodeID) error {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, a.base+"/api/v2/device/"+url.PathEscape(string(id)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// wanted reports whether discovery would list dev if it could see it.
+func (a *adminAPI) wanted(dev apiDevice) bool {
+	if a.d.allPeers != nil || a.d.matchHostname && strings.HasPrefix(dev.Hostname, hostnamePrefix) {
+		return a.d.hostnameWanted(dev.Hostname)
+	}
+	for _, tag := range dev.Tags {
+		for _, want := range a.d.tags {
+			if tag == want {
+				return a.d.hostnameWanted(dev.Hostname)
+			}
+		}
+	}
+	return false
+}
+
+func (a *adminAPI) fetchDevices(ctx context.Context) ([]apiDevice, error) {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := a.base + "/api/v2/tailnet/" + url.PathEscape(a.tailnet) + "/devices?fields=all"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var list struct {
+		Devices []apiDevice `json:"devices"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list.Devices, err
+}
+
+// accessToken returns the API key, or a token for the OAuth client,
+// which is reused until shortly before it expires.
+func (a *adminAPI) accessToken(ctx context.Context) (string, error) {
+	id, secret, ok := strings.Cut(a.key, ":")
+	if !ok {
+		return a.key, nil
+	}
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	if a.token != "" && time.Until(a.expires) > time.Minute {
+		return a.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {id},
+		"client_secret": {secret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.base+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth token: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	a.token = tok.AccessToken
+	a.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+// labels describes a peer from the last device list.
+func (a *adminAPI) labels(id tailcfg.StableNodeID) map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dev, ok := a.devices[id]
+	if !ok {
+		return nil
+	}
+	labels := map[string]string{
+		"__meta_tailscale_authorized":          strconv.FormatBool(dev.Authorized),
+		"__meta_tailscale_key_expiry_disabled": strconv.FormatBool(dev.KeyExpiryDisabled),
+	}
+	if !dev.KeyExpiryDisabled && !dev.Expires.IsZero() {
+		labels["__meta_tailscale_key_expiry"] = dev.Expires.UTC().Format(time.RFC3339)
+	}
+	return labels
+}
+
+// writeAPIMetrics exports what the API knows that this node cannot see.
+func (a *adminAPI) writeAPIMetrics(w *metrics.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w.Header("tailmon_discover_api_devices", "Devices the Tailscale API lists in the tailnet.", "gauge")
+	w.Sample("tailmon_discover_api_devices", nil, float64(len(a.devices)))
+	w.Header("tailmon_discover_api_unseen_device", "A tailmon node the Tailscale API lists but this node cannot see, always 1.", "gauge")
+	for _, dev := range a.unseen {
+		w.Sample("tailmon_discover_api_unseen_device", []string{"name", dev.Name, "hostname", dev.Hostname}, 1)
+	}
+	w.Header("tailmon_discover_api_deleted_devices_total", "Offline tailmon devices deleted with -delete-offline.", "counter")
+	w.Sample("tailmon_discover_api_deleted_devices_total", nil, float64(a.deleted))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// historyPath returns the most recent target changes, newest last,
+// filtered by ?node= and ?exporter=.
+const historyPath = "/history"
+
+// historyKeep is how many changes are kept for historyPath.
+const historyKeep = 1000
+
+// auditEntry is one target appearing or disappearing.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Change   string    `json:"change"` // add or remove
+	Node     string    `json:"node"`
+	Exporter string    `json:"exporter"`
+	Target   string    `json:"target"`
+	Tailnet  string    `json:"tailnet,omitempty"`
+}
+
+// auditLog records when targets come and go, in memory and, once
+// opened, appended to a file as JSON lines.  The zero value is ready to
+// use.
+type auditLog struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+	file   *os.File
+	recent []auditEntry
+}
+
+// open appends to path, first reading its last entries back as history.
+func (a *auditLog) open(logger *zap.Logger, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.logger = logger
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			a.remember(e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+func (a *auditLog) remember(e auditEntry) {
+	if len(a.recent) >= historyKeep {
+		a.recent = append(a.recent[:0], a.recent[len(a.recent)-historyKeep+1:]...)
+	}
+	a.recent = append(a.recent, e)
+}
+
+// record notes the adds and removes among events.  Updates, such as a
+// health label changing, are not recorded.
+func (a *auditLog) record(now time.Time, events []targetEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if ev.kind == "update" {
+			continue
+		}
+		e := auditEntry{
+			Time:     now.UTC(),
+			Change:   ev.kind,
+			Node:     ev.ep.node,
+			Exporter: ev.ep.exporter,
+			Target:   ev.ep.Targets[0] + metricsPath(ev.ep),
+		}
+		if ev.ep.via != nil {
+			e.Tailnet = ev.ep.via.name
+		}
+		a.remember(e)
+		_ = enc.Encode(e)
+	}
+	if a.file == nil || buf.Len() == 0 {
+		return
+	}
+	// One write, so that entries are never interleaved or split.
+	if _, err := a.file.Write(buf.Bytes()); err != nil {
+		a.logger.Error("audit log", zap.Error(err))
+	}
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func newHistoryHandler(a *auditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		node, exporter := q.Get("node"), q.Get("exporter")
+		a.mu.Lock()
+		entries := []auditEntry{}
+		for _, e := range a.recent {
+			if (node == "" || e.Node == node) && (exporter == "" || e.Exporter == exporter) {
+				entries = append(entries, e)
+			}
+		}
+		a.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(entries)
+	})
+}
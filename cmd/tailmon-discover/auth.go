@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// httpAuth requires a bearer token or basic auth, matching the
+// authorization and basic_auth options of Prometheus http_sd_configs.
+// Either one is enough when both are set.
+type httpAuth struct {
+	bearer   string
+	user     string
+	password string
+}
+
+func newHTTPAuth(bearer, userpass []byte) (*httpAuth, error) {
+	if len(bearer) == 0 && len(userpass) == 0 {
+		return nil, nil
+	}
+	a := &httpAuth{bearer: string(bearer)}
+	if len(userpass) > 0 {
+		user, password, ok := strings.Cut(string(userpass), ":")
+		if !ok {
+			return nil, errors.New("secret must be user:password")
+		}
+		a.user, a.password = user, password
+	}
+	return a, nil
+}
+
+func (a *httpAuth) allowed(r *http.Request) bool {
+	if a.bearer != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.bearer)) == 1 {
+			return true
+		}
+	}
+	if a.user != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			// Compare both, so timing does not tell which was wrong.
+			u := subtle.ConstantTimeCompare([]byte(user), []byte(a.user))
+			p := subtle.ConstantTimeCompare([]byte(password), []byte(a.password))
+			if u&p == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize adds our own credentials to req.
+func (a *httpAuth) authorize(req *http.Request) {
+	switch {
+	case a == nil:
+	case a.bearer != "":
+		req.Header.Set("Authorization", "Bearer "+a.bearer)
+	case a.user != "":
+		req.SetBasicAuth(a.user, a.password)
+	}
+}
+
+// wrap requires auth on every path except exempt, which check callers
+// some other way.
+func (a *httpAuth) wrap(next http.Handler, exempt ...string) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if !a.allowed(r) {
+			if a.user != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tailmon-discover"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tailmon-discover"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
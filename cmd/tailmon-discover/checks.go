@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// checkHost is a node as a host of check-based monitoring, with a
+// service per exporter.
+type checkHost struct {
+	name, address, dnsName string
+	services               []checkService
+}
+
+type checkService struct {
+	exporter, port, path string
+}
+
+// checkHosts groups endpoints by node.  Hosts on a joined tailnet are
+// named TAILNET/NODE, and grouped endpoints without a node are left out.
+func checkHosts(endpoints []*Endpoint) []*checkHost {
+	var hosts []*checkHost
+	byName := map[string]*checkHost{}
+	seen := map[[2]string]bool{}
+	for _, ep := range endpoints {
+		if ep.node == "" || len(ep.Targets) == 0 {
+			continue
+		}
+		name := ep.node
+		if ep.via != nil && ep.via.name != "" {
+			name = ep.via.name + "/" + ep.node
+		}
+		_, port, err := net.SplitHostPort(ep.Targets[0])
+		if err != nil {
+			continue
+		}
+		h, ok := byName[name]
+		if !ok {
+			h = &checkHost{name: name, address: ep.ip.String(), dnsName: strings.TrimSuffix(ep.Labels["__meta_tailscale_dns_name"], ".")}
+			byName[name] = h
+			hosts = append(hosts, h)
+		}
+		// With both address families, each exporter is listed twice.
+		if seen[[2]string{name, ep.exporter}] {
+			continue
+		}
+		seen[[2]string{name, ep.exporter}] = true
+		h.services = append(h.services, checkService{ep.exporter, port, metricsPath(ep)})
+	}
+	return hosts
+}
+
+// nagiosName replaces the characters Nagios forbids in object names.
+func nagiosName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune("~!$%^&*|'\"<>?,()=`", r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// encodeNagios writes a Nagios host per node and a service per exporter
+// that checks its metrics path with check_http.  ?host_template= and
+// ?service_template= name the templates they use, generic-host and
+// generic-service by default.
+func encodeNagios(w io.Writer, endpoints []*Endpoint, _ string, r *http.Request) error {
+	hostTemplate, serviceTemplate := checkTemplates(r)
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Generated by tailmon-discover.\n")
+	for _, h := range checkHosts(endpoints) {
+		name := nagiosName(h.name)
+		alias := h.dnsName
+		if alias == "" {
+			alias = name
+		}
+		fmt.Fprintf(bw, "\ndefine host {\n")
+		fmt.Fprintf(bw, "    use                  %s\n", nagiosName(hostTemplate))
+		fmt.Fprintf(bw, "    host_name            %s\n", name)
+		fmt.Fprintf(bw, "    alias                %s\n", nagiosName(alias))
+		fmt.Fprintf(bw, "    address              %s\n", h.address)
+		fmt.Fprintf(bw, "}\n")
+		for _, s := range h.services {
+			fmt.Fprintf(bw, "\ndefine service {\n")
+			fmt.Fprintf(bw, "    use                  %s\n", nagiosName(serviceTemplate))
+			fmt.Fprintf(bw, "    host_name            %s\n", name)
+			fmt.Fprintf(bw, "    service_description  %s\n", nagiosName(s.exporter))
+			fmt.Fprintf(bw, "    check_command        check_http!-p %s -u %s\n", s.port, nagiosName(s.path))
+			fmt.Fprintf(bw, "}\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// encodeIcinga writes an Icinga 2 Host object per node and a Service per
+// exporter using the ITL's http check, with the same templates as
+// encodeNagios.
+func encodeIcinga(w io.Writer, endpoints []*Endpoint, _ string, r *http.Request) error {
+	hostTemplate, serviceTemplate := checkTemplates(r)
+	bw := bufio.NewWriter(w)
+	bw.WriteString("// Generated by tailmon-discover.\n")
+	for _, h := range checkHosts(endpoints) {
+		fmt.Fprintf(bw, "\nobject Host %s {\n", strconv.Quote(h.name))
+		fmt.Fprintf(bw, "  import %s\n", strconv.Quote(hostTemplate))
+		fmt.Fprintf(bw, "  address = %s\n", strconv.Quote(h.address))
+		if h.dnsName != "" {
+			fmt.Fprintf(bw, "  vars.tailscale_dns_name = %s\n", strconv.Quote(h.dnsName))
+		}
+		fmt.Fprintf(bw, "}\n")
+		for _, s := range h.services {
+			fmt.Fprintf(bw, "\nobject Service %s {\n", strconv.Quote(s.exporter))
+			fmt.Fprintf(bw, "  import %s\n", strconv.Quote(serviceTemplate))
+			fmt.Fprintf(bw, "  host_name = %s\n", strconv.Quote(h.name))
+			fmt.Fprintf(bw, "  check_command = \"http\"\n")
+			fmt.Fprintf(bw, "  vars.http_port = %s\n", s.port)
+			fmt.Fprintf(bw, "  vars.http_uri = %s\n", strconv.Quote(s.path))
+			fmt.Fprintf(bw, "}\n")
+		}
+	}
+	return bw.Flush()
+}
+
+func checkTemplates(r *http.Request) (host, service string) {
+	q := r.URL.Query()
+	host, service = q.Get("host_template"), q.Get("service_template")
+	if host == "" {
+		host = "generic-host"
+	}
+	if service == "" {
+		service = "generic-service"
+	}
+	return host, service
+}
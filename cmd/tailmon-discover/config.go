@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configPath serves ready-to-use configuration for scraping the targets,
+// like /config/alloy.  Filters such as ?exporter= are carried into the
+// discovery URL, and ?url= overrides how tailmon-discover is reached.
+const configPath = "/config/"
+
+// configGenerator writes configuration reading the targets from sdURL,
+// whose tailmon labels start with prefix.
+type configGenerator struct {
+	contentType string
+	write       func(w io.Writer, sdURL, prefix string, q url.Values) error
+}
+
+var configGenerators = map[string]configGenerator{
+	"alloy":      {"text/plain; charset=utf-8", writeAlloyConfig},
+	"prometheus": {"application/yaml; charset=utf-8", writePrometheusConfig},
+	"vmagent":    {"application/yaml; charset=utf-8", writeVMAgentConfig},
+}
+
+// filterParams are the query parameters passed through to the SD URL.
+var filterParams = []string{"exporter", "node", "label", "group", "shards", "shard", "version"}
+
+func newConfigHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := strings.TrimPrefix(r.URL.Path, configPath)
+		gen, ok := configGenerators[kind]
+		if !ok {
+			kinds := make([]string, 0, len(configGenerators))
+			for k := range configGenerators {
+				kinds = append(kinds, configPath+k)
+			}
+			sort.Strings(kinds)
+			http.Error(w, fmt.Sprintf("unknown config, want one of %q", kinds), http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		if _, err := parseTargetFilter(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		if err := gen.write(&buf, sdURL(r), prefix, q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", gen.contentType)
+		_, _ = w.Write(buf.Bytes())
+	})
+}
+
+// sdURL is where the generated configuration finds the targets.
+func sdURL(r *http.Request) string {
+	q := r.URL.Query()
+	base := q.Get("url")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host + "/"
+	}
+	sd := url.Values{}
+	for _, name := range filterParams {
+		if values, ok := q[name]; ok {
+			sd[name] = values
+		}
+	}
+	if len(sd) == 0 {
+		return base
+	}
+	return base + "?" + sd.Encode()
+}
+
+var alloyReference = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)+$`)
+
+// writeAlloyConfig writes a Grafana Alloy pipeline that discovers the
+// targets, names the job from -jobs, and scrapes them.
+// ?forward_to= names the receiver, prometheus.remote_write.default by
+// default.
+func writeAlloyConfig(w io.Writer, sdURL, prefix string, q url.Values) error {
+	forwardTo := q.Get("forward_to")
+	if forwardTo == "" {
+		forwardTo = "prometheus.remote_write.default.receiver"
+	}
+	if !alloyReference.MatchString(forwardTo) {
+		return fmt.Errorf("forward_to %q is not a component export like prometheus.remote_write.default.receiver", forwardTo)
+	}
+	_, err := fmt.Fprintf(w, `// Generated by tailmon-discover.
+discovery.http "tailmon" {
+  url              = %[1]s
+  refresh_interval = "30s"
+}
+
+discovery.relabel "tailmon" {
+  targets = discovery.http.tailmon.targets
+
+  rule {
+    source_labels = [%[3]s]
+    target_label  = "job"
+  }
+
+  rule {
+    source_labels = [%[4]s]
+    target_label  = "node"
+  }
+}
+
+prometheus.scrape "tailmon" {
+  targets    = discovery.relabel.tailmon.output
+  forward_to = [%[2]s]
+}
+`, strconv.Quote(sdURL), forwardTo, strconv.Quote(prefix+"job"), strconv.Quote(prefix+"node_name"))
+	return err
+}
+
+var jobName = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// writePrometheusConfig writes a scrape_configs job using HTTP SD, with
+// relabeling that turns the tailmon labels into node, exporter and
+// instance, and drops nodes whose heartbeats stopped.  ?job= names the
+// job, tailmon by default.  With ?proxy=1, scrapes go through the
+// discover node's /scrape, for a Prometheus off the tailnet.
+func writePrometheusConfig(w io.Writer, sdURL, prefix string, q url.Values) error {
+	job := q.Get("job")
+	if job == "" {
+		job = "tailmon"
+	}
+	if !jobName.MatchString(job) {
+		return fmt.Errorf("job %q may only use letters, digits and _.:-", job)
+	}
+	_, err := fmt.Fprintf(w, `# Generated by tailmon-discover.
+scrape_configs:
+  - job_name: %[1]s
+    http_sd_configs:
+      - url: %[2]s
+    relabel_configs:
+      - source_labels: [%[3]salive]
+        regex: "false"
+        action: drop
+      - source_labels: [%[3]sexporter_name]
+        target_label: exporter
+      - source_labels: [%[3]snode_name]
+        target_label: node
+      - source_labels: [%[3]snode_name]
+        target_label: instance
+`, yamlString(job), yamlString(sdURL), prefix)
+	if err != nil || q.Get("proxy") == "" {
+		return err
+	}
+	return writeProxyRelabeling(w, sdURL, prefix, q)
+}
+
+// writeVMAgentConfig writes the same job for VictoriaMetrics vmagent's
+// -promscrape.config, dropping stopped nodes with a series selector as
+// vmagent prefers.  It takes the same ?job= and ?proxy=1.
+func writeVMAgentConfig(w io.Writer, sdURL, prefix string, q url.Values) error {
+	job := q.Get("job")
+	if job == "" {
+		job = "tailmon"
+	}
+	if !jobName.MatchString(job) {
+		return fmt.Errorf("job %q may only use letters, digits and _.:-", job)
+	}
+	_, err := fmt.Fprintf(w, `# Generated by tailmon-discover, for vmagent -promscrape.config.
+scrape_configs:
+  - job_name: %[1]s
+    http_sd_configs:
+      - url: %[2]s
+    relabel_configs:
+      - action: drop
+        if: %[4]s
+      - source_labels: [%[3]sexporter_name]
+        target_label: exporter
+      - source_labels: [%[3]snode_name]
+        target_label: node
+      - source_labels: [%[3]snode_name]
+        target_label: instance
+`, yamlString(job), yamlString(sdURL), prefix, yamlString("{"+prefix+`alive="false"}`))
+	if err != nil || q.Get("proxy") == "" {
+		return err
+	}
+	return writeProxyRelabeling(w, sdURL, prefix, q)
+}
+
+// writeProxyRelabeling sends the job's scrapes through the discover
+// node's /scrape, over https if the SD URL is.  /scrape takes the same
+// -bearer or -basic-auth as SD, which the job has to be given by hand.
+// ?group= is refused, since a grouped target has no one node to proxy.
+func writeProxyRelabeling(w io.Writer, sdURL, prefix string, q url.Values) error {
+	if q.Has("group") {
+		return fmt.Errorf("group cannot be used with proxy, which scrapes each node by name")
+	}
+	u, err := url.Parse(sdURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		if _, err := fmt.Fprint(w, `      - target_label: __scheme__
+        replacement: https
+`); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, `      - source_labels: [%[1]snode_name]
+        target_label: __param_target
+      - source_labels: [%[1]sexporter_name]
+        target_label: __param_exporter
+      - source_labels: [%[1]stailnet]
+        target_label: __param_tailnet
+      - target_label: __metrics_path__
+        replacement: %[2]s
+      - target_label: __address__
+        replacement: %[3]s
+    # With -bearer or -basic-auth, /scrape needs them too: give this job
+    # the same authorization or basic_auth as its http_sd_configs.
+`, prefix, yamlString(scrapePath), yamlString(u.Host))
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// knownNode is a tailmon node discovery has listed since it started, or
+// that the audit log remembers.
+type knownNode struct {
+	node, tailnet string
+	seen          time.Time // last listed
+	missing       bool
+}
+
+// trackNodes notes which known nodes snap lists, so that a node that
+// silently leaves the tailnet is exported as missing rather than just
+// dropping out, which no "up" alert can catch.  Hold d.mu.
+func (d *discoverer) trackNodes(snap *snapshot) {
+	if d.known == nil {
+		d.known = map[string]*knownNode{}
+		d.rememberNodes()
+	}
+	listed := map[string]bool{}
+	for _, ep := range snap.endpoints {
+		k := &knownNode{node: ep.node, seen: snap.fetched}
+		if ep.via != nil {
+			k.tailnet = ep.via.name
+		}
+		key := k.tailnet + "/" + k.node
+		listed[key] = true
+		d.known[key] = k
+	}
+	for key, k := range d.known {
+		switch {
+		case listed[key]:
+		case d.forgetMissing > 0 && snap.fetched.Sub(k.seen) > d.forgetMissing:
+			delete(d.known, key)
+		default:
+			k.missing = true
+		}
+	}
+}
+
+// rememberNodes seeds the known nodes from the audit log, so nodes that
+// vanished before a restart are still missing after it.
+func (d *discoverer) rememberNodes() {
+	d.audit.mu.Lock()
+	defer d.audit.mu.Unlock()
+	for _, e := range d.audit.recent {
+		d.known[e.Tailnet+"/"+e.Node] = &knownNode{node: e.Node, tailnet: e.Tailnet, seen: e.Time}
+	}
+}
+
+// writeMissingMetrics exports every known node, missing or not.
+func (d *discoverer) writeMissingMetrics(w *metrics.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]string, 0, len(d.known))
+	for key := range d.known {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := func(k *knownNode) []string {
+		l := []string{"node", k.node}
+		if k.tailnet != "" {
+			l = append(l, "tailnet", k.tailnet)
+		}
+		return l
+	}
+	w.Header("tailmon_target_missing", "Whether a tailmon node discovery once listed has disappeared.", "gauge")
+	for _, key := range keys {
+		k := d.known[key]
+		w.Sample("tailmon_target_missing", labels(k), boolValue(k.missing))
+	}
+	w.Header("tailmon_target_last_seen_timestamp_seconds", "When discovery last listed the node.", "gauge")
+	for _, key := range keys {
+		k := d.known[key]
+		w.Sample("tailmon_target_last_seen_timestamp_seconds", labels(k), float64(k.seen.UnixNano())/1e9)
+	}
+}
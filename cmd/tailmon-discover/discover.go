@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// hostnamePrefix marks tailmon nodes named like "tailmon/EXPORTER/NODE".
+const hostnamePrefix = "tailmon/"
+
+// withdrawnPrefix marks tailmon nodes whose upstreams are down, which
+// keep their tags but have nothing to scrape.
+const withdrawnPrefix = "tailmon-withdrawn/"
+
+type Endpoint struct {
+	ip       netip.Addr // for output sort
+	via      *tailnet   // reaches the target
+	node     string     // whatever the label prefix
+	exporter string
+	job      string
+	Targets  []string          `json:"targets"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// tailnet is one network discover has joined.
+type tailnet struct {
+	// name labels the targets when several tailnets are joined.
+	name   string
+	srv    *tsnet.Server
+	client *http.Client // srv.HTTPClient, made once
+	whois  *whoisCache
+}
+
+func newTailnet(name string, srv *tsnet.Server, whoisTTL time.Duration) *tailnet {
+	return &tailnet{name: name, srv: srv, client: srv.HTTPClient(), whois: newWhoisCache(srv, whoisTTL)}
+}
+
+// discoverer finds tailmon nodes among the tailnet peers.
+type discoverer struct {
+	// tailnets are searched for targets.  The first is the main one,
+	// which other tailmon-discover instances are reached over.
+	tailnets   []*tailnet
+	heartbeats *heartbeats
+
+	// matchHostname finds nodes by the "tailmon/" hostname prefix.
+	matchHostname bool
+
+	// tags finds nodes carrying any of these ACL tags, like "tag:tailmon".
+	tags []string
+
+	// allPeers, when set, lists every other peer as these exporters.
+	allPeers *tailmonNode
+
+	// maxAge is how long endpoints are served from the cache before
+	// a request waits for a fresh Status.  Zero disables the cache.
+	maxAge time.Duration
+
+	// family chooses between the peer's IPv4 and IPv6 addresses, like
+	// familyIPv4.  Empty is familyFirst.
+	family string
+
+	// magicDNS lists targets by the peer's MagicDNS name rather than
+	// its address.
+	magicDNS bool
+
+	// include, when set, keeps only peers whose hostname it matches,
+	// and exclude leaves out those it matches.
+	include, exclude *regexp.Regexp
+
+	// offlineAfter leaves out peers offline for longer than this.
+	// Zero keeps them all.
+	offlineAfter time.Duration
+
+	// labelPrefix starts the tailmon labels, like "__meta_tailmon_".
+	labelPrefix string
+
+	// staticLabels are added to every target, like tailnet="prod".
+	staticLabels map[string]string
+
+	// scrapeHints suggest a scrape interval and timeout by exporter.
+	scrapeHints map[string]scrapeHint
+
+	// jobs are -jobs, in order.
+	jobs []jobRule
+
+	// signKey, if set, signs SD responses in signatureHeader.
+	signKey []byte
+
+	// upstreams, if set, adds other discover instances' targets.
+	upstreams *upstreams
+
+	// grace keeps a target that disappears for this long, so a peer
+	// that briefly leaves Status does not flap.  Zero drops it at once.
+	grace time.Duration
+
+	// forgetMissing stops reporting a vanished node as missing after
+	// this long.  Zero reports it until restart.
+	forgetMissing time.Duration
+
+	// api labels the main tailnet's targets from the Tailscale API
+	// when set.
+	api *adminAPI
+
+	// alertmanagerTags finds Alertmanagers by ACL tag, besides those
+	// named like "alertmanager/NODE[/PORT]", listening on
+	// alertmanagerPort unless the name gives another.
+	alertmanagerTags []string
+	alertmanagerPort int
+
+	// health probes targets when set.
+	health *healthChecker
+
+	// federateTimeout bounds the scrapes of federatePath, which is
+	// only served when it is set.
+	federateTimeout time.Duration
+
+	// ping measures the path to each tailmon node when set.
+	ping *pinger
+
+	// load estimates the cost of scraping every target when set.
+	load *loadEstimator
+
+	// enrich runs the -enrich hook over the targets when set.
+	enrich *enricher
+
+	refreshMu sync.Mutex              // held while fetching Status
+	lastSeen  map[string]seenEndpoint // for grace; hold refreshMu
+	mu        sync.Mutex
+	cached    *snapshot
+	wake      chan struct{} // from watch to refresh
+	events    eventHub      // changes to cached
+	audit     auditLog
+	known     map[string]*knownNode // by tailnet/node; hold mu
+
+	// cache saves the targets when set, and stale holds those it had
+	// saved before a restart until ready, when the main tailnet runs.
+	cache *targetCache
+	stale *snapshot
+	ready <-chan struct{}
+}
+
+type seenEndpoint struct {
+	ep   *Endpoint
+	seen time.Time
+}
+
+// snapshot is one fetch of the endpoints.  It is shared by every caller
+// and must not be modified.
+type snapshot struct {
+	endpoints     []*Endpoint
+	alertmanagers []*Endpoint
+	fetched       time.Time
+	sum           [sha256.Size]byte // of the endpoints
+	changed       time.Time         // when sum last differed
+}
+
+func (d *discoverer) hasTag(v *ipnstate.PeerStatus) bool {
+	if v.Tags == nil {
+		return false
+	}
+	for i := 0; i < v.Tags.Len(); i++ {
+		for _, tag := range d.tags {
+			if v.Tags.At(i) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jobRule is an entry of -jobs: the job for an exporter, or for every
+// exporter of nodes with a tag.
+type jobRule struct {
+	exporter, tag string // one of them
+	job           string
+}
+
+// jobName returns the first -jobs rule matching the exporter on v, or
+// else the exporter's own name.
+func (d *discoverer) jobName(exporter string, v *ipnstate.PeerStatus) string {
+	for _, rule := range d.jobs {
+		if rule.exporter == exporter {
+			return rule.job
+		}
+		if rule.tag != "" && v.Tags != nil && slices.Contains(v.Tags.AsSlice(), rule.tag) {
+			return rule.job
+		}
+	}
+	return exporter
+}
+
+// scrapeHint is an exporter's entry in -scrape-hints.
+type scrapeHint struct {
+	interval, timeout time.Duration // zero to leave to Prometheus
+}
+
+// label sets the labels Prometheus reads the hint from.
+func (h scrapeHint) label(labels map[string]string) {
+	if h.interval > 0 {
+		labels["__scrape_interval__"] = promDuration(h.interval)
+	}
+	if h.timeout > 0 {
+		labels["__scrape_timeout__"] = promDuration(h.timeout)
+	}
+}
+
+// promDuration formats d as Prometheus parses it, like 1m30s or 500ms,
+// rather than time.Duration's 1.5s.
+func promDuration(d time.Duration) string {
+	if d%time.Second != 0 {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+	var b strings.Builder
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if n := d / unit.d; n > 0 {
+			b.WriteString(strconv.FormatInt(int64(n), 10) + unit.name)
+			d -= n * unit.d
+		}
+	}
+	return b.String()
+}
+
+// tailmonNode is what a peer's name or heartbeat says it serves.
+type tailmonNode struct {
+	exporters []string
+	node      string
+	port      int
+	path      string // metrics path, if not the usual
+
+	// ports are exporters served by themselves on another port, at
+	// paths if not the usual, rather than sharing port.
+	ports map[string]int
+	paths map[string]string
+}
+
+// exporterPort returns where an exporter is scraped.
+func (tn *tailmonNode) exporterPort(exporter string) (port int, path string) {
+	if port, ok := tn.ports[exporter]; ok {
+		return port, tn.paths[exporter]
+	}
+	if len(tn.exporters) > 1 {
+		return tn.port, "/" + exporter + "/metrics"
+	}
+	return tn.port, tn.path
+}
+
+// parseAllPeers parses -all-peers, a comma separated list like
+// "node-exporter:9100" or "node-exporter:9100,process-exporter:9256/metrics".
+// Each exporter has its own port.
+func parseAllPeers(s string) (*tailmonNode, error) {
+	tn := &tailmonNode{ports: map[string]int{}, paths: map[string]string{}}
+	for _, field := range splitList(s) {
+		exporter, rest, ok := strings.Cut(field, ":")
+		if !ok || exporter == "" {
+			return nil, fmt.Errorf("%q is not EXPORTER:PORT[/PATH]", field)
+		}
+		portStr, path, _ := strings.Cut(rest, "/")
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%q has no valid port", field)
+		}
+		if _, dup := tn.ports[exporter]; dup {
+			return nil, fmt.Errorf("%q is listed twice", exporter)
+		}
+		tn.exporters = append(tn.exporters, exporter)
+		tn.ports[exporter] = port
+		if path != "" && path != "metrics" {
+			tn.paths[exporter] = "/" + path
+		}
+	}
+	if len(tn.exporters) == 0 {
+		return nil, fmt.Errorf("%q lists no exporters", s)
+	}
+	tn.port = tn.ports[tn.exporters[0]]
+	return tn, nil
+}
+
+// parseHostname splits a hostname like "tailmon/node-exporter/node1"
+// or "tailmon/node-exporter/node1/9100".  The port is zero if absent.
+func parseHostname(hostname string) tailmonNode {
+	parts := strings.SplitN(strings.TrimPrefix(hostname, hostnamePrefix), "/", 3)
+	if len(parts) < 2 {
+		return tailmonNode{exporters: []string{hostname}, node: "unknown"}
+	}
+	tn := tailmonNode{exporters: strings.Split(parts[0], ","), node: parts[1]}
+	if len(parts) == 3 {
+		if port, err := strconv.Atoi(parts[2]); err == nil && port > 0 && port <= 65535 {
+			tn.port = port
+		} else {
+			tn.node = parts[1] + "/" + parts[2]
+		}
+	}
+	return tn
+}
+
+// lookup returns what a peer serves, or false if the peer is not a
+// tailmon node.
+//
+// Hostnames like "tailmon/node-exporter/node1" give both the exporters
+// and the node directly.  A node started with "tailmon -shared" lists
+// several exporters, each served at /EXPORTER/metrics.  The node name
+// its heartbeat registers is read instead when there is one, since
+// tailscale shortens long hostnames.  A tagged peer without such a name
+// is described by its heartbeat, or failing that is taken to be a
+// single exporter named after it.  With -all-peers, any other peer is
+// that exporter.  Withdrawn nodes are never listed.
+func (d *discoverer) lookup(v *ipnstate.PeerStatus) (tailmonNode, bool) {
+	var tn tailmonNode
+	beat, hasBeat := d.heartbeats.get(v.ID)
+	switch {
+	case strings.HasPrefix(v.HostName, withdrawnPrefix):
+		return tn, false
+	case strings.HasPrefix(v.HostName, hostnamePrefix) && (d.matchHostname || d.hasTag(v)):
+		name := v.HostName
+		if hasBeat && strings.HasPrefix(beat.Node, hostnamePrefix) {
+			name = beat.Node
+		}
+		tn = parseHostname(name)
+	case d.hasTag(v) && hasBeat && len(beat.Exporters) > 0:
+		tn.node = v.HostName
+		for _, ep := range beat.Exporters {
+			tn.exporters = append(tn.exporters, ep.Name)
+		}
+	case d.hasTag(v):
+		tn = tailmonNode{exporters: []string{v.HostName}, node: v.HostName}
+	case d.allPeers != nil:
+		tn = *d.allPeers
+		tn.node = v.HostName
+		tn.ports, tn.paths = maps.Clone(tn.ports), maps.Clone(tn.paths)
+	default:
+		return tn, false
+	}
+	if hasBeat && tn.port == 0 {
+		tn.port = beat.Port
+	}
+	if tn.port == 0 {
+		tn.port = 80
+	}
+	return tn, true
+}
+
+// peerLabels describes v for relabeling.  Labels that would be empty
+// are left out.
+func peerLabels(status *ipnstate.Status, v *ipnstate.PeerStatus) map[string]string {
+	labels := map[string]string{
+		"__meta_tailscale_dns_name":  v.DNSName,
+		"__meta_tailscale_online":    strconv.FormatBool(v.Online),
+		"__meta_tailscale_exit_node": strconv.FormatBool(v.ExitNodeOption),
+		"__meta_tailscale_shared":    strconv.FormatBool(v.ShareeNode),
+	}
+	if machine, _, _ := strings.Cut(v.DNSName, "."); machine != "" {
+		labels["__meta_tailscale_machine_name"] = machine
+	}
+	if v.HostName != "" {
+		labels["__meta_tailscale_hostname"] = v.HostName
+	}
+	if v.OS != "" {
+		labels["__meta_tailscale_os"] = v.OS
+	}
+	if v.Tags != nil && v.Tags.Len() > 0 {
+		labels["__meta_tailscale_tags"] = "," + strings.Join(v.Tags.AsSlice(), ",") + ","
+	}
+	if profile, ok := status.User[v.UserID]; ok && profile.LoginName != "" {
+		labels["__meta_tailscale_user"] = profile.LoginName
+	}
+	if v.Relay != "" {
+		labels["__meta_tailscale_relay"] = v.Relay
+	}
+	if !v.Created.IsZero() {
+		labels["__meta_tailscale_created"] = v.Created.UTC().Format(time.RFC3339)
+	}
+	if !v.Online && !v.LastSeen.IsZero() {
+		labels["__meta_tailscale_last_seen"] = v.LastSeen.UTC().Format(time.RFC3339)
+	}
+	return labels
+}
+
+// label names a tailmon label, like __meta_tailmon_node_name.
+func (d *discoverer) label(name string) string {
+	return d.labelPrefix + name
+}
+
+// Address families for -address-family.
+const (
+	familyFirst = "first" // the peer's first address
+	familyIPv4  = "ipv4"  // IPv4, or the first address without one
+	familyIPv6  = "ipv6"  // IPv6, or the first address without one
+	familyBoth  = "both"  // one target per family
+)
+
+// addresses picks the peer's addresses to list as targets.
+func (d *discoverer) addresses(ips []netip.Addr) []netip.Addr {
+	if len(ips) == 0 {
+		return nil
+	}
+	switch d.family {
+	case familyBoth:
+		return ips
+	case familyIPv4, familyIPv6:
+		for i, ip := range ips {
+			if ip.Is4() == (d.family == familyIPv4) {
+				return ips[i : i+1]
+			}
+		}
+	}
+	return ips[:1]
+}
+
+// hostnameWanted applies -include and -exclude.
+func (d *discoverer) hostnameWanted(hostname string) bool {
+	if d.include != nil && !d.include.MatchString(hostname) {
+		return false
+	}
+	return d.exclude == nil || !d.exclude.MatchString(hostname)
+}
+
+// offlineTooLong reports whether v has been offline past offlineAfter.
+// A peer never seen online counts as offline forever.
+func (d *discoverer) offlineTooLong(v *ipnstate.PeerStatus, now time.Time) bool {
+	if d.offlineAfter <= 0 || v.Online {
+		return false
+	}
+	return v.LastSeen.IsZero() || now.Sub(v.LastSeen) > d.offlineAfter
+}
+
+// findTailmonEndpoints returns the targets and the Alertmanagers.
+func (d *discoverer) findTailmonEndpoints(ctx context.Context) ([]*Endpoint, []*Endpoint, error) {
+	// An empty list, not null, when nothing is found.
+	endpoints := []*Endpoint{}
+	alertmanagers := []*Endpoint{}
+	now := time.Now()
+
+	for _, via := range d.tailnets {
+		found, ams, err := d.tailnetEndpoints(ctx, via, now)
+		if err != nil {
+			if len(d.tailnets) > 1 {
+				err = fmt.Errorf("tailnet %s: %w", via.name, err)
+			}
+			return nil, nil, err
+		}
+		endpoints = append(endpoints, found...)
+		alertmanagers = append(alertmanagers, ams...)
+	}
+
+	sortEndpoints(endpoints)
+	sortEndpoints(alertmanagers)
+	return endpoints, alertmanagers, nil
+}
+
+// sortEndpoints gives endpoints a stable order, so that instances agree
+// byte for byte.
+func sortEndpoints(endpoints []*Endpoint) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].via.name != endpoints[j].via.name {
+			return endpoints[i].via.name < endpoints[j].via.name
+		}
+		if endpoints[i].ip != endpoints[j].ip {
+			return endpoints[i].ip.Less(endpoints[j].ip)
+		}
+		return endpoints[i].exporter < endpoints[j].exporter
+	})
+}
+
+// keepMissing adds endpoints that disappeared less than grace ago, as
+// they were last seen.  Hold refreshMu.
+func (d *discoverer) keepMissing(eps []*Endpoint, now time.Time) []*Endpoint {
+	if d.grace <= 0 {
+		return eps
+	}
+	if d.lastSeen == nil {
+		d.lastSeen = map[string]seenEndpoint{}
+	}
+	found := make(map[string]bool, len(eps))
+	for _, ep := range eps {
+		key := endpointKey(ep)
+		found[key] = true
+		d.lastSeen[key] = seenEndpoint{ep, now}
+	}
+	kept := false
+	for key, s := range d.lastSeen {
+		switch {
+		case found[key]:
+		case now.Sub(s.seen) > d.grace:
+			delete(d.lastSeen, key)
+		default:
+			eps = append(eps, s.ep)
+			kept = true
+		}
+	}
+	if kept {
+		sortEndpoints(eps)
+	}
+	return eps
+}
+
+// tailnetEndpoints finds the tailmon nodes and Alertmanagers among via's
+// peers.
+func (d *discoverer) tailnetEndpoints(ctx context.Context, via *tailnet, now time.Time) ([]*Endpoint, []*Endpoint, error) {
+	lc, err := via.srv.LocalClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var endpoints, alertmanagers []*Endpoint
+	for _, v := range status.Peer {
+		if node, port, ok := d.alertmanager(v); ok && len(v.TailscaleIPs) > 0 && !d.offlineTooLong(v, now) {
+			alertmanagers = append(alertmanagers, d.alertmanagerEndpoint(status, via, v, node, port))
+		}
+		found, _ := d.peerEndpoints(status, via, v, now)
+		endpoints = append(endpoints, found...)
+	}
+	return endpoints, alertmanagers, nil
+}
+
+// peerEndpoints returns v's targets, or why it has none.
+func (d *discoverer) peerEndpoints(status *ipnstate.Status, via *tailnet, v *ipnstate.PeerStatus, now time.Time) ([]*Endpoint, string) {
+	tn, ok := d.lookup(v)
+	if !ok {
+		return nil, d.notTailmonReason(v)
+	}
+	addrs := d.addresses(v.TailscaleIPs)
+	if len(addrs) == 0 {
+		return nil, "no tailscale addresses"
+	}
+	dnsName := strings.TrimSuffix(v.DNSName, ".")
+	if d.magicDNS && dnsName != "" {
+		// The name already covers every address.
+		addrs = addrs[:1]
+	}
+	if d.offlineTooLong(v, now) {
+		return nil, "offline longer than -offline-after"
+	}
+	if !d.hostnameWanted(v.HostName) {
+		return nil, "hostname left out by -include or -exclude"
+	}
+	if len(tn.exporters) == 0 {
+		return nil, "lists no exporters"
+	}
+
+	beat, hasBeat := d.heartbeats.get(v.ID)
+	peer := peerLabels(status, v)
+	if d.api != nil && via == d.tailnets[0] {
+		maps.Copy(peer, d.api.labels(v.ID))
+	}
+
+	var endpoints []*Endpoint
+	for _, name := range tn.exporters {
+		port, path := tn.exporterPort(name)
+		job := d.jobName(name, v)
+		for _, ip := range addrs {
+			// Prometheus scrapes all endpoints we provide,
+			// so only provide one address per peer unless
+			// asked for both families.
+			endpoint := &Endpoint{
+				ip:       ip, // for sorting
+				via:      via,
+				node:     tn.node,
+				exporter: name,
+				job:      job,
+				Targets:  []string{net.JoinHostPort(ip.String(), strconv.Itoa(port))},
+				Labels: map[string]string{
+					d.label("node_name"):     tn.node,
+					d.label("exporter_name"): name,
+					d.label("job"):           job,
+					"__meta_tailscale_ip":    ip.String(),
+				},
+			}
+			if d.magicDNS && dnsName != "" {
+				endpoint.Targets[0] = net.JoinHostPort(dnsName, strconv.Itoa(port))
+			}
+			maps.Copy(endpoint.Labels, peer)
+			if hasBeat {
+				beat.label(name, endpoint.Labels)
+			}
+			maps.Copy(endpoint.Labels, d.staticLabels)
+			if hint, ok := d.scrapeHints[name]; ok {
+				hint.label(endpoint.Labels)
+			}
+			if via.name != "" {
+				endpoint.Labels[d.label("tailnet")] = via.name
+			}
+			if path != "" {
+				endpoint.Labels["__metrics_path__"] = path
+			}
+			if hasBeat {
+				endpoint.Labels[d.label("version")] = beat.Version
+				if beat.GoVersion != "" {
+					endpoint.Labels[d.label("go_version")] = beat.GoVersion
+				}
+				if beat.tailscaleVersion != "" {
+					endpoint.Labels["__meta_tailscale_version"] = beat.tailscaleVersion
+				}
+				endpoint.Labels[d.label("alive")] = strconv.FormatBool(beat.alive(now))
+				if up, ok := beat.up(name); ok {
+					endpoint.Labels[d.label("upstream_up")] = strconv.FormatBool(up)
+				}
+			}
+			if d.health != nil {
+				if th, ok := d.health.status(endpoint); ok {
+					endpoint.Labels[d.label("healthy")] = strconv.FormatBool(th.healthy)
+				}
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, ""
+}
+
+// notTailmonReason explains why lookup passed over v.
+func (d *discoverer) notTailmonReason(v *ipnstate.PeerStatus) string {
+	if strings.HasPrefix(v.HostName, hostnamePrefix) {
+		return "hostname starts with " + hostnamePrefix + " but -match-hostname is off and the peer has none of -tags"
+	}
+	if len(d.tags) > 0 {
+		return "hostname does not start with " + hostnamePrefix + " and the peer has none of -tags"
+	}
+	return "hostname does not start with " + hostnamePrefix
+}
+
+// endpoints returns the cached endpoints if they are younger than
+// maxAge, and otherwise fetches them.
+func (d *discoverer) endpoints(ctx context.Context) (*snapshot, error) {
+	if snap, ok := d.fromCache(); ok {
+		return snap, nil
+	}
+	if snap := d.staleSnapshot(); snap != nil {
+		return snap, nil
+	}
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	// Someone else may have refreshed while we waited.
+	if snap, ok := d.fromCache(); ok {
+		return snap, nil
+	}
+	return d.fetch(ctx)
+}
+
+func (d *discoverer) fromCache() (*snapshot, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cached == nil || d.maxAge <= 0 || time.Since(d.cached.fetched) > d.maxAge {
+		return nil, false
+	}
+	return d.cached, true
+}
+
+// staleSnapshot returns the targets loaded from -target-cache while the
+// main tailnet is still coming up, and nil after.
+func (d *discoverer) staleSnapshot() *snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stale == nil {
+		return nil
+	}
+	select {
+	case <-d.ready:
+		d.stale = nil
+		return nil
+	default:
+		return d.stale
+	}
+}
+
+// fetch finds the endpoints, caches them, and records metrics.  Hold
+// refreshMu.
+func (d *discoverer) fetch(ctx context.Context) (*snapshot, error) {
+	start := time.Now()
+	snap, err := d.fetchSnapshot(ctx)
+	recordFetch(start, snap, err)
+	return snap, err
+}
+
+func (d *discoverer) fetchSnapshot(ctx context.Context) (*snapshot, error) {
+	eps, ams, err := d.findTailmonEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	eps = d.keepMissing(eps, time.Now())
+	eps = d.enrich.apply(ctx, eps)
+	if d.health != nil {
+		d.health.setTargets(eps)
+		eps = d.health.exclude(eps)
+	}
+	eps = d.upstreams.merge(eps)
+	snap := &snapshot{endpoints: eps, alertmanagers: ams, fetched: time.Now()}
+	if snap.sum, err = endpointsSum(eps); err != nil {
+		return nil, err
+	}
+	snap.changed = snap.fetched
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cache != nil && (d.cached == nil || d.cached.sum != snap.sum) {
+		d.cache.save(snap)
+	}
+	if d.cached == nil {
+		// The audit log starts with what is there at startup.
+		d.audit.record(snap.fetched, diffEndpoints(nil, snap.endpoints))
+	} else if d.cached.sum == snap.sum {
+		snap.changed = d.cached.changed
+	} else if events := diffEndpoints(d.cached.endpoints, snap.endpoints); len(events) > 0 {
+		recordChanges(events)
+		d.audit.record(snap.fetched, events)
+		d.events.publish(events)
+	}
+	d.trackNodes(snap)
+	d.cached = snap
+	return snap, nil
+}
+
+// endpointsSum tells whether endpoints changed.
+func endpointsSum(endpoints []*Endpoint) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(endpoints); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// refresh keeps the cache warm so requests rarely wait for Status.
+// It also fetches soon after wakeRefresh.
+func (d *discoverer) refresh(ctx context.Context, logger *zap.Logger, interval time.Duration, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.refreshMu.Lock()
+		_, err := d.fetch(ctx)
+		d.refreshMu.Unlock()
+		if err != nil && ctx.Err() == nil {
+			logger.Error("refresh", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchSettle):
+			}
+		}
+	}
+}
+
+func (d *discoverer) marshalEndpoints(ctx context.Context, f *targetFilter) ([]byte, error) {
+	snap, err := d.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = encodeEndpoints(&buf, f.apply(snap.endpoints))
+	return buf.Bytes(), err
+}
+
+// encodeEndpoints writes endpoints as an indented JSON array one at a
+// time, rather than building the whole document in memory.
+func encodeEndpoints(w io.Writer, endpoints []*Endpoint) error {
+	if len(endpoints) == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[\n")
+	for i, ep := range endpoints {
+		data, err := json.MarshalIndent(ep, "    ", "    ")
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",\n")
+		}
+		bw.WriteString("    ")
+		bw.Write(data)
+	}
+	bw.WriteString("\n]")
+	return bw.Flush()
+}
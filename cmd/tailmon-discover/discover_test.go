@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+func TestParseHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     tailmonNode
+	}{
+		{"tailmon/node-exporter/web1", tailmonNode{exporters: []string{"node-exporter"}, node: "web1"}},
+		{"tailmon/node-exporter/web1/9100", tailmonNode{exporters: []string{"node-exporter"}, node: "web1", port: 9100}},
+		{"tailmon/node-exporter,mysqld/web1/8080", tailmonNode{exporters: []string{"node-exporter", "mysqld"}, node: "web1", port: 8080}},
+		// Anything after the node that is not a port is part of the node.
+		{"tailmon/app/web1/blue", tailmonNode{exporters: []string{"app"}, node: "web1/blue"}},
+		{"tailmon/app/web1/0", tailmonNode{exporters: []string{"app"}, node: "web1/0"}},
+		{"tailmon/app/web1/65536", tailmonNode{exporters: []string{"app"}, node: "web1/65536"}},
+		{"tailmon/app/web1/80/x", tailmonNode{exporters: []string{"app"}, node: "web1/80/x"}},
+		{"tailmon/app", tailmonNode{exporters: []string{"tailmon/app"}, node: "unknown"}},
+	}
+	for _, tt := range tests {
+		if got := parseHostname(tt.hostname); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHostname(%q) = %+v, want %+v", tt.hostname, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllPeers(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *tailmonNode
+		wantErr bool
+	}{
+		{
+			value: "node-exporter:9100",
+			want: &tailmonNode{
+				exporters: []string{"node-exporter"},
+				port:      9100,
+				ports:     map[string]int{"node-exporter": 9100},
+				paths:     map[string]string{},
+			},
+		},
+		{
+			value: "node-exporter:9100/metrics,envoy:15090/stats/prometheus",
+			want: &tailmonNode{
+				exporters: []string{"node-exporter", "envoy"},
+				port:      9100,
+				ports:     map[string]int{"node-exporter": 9100, "envoy": 15090},
+				paths:     map[string]string{"envoy": "/stats/prometheus"},
+			},
+		},
+		{value: "", wantErr: true},
+		{value: "node-exporter", wantErr: true},
+		{value: ":9100", wantErr: true},
+		{value: "node-exporter:0", wantErr: true},
+		{value: "node-exporter:65536", wantErr: true},
+		{value: "node-exporter:http", wantErr: true},
+		{value: "a:1,a:2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAllPeers(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAllPeers(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAllPeers(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExporterPort(t *testing.T) {
+	single := parseHostname("tailmon/node-exporter/web1/9100")
+	shared := parseHostname("tailmon/node-exporter,mysqld/web1")
+	shared.port = 80
+	peers, err := parseAllPeers("node-exporter:9100,envoy:15090/stats/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		tn       *tailmonNode
+		exporter string
+		port     int
+		path     string
+	}{
+		{"single", &single, "node-exporter", 9100, ""},
+		{"shared", &shared, "mysqld", 80, "/mysqld/metrics"},
+		{"own port", peers, "node-exporter", 9100, ""},
+		{"own port and path", peers, "envoy", 15090, "/stats/prometheus"},
+	}
+	for _, tt := range tests {
+		port, path := tt.tn.exporterPort(tt.exporter)
+		if port != tt.port || path != tt.path {
+			t.Errorf("%s: exporterPort(%q) = %d, %q, want %d, %q", tt.name, tt.exporter, port, path, tt.port, tt.path)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	d := &discoverer{matchHostname: true, tags: []string{"tag:tailmon"}, heartbeats: newHeartbeats()}
+	tagged := views.SliceOf([]string{"tag:tailmon"})
+	tests := []struct {
+		hostname string
+		tags     *views.Slice[string]
+		want     bool
+	}{
+		{"tailmon/node-exporter/web1", nil, true},
+		{"web1", &tagged, true},
+		{"web1", nil, false},
+		// A withdrawn node keeps its tags.
+		{"tailmon-withdrawn/node-exporter/web1", nil, false},
+		{"tailmon-withdrawn/node-exporter/web1", &tagged, false},
+	}
+	for _, tt := range tests {
+		v := &ipnstate.PeerStatus{ID: "n1", HostName: tt.hostname, Tags: tt.tags}
+		if _, ok := d.lookup(v); ok != tt.want {
+			t.Errorf("lookup(%q, tagged %v) = %v, want %v", tt.hostname, tt.tags != nil, ok, tt.want)
+		}
+	}
+}
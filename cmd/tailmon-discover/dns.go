@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL         = 15
+	dnsIdleTimeout = 30 * time.Second
+	dnsMaxUDP      = 512
+)
+
+// dnsServer answers DNS-SD style queries within domain:
+//
+//	_EXPORTER._tcp.DOMAIN  SRV   every node serving EXPORTER, by MagicDNS name
+//	EXPORTER.DOMAIN        A     the tailnet addresses of those nodes
+//	                       AAAA
+//
+// Nodes started with "tailmon -shared" serve each exporter at a path
+// other than /metrics, which DNS cannot express.
+//
+// Each joined tailnet is answered for its own targets, which are the only
+// ones its clients can reach.
+type dnsServer struct {
+	logger *zap.Logger
+	d      *discoverer
+	via    *tailnet
+	domain string // lower case and fully qualified, like "tailmon."
+}
+
+// dnsTarget is one exporter on one node.
+type dnsTarget struct {
+	dnsName string
+	addr    netip.Addr
+	port    uint16
+}
+
+// serve answers on the tailnet over both UDP and TCP.
+func (s *dnsServer) serve(ctx context.Context, port int) error {
+	addr := ":" + strconv.Itoa(port)
+	udp, err := s.via.srv.Listen("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := s.via.srv.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		udp.Close()
+		tcp.Close()
+	}()
+	go s.accept(ctx, udp, s.serveUDP)
+	go s.accept(ctx, tcp, s.serveTCP)
+	return nil
+}
+
+func (s *dnsServer) accept(ctx context.Context, ln net.Listener, handle func(context.Context, net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("accept", zap.Error(err))
+			}
+			return
+		}
+		go handle(ctx, conn)
+	}
+}
+
+// serveUDP handles one UDP flow, where each read is a query.
+func (s *dnsServer) serveUDP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(ctx, buf[:n], true); resp != nil {
+			_, _ = conn.Write(resp)
+		}
+	}
+}
+
+// serveTCP handles length prefixed queries on a TCP connection.
+func (s *dnsServer) serveTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var size [2]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.answer(ctx, query, false)
+		if resp == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a query, or nil if it cannot be parsed.
+func (s *dnsServer) answer(ctx context.Context, query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	maxSize := 65535
+	if udp {
+		maxSize = dnsMaxUDP
+		_ = p.SkipAllQuestions()
+		_ = p.SkipAllAnswers()
+		_ = p.SkipAllAuthorities()
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dnsmessage.TypeOPT && int(rh.Class) > maxSize {
+				maxSize = int(rh.Class)
+			}
+			_ = p.SkipAdditional()
+		}
+	}
+
+	resp := dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true, RecursionDesired: hdr.RecursionDesired}
+	targets, rcode := s.lookup(ctx, q)
+	resp.RCode = rcode
+
+	msg, err := s.build(resp, q, targets)
+	if err == nil && len(msg) > maxSize {
+		resp.Truncated = true
+		msg, err = s.build(resp, q, nil)
+	}
+	if err != nil {
+		s.logger.Error("build", zap.Error(err))
+		return nil
+	}
+	return msg
+}
+
+// lookup finds the targets for the exporter named in a query.
+func (s *dnsServer) lookup(ctx context.Context, q dnsmessage.Question) ([]dnsTarget, dnsmessage.RCode) {
+	name := strings.ToLower(q.Name.String())
+	if q.Class != dnsmessage.ClassINET {
+		return nil, dnsmessage.RCodeRefused
+	}
+	if name == s.domain {
+		return nil, dnsmessage.RCodeSuccess
+	}
+	if !strings.HasSuffix(name, "."+s.domain) {
+		return nil, dnsmessage.RCodeRefused
+	}
+	rest := strings.TrimSuffix(name, "."+s.domain)
+	exporter := rest
+	if srv, ok := strings.CutSuffix(rest, "._tcp"); ok && strings.HasPrefix(srv, "_") {
+		exporter = strings.TrimPrefix(srv, "_")
+	}
+
+	snap, err := s.d.endpoints(ctx)
+	if err != nil {
+		s.logger.Error("endpoints", zap.Error(err))
+		return nil, dnsmessage.RCodeServerFailure
+	}
+	var targets []dnsTarget
+	for _, ep := range snap.endpoints {
+		if ep.via != s.via || strings.ToLower(ep.exporter) != exporter || len(ep.Targets) == 0 {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(ep.Targets[0])
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.ParseUint(portStr, 10, 16)
+		targets = append(targets, dnsTarget{
+			dnsName: ep.Labels["__meta_tailscale_dns_name"],
+			addr:    ep.ip,
+			port:    uint16(port),
+		})
+	}
+	if len(targets) == 0 {
+		return nil, dnsmessage.RCodeNameError
+	}
+	return targets, dnsmessage.RCodeSuccess
+}
+
+func (s *dnsServer) build(hdr dnsmessage.Header, q dnsmessage.Question, targets []dnsTarget) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	var additional []dnsTarget
+	for _, t := range targets {
+		var err error
+		switch q.Type {
+		case dnsmessage.TypeSRV:
+			target, nerr := dnsmessage.NewName(t.dnsName)
+			if nerr != nil || t.dnsName == "" {
+				continue
+			}
+			err = b.SRVResource(rh, dnsmessage.SRVResource{Port: t.port, Target: target})
+			additional = append(additional, t)
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			err = addressResource(&b, rh, q.Type, t.addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	for _, t := range additional {
+		name, _ := dnsmessage.NewName(t.dnsName)
+		ah := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		typ := dnsmessage.TypeA
+		if t.addr.Is6() {
+			typ = dnsmessage.TypeAAAA
+		}
+		if err := addressResource(&b, ah, typ, t.addr); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func addressResource(b *dnsmessage.Builder, rh dnsmessage.ResourceHeader, typ dnsmessage.Type, addr netip.Addr) error {
+	switch {
+	case typ == dnsmessage.TypeA && addr.Is4():
+		return b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+	case typ == dnsmessage.TypeAAAA && addr.Is6():
+		return b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+	}
+	return nil
+}
+
+// fqdn lower cases a domain and makes sure it ends in a dot.
+func fqdn(domain string) (string, error) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" {
+		return "", errors.New("domain is empty")
+	}
+	if _, err := dnsmessage.NewName(domain + "."); err != nil {
+		return "", err
+	}
+	return domain + ".", nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// enricher runs -enrich, a command that is given every target group as a
+// JSON array on stdin, as in the SD response, and writes back the groups
+// to keep with the labels to serve, such as an owner or tier from a CMDB.
+// Groups are matched by their first target, metrics path and tailnet,
+// as several exporters of a -shared node share an address and addresses
+// repeat across tailnets; ones left out are dropped, and targets it adds
+// or changes are ignored.
+//
+// The command runs when the targets change.  If it fails, its last
+// answer still applies and targets it has not seen are kept as they are,
+// so that a broken hook moves no labels around.
+type enricher struct {
+	logger  *zap.Logger
+	command []string
+	timeout time.Duration
+	d       *discoverer
+
+	mu     sync.Mutex
+	sum    [sha256.Size]byte            // of the last input
+	labels map[string]map[string]string // by endpointKey
+	seen   map[string]bool              // endpointKeys of the last good run
+	vetoed int
+	runs   map[string]int // by result
+}
+
+// enrichGroup is a target group as the command reads and writes it.
+type enrichGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func newEnricher(logger *zap.Logger, d *discoverer, command string, timeout time.Duration) (*enricher, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return &enricher{
+		logger:  logger,
+		command: args,
+		timeout: timeout,
+		d:       d,
+		runs:    map[string]int{},
+	}, nil
+}
+
+// apply returns endpoints with the command's labels, leaving out vetoed
+// ones.  A nil enricher changes nothing.
+func (e *enricher) apply(ctx context.Context, endpoints []*Endpoint) []*Endpoint {
+	if e == nil {
+		return endpoints
+	}
+	input, err := json.Marshal(endpoints)
+	if err != nil {
+		e.logger.Error("enrich", zap.Error(err))
+		return endpoints
+	}
+	sum := sha256.Sum256(input)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sum != e.sum || e.seen == nil {
+		if labels, err := e.run(ctx, input); err != nil {
+			e.runs["error"]++
+			if ctx.Err() == nil {
+				e.logger.Warn("enrich failed, keeping its last labels", zap.Error(err))
+			}
+		} else {
+			e.runs["ok"]++
+			e.sum, e.labels = sum, labels
+			e.seen = make(map[string]bool, len(endpoints))
+			for _, ep := range endpoints {
+				e.seen[endpointKey(ep)] = true
+			}
+		}
+	}
+
+	out := make([]*Endpoint, 0, len(endpoints))
+	e.vetoed = 0
+	for _, ep := range endpoints {
+		key := endpointKey(ep)
+		labels, ok := e.labels[key]
+		switch {
+		case ok:
+			enriched := *ep
+			enriched.Labels = maps.Clone(labels)
+			if job := labels[e.d.label("job")]; job != "" {
+				enriched.job = job
+			}
+			out = append(out, &enriched)
+		case e.seen[key]:
+			e.vetoed++
+		default:
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
+// run gives the command input and returns the labels it sets by
+// endpointKey.
+func (e *enricher) run(ctx context.Context, input []byte) (map[string]map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	var groups []enrichGroup
+	if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+		return nil, fmt.Errorf("output: %w", err)
+	}
+	labels := make(map[string]map[string]string, len(groups))
+	for _, g := range groups {
+		if len(g.Targets) == 0 {
+			continue
+		}
+		for name := range g.Labels {
+			if !labelName.MatchString(name) {
+				return nil, fmt.Errorf("output: %q is not a label name", name)
+			}
+		}
+		if g.Labels == nil {
+			g.Labels = map[string]string{}
+		}
+		if key := e.groupKey(g); labels[key] == nil {
+			labels[key] = g.Labels
+		}
+	}
+	return labels, nil
+}
+
+// groupKey is the endpointKey of a group the command wrote, which
+// carries its metrics path and tailnet as labels.
+func (e *enricher) groupKey(g enrichGroup) string {
+	ep := &Endpoint{Targets: g.Targets, Labels: g.Labels}
+	if name := g.Labels[e.d.label("tailnet")]; name != "" {
+		ep.via = &tailnet{name: name}
+	}
+	return endpointKey(ep)
+}
+
+func (e *enricher) writeEnrichMetrics(w *metrics.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w.Header("tailmon_discover_enrich_runs_total", "Runs of the -enrich command, by result.", "counter")
+	w.Sample("tailmon_discover_enrich_runs_total", []string{"result", "ok"}, float64(e.runs["ok"]))
+	w.Sample("tailmon_discover_enrich_runs_total", []string{"result", "error"}, float64(e.runs["error"]))
+	w.Header("tailmon_discover_enrich_vetoed", "Targets the -enrich command dropped.", "gauge")
+	w.Sample("tailmon_discover_enrich_vetoed", nil, float64(e.vetoed))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestEnricherApply(t *testing.T) {
+	// The hook answers for two exporters of one -shared node, which share
+	// an address, and leaves out the same address on another tailnet.
+	hook := filepath.Join(t.TempDir(), "hook")
+	script := `#!/bin/sh
+cat >/dev/null
+cat <<'EOF'
+[{"targets": ["100.64.0.3:80"], "labels": {"team": "web"}},
+ {"targets": ["100.64.0.3:80"], "labels": {"__metrics_path__": "/mysqld/metrics", "team": "dba"}}]
+EOF
+`
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d := &discoverer{labelPrefix: "__meta_tailmon_"}
+	e, err := newEnricher(zap.NewNop(), d, hook, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home, other := &tailnet{}, &tailnet{name: "other"}
+	endpoints := []*Endpoint{
+		{via: home, exporter: "node-exporter", Targets: []string{"100.64.0.3:80"}, Labels: map[string]string{}},
+		{via: home, exporter: "mysqld", Targets: []string{"100.64.0.3:80"}, Labels: map[string]string{"__metrics_path__": "/mysqld/metrics"}},
+		{via: other, exporter: "node-exporter", Targets: []string{"100.64.0.3:80"}, Labels: map[string]string{"__meta_tailmon_tailnet": "other"}},
+	}
+	got := e.apply(context.Background(), endpoints)
+	if len(got) != 2 || e.vetoed != 1 {
+		t.Fatalf("apply kept %d endpoints and vetoed %d, want 2 and 1", len(got), e.vetoed)
+	}
+	for i, team := range []string{"web", "dba"} {
+		if got[i].exporter != endpoints[i].exporter || got[i].Labels["team"] != team {
+			t.Errorf("endpoint %d = %s team=%q, want %s team=%q", i, got[i].exporter, got[i].Labels["team"], endpoints[i].exporter, team)
+		}
+	}
+}
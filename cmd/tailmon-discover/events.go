@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// eventsPath streams target changes as server-sent events.
+const eventsPath = "/events"
+
+// eventKeepalive keeps idle streams open through proxies.
+const eventKeepalive = 30 * time.Second
+
+// eventBuffer is how many batches a slow subscriber may fall behind
+// before it is disconnected, to reconnect and start over.
+const eventBuffer = 16
+
+type targetEvent struct {
+	kind string // add, update or remove
+	ep   *Endpoint
+	prev *Endpoint // for update
+}
+
+// eventHub fans target changes out to subscribers.  The zero value is
+// ready to use.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan []targetEvent]struct{}
+	closed bool
+}
+
+func (h *eventHub) subscribe() chan []targetEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []targetEvent, eventBuffer)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	if h.subs == nil {
+		h.subs = map[chan []targetEvent]struct{}{}
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []targetEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks; a subscriber that is too far behind is dropped.
+func (h *eventHub) publish(events []targetEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- events:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every stream, for shutdown.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// diffEndpoints lists what changed from old to new, in new's order
+// followed by removals in old's order.
+func diffEndpoints(old, new []*Endpoint) []targetEvent {
+	before := make(map[string]*Endpoint, len(old))
+	for _, ep := range old {
+		before[endpointKey(ep)] = ep
+	}
+	var events []targetEvent
+	for _, ep := range new {
+		key := endpointKey(ep)
+		prev, ok := before[key]
+		delete(before, key)
+		switch {
+		case !ok:
+			events = append(events, targetEvent{"add", ep, nil})
+		case !slices.Equal(prev.Targets, ep.Targets) || !maps.Equal(prev.Labels, ep.Labels):
+			events = append(events, targetEvent{"update", ep, prev})
+		}
+	}
+	for _, ep := range old {
+		if _, ok := before[endpointKey(ep)]; ok {
+			events = append(events, targetEvent{"remove", ep, nil})
+		}
+	}
+	return events
+}
+
+// subscribe returns the current endpoints and a channel of every change
+// after them.  Both are taken under the cache lock, so nothing is missed
+// or repeated.
+func (d *discoverer) subscribe(ctx context.Context) (*snapshot, chan []targetEvent, error) {
+	if _, err := d.endpoints(ctx); err != nil {
+		return nil, nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cached, d.events.subscribe(), nil
+}
+
+// newEventsHandler streams target changes.  A new stream starts with an
+// add for every current target and a "synced" event, then sends add,
+// update and remove as the targets change.  The same query filters as
+// the SD response apply, except group.
+func newEventsHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseTargetFilter(query)
+		if err == nil && filter.group {
+			err = fmt.Errorf("group is not supported on %s", eventsPath)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snap, ch, err := d.subscribe(r.Context())
+		if err != nil {
+			logger.Error("endpoints", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer d.events.unsubscribe(ch)
+
+		// Streams outlive the server's write timeout.
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		send := func(events []targetEvent) error {
+			for _, ev := range events {
+				kind, ep := ev.kind, ev.ep
+				if ev.prev != nil {
+					// An update may move a target in or out of the filter.
+					was, is := filter.match(ev.prev), filter.match(ep)
+					switch {
+					case was && !is:
+						kind, ep = "remove", ev.prev
+					case !was && is:
+						kind = "add"
+					}
+				}
+				if !filter.match(ep) {
+					continue
+				}
+				if err := writeEvent(w, kind, ep); err != nil {
+					return err
+				}
+			}
+			return rc.Flush()
+		}
+
+		initial := make([]targetEvent, len(snap.endpoints))
+		for i, ep := range snap.endpoints {
+			initial[i] = targetEvent{"add", ep, nil}
+		}
+		if send(initial) != nil || writeEvent(w, "synced", struct{}{}) != nil || rc.Flush() != nil {
+			return
+		}
+
+		keepalive := time.NewTicker(eventKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case events, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := send(events); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+func writeEvent(w io.Writer, kind string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// federatePath scrapes every matching target over the tailnet when asked
+// and returns all of their samples, labeled node, exporter and instance,
+// so a Prometheus outside the tailnet, or none at all for a small
+// install, needs only this one target.  It takes the SD filters.
+const federatePath = "/federate"
+
+// federateLabels are added to every sample.  Ones the target already
+// has are kept as exported_NAME, as Prometheus does.
+var federateLabels = []string{"node", "exporter", "instance"}
+
+func newFederateHandler(logger *zap.Logger, d *discoverer, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseTargetFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		snap, err := d.endpoints(r.Context())
+		if err != nil {
+			logger.Error("endpoints", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Grouping would lose the node of each target.
+		filter.group = false
+		endpoints := slices.DeleteFunc(filter.apply(snap.endpoints), func(ep *Endpoint) bool {
+			return !ep.via.local()
+		})
+		endpoints = filter.page(endpoints)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		scrapes := make([][]*exposition.Family, len(endpoints))
+		sem := make(chan struct{}, maxProbes)
+		var wg sync.WaitGroup
+		for i, ep := range endpoints {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, ep *Endpoint) {
+				defer func() { <-sem; wg.Done() }()
+				families, _, err := federateScrape(ctx, ep)
+				if err != nil {
+					logger.Debug("scrape", zap.String("target", ep.Targets[0]), zap.Error(err))
+					return
+				}
+				if families == nil {
+					families = []*exposition.Family{} // up, if empty
+				}
+				scrapes[i] = families
+			}(i, ep)
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := metrics.NewWriter(w)
+		writeFederated(mw, endpoints, scrapes)
+		_ = mw.Flush()
+	})
+}
+
+// federateScrape scrapes ep, also returning the exposition's
+// uncompressed size.
+func federateScrape(ctx context.Context, ep *Endpoint) ([]*exposition.Family, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ep.Targets[0]+metricsPath(ep), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := ep.via.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("target returned %s", resp.Status)
+	}
+	body := &countingReader{r: resp.Body}
+	families, err := exposition.Parse(body)
+	return families, body.n, err
+}
+
+// writeFederated merges the scrapes by family, after an up for each
+// target.  A nil scrape failed.
+func writeFederated(w *metrics.Writer, endpoints []*Endpoint, scrapes [][]*exposition.Family) {
+	targetLabels := func(ep *Endpoint) []string {
+		return []string{"node", ep.node, "exporter", ep.exporter, "instance", ep.node}
+	}
+	w.Header("up", "Whether discover could scrape the target.", "gauge")
+	for i, ep := range endpoints {
+		w.Sample("up", targetLabels(ep), boolValue(scrapes[i] != nil))
+	}
+
+	// part is one target's share of a family.
+	type part struct {
+		target int
+		family *exposition.Family
+	}
+	byName := map[string][]part{}
+	for i, families := range scrapes {
+		for _, f := range families {
+			if f.Name != "up" {
+				byName[f.Name] = append(byName[f.Name], part{i, f})
+			}
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parts := byName[name]
+		w.Header(name, parts[0].family.Help, parts[0].family.Type)
+		for _, p := range parts {
+			target := targetLabels(endpoints[p.target])
+			for _, s := range p.family.Samples {
+				w.Sample(s.Name, federatedLabels(s.Labels, target), s.Value)
+			}
+		}
+	}
+}
+
+// federatedLabels appends the target's labels to a sample's.
+func federatedLabels(labels []exposition.Label, target []string) []string {
+	out := make([]string, 0, 2*len(labels)+len(target))
+	for _, l := range labels {
+		name := l.Name
+		for _, reserved := range federateLabels {
+			if name == reserved {
+				name = "exported_" + name
+			}
+		}
+		out = append(out, name, l.Value)
+	}
+	return append(out, target...)
+}
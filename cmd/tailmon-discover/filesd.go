@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/atomicfile"
+)
+
+// fileSDWriter keeps Prometheus file_sd files up to date with the
+// discovered targets, for a Prometheus that reads them from disk.
+type fileSDWriter struct {
+	logger   *zap.Logger
+	d        *discoverer
+	paths    []string
+	interval time.Duration
+	ready    <-chan struct{}
+}
+
+func (f *fileSDWriter) run(ctx context.Context) {
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		return
+	}
+
+	var last []byte
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		data, err := f.d.marshalEndpoints(ctx, nil)
+		if err != nil {
+			f.logger.Error("marshalEndpoints", zap.Error(err))
+		} else if !bytes.Equal(data, last) {
+			if f.write(data) {
+				last = data
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// write replaces every file, so Prometheus never sees a partial one.
+func (f *fileSDWriter) write(data []byte) bool {
+	ok := true
+	for _, path := range f.paths {
+		if err := atomicfile.WriteFile(path, data, 0o644); err != nil {
+			f.logger.Error("write", zap.String("path", path), zap.Error(err))
+			ok = false
+			continue
+		}
+		f.logger.Debug("wrote", zap.String("path", path), zap.Int("bytes", len(data)))
+	}
+	return ok
+}
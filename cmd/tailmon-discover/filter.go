@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// targetFilter selects endpoints by query parameters, so a Prometheus
+// job can ask for only its own targets:
+//
+//	?exporter=node-exporter&node=web1&label=__meta_tailmon_alive=true
+//
+// ?job= matches the job from -jobs.  Repeated exporter, job or node
+// values match any of them; every label must match.  With
+// ?group=exporter the matches are grouped per exporter.  ?offset= and
+// ?limit= return one page of the matches.
+//
+// ?shards=N splits the targets into N shards by a hash of the node name,
+// the same for every request and instance, labeling each with its shard
+// so several Prometheus servers can each keep one; ?shard=K returns
+// only shard K.
+type targetFilter struct {
+	exporters map[string]bool
+	jobs      map[string]bool
+	nodes     map[string]bool
+	labels    map[string]string
+	group     bool
+
+	offset, limit int // limit zero for all
+
+	shards int // zero for none
+	shard  int // -1 for all of them
+	// shardLabel, set by the caller, names the shard label.
+	shardLabel string
+}
+
+func parseTargetFilter(q url.Values) (*targetFilter, error) {
+	f := &targetFilter{
+		exporters: set(q["exporter"]),
+		jobs:      set(q["job"]),
+		nodes:     set(q["node"]),
+		labels:    map[string]string{},
+		shard:     -1,
+	}
+	for _, kv := range q["label"] {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("label filter %q is not name=value", kv)
+		}
+		f.labels[name] = value
+	}
+	switch g := q.Get("group"); g {
+	case "":
+	case "exporter":
+		f.group = true
+	default:
+		return nil, fmt.Errorf("unknown group %q, only exporter is supported", g)
+	}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"offset", &f.offset}, {"limit", &f.limit}, {"shards", &f.shards}} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s %q is not a count", p.name, s)
+			}
+			*p.n = n
+		}
+	}
+	if s := q.Get("shard"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n >= f.shards {
+			return nil, fmt.Errorf("shard %q is not below shards=%d", s, f.shards)
+		}
+		f.shard = n
+	}
+	return f, nil
+}
+
+// shardOf places a node in one of n shards.
+func shardOf(node string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(node))
+	return int(h.Sum32() % uint32(n))
+}
+
+// page returns the endpoints from offset, at most limit of them.
+func (f *targetFilter) page(endpoints []*Endpoint) []*Endpoint {
+	if f == nil {
+		return endpoints
+	}
+	endpoints = endpoints[min(f.offset, len(endpoints)):]
+	if f.limit > 0 && f.limit < len(endpoints) {
+		endpoints = endpoints[:f.limit]
+	}
+	return endpoints
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func (f *targetFilter) match(ep *Endpoint) bool {
+	if f.exporters != nil && !f.exporters[ep.exporter] {
+		return false
+	}
+	if f.jobs != nil && !f.jobs[ep.job] {
+		return false
+	}
+	if f.nodes != nil && !f.nodes[ep.node] {
+		return false
+	}
+	if f.shard >= 0 && shardOf(ep.node, f.shards) != f.shard {
+		return false
+	}
+	for name, value := range f.labels {
+		if ep.Labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the matching endpoints in a new slice, leaving the
+// shared cache alone.  A nil filter matches everything.
+func (f *targetFilter) apply(endpoints []*Endpoint) []*Endpoint {
+	if f == nil {
+		return endpoints
+	}
+	out := []*Endpoint{}
+	for _, ep := range endpoints {
+		if !f.match(ep) {
+			continue
+		}
+		if f.shards > 0 && f.shardLabel != "" {
+			sharded := *ep
+			sharded.Labels = maps.Clone(ep.Labels)
+			sharded.Labels[f.shardLabel] = strconv.Itoa(shardOf(ep.node, f.shards))
+			ep = &sharded
+		}
+		out = append(out, ep)
+	}
+	if f.group {
+		return groupByExporter(out)
+	}
+	return out
+}
+
+// groupByExporter merges endpoints into one target group per tailnet,
+// exporter and metrics path, since targets on different tailnets are
+// reached differently and must not share a group.  A group keeps only
+// the labels every one of its targets agrees on, so per-node labels such
+// as the node name are lost; the instance label still tells targets
+// apart.
+func groupByExporter(endpoints []*Endpoint) []*Endpoint {
+	type key struct{ tailnet, exporter, path string }
+	groups := map[key]*Endpoint{}
+	var order []key
+	for _, ep := range endpoints {
+		var tailnet string
+		if ep.via != nil {
+			tailnet = ep.via.name
+		}
+		k := key{tailnet, ep.exporter, ep.Labels["__metrics_path__"]}
+		g, ok := groups[k]
+		if !ok {
+			g = &Endpoint{via: ep.via, node: ep.node, exporter: ep.exporter, job: ep.job, Labels: maps.Clone(ep.Labels)}
+			groups[k] = g
+			order = append(order, k)
+		} else {
+			if g.node != ep.node {
+				g.node = ""
+			}
+			if g.job != ep.job {
+				g.job = ""
+			}
+			for name, value := range g.Labels {
+				if ep.Labels[name] != value {
+					delete(g.Labels, name)
+				}
+			}
+		}
+		g.Targets = append(g.Targets, ep.Targets...)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].tailnet != order[j].tailnet {
+			return order[i].tailnet < order[j].tailnet
+		}
+		if order[i].exporter != order[j].exporter {
+			return order[i].exporter < order[j].exporter
+		}
+		return order[i].path < order[j].path
+	})
+	out := make([]*Endpoint, 0, len(order))
+	for _, k := range order {
+		out = append(out, groups[k])
+	}
+	return out
+}
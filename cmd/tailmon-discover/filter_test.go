@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *targetFilter
+		wantErr string
+	}{
+		{
+			query: "",
+			want:  &targetFilter{labels: map[string]string{}, shard: -1},
+		},
+		{
+			query: "exporter=a&exporter=b&job=j&node=web1&label=team=db&label=url=http://x/?y=1",
+			want: &targetFilter{
+				exporters: map[string]bool{"a": true, "b": true},
+				jobs:      map[string]bool{"j": true},
+				nodes:     map[string]bool{"web1": true},
+				labels:    map[string]string{"team": "db", "url": "http://x/?y=1"},
+				shard:     -1,
+			},
+		},
+		{
+			query: "group=exporter&offset=10&limit=5",
+			want:  &targetFilter{labels: map[string]string{}, group: true, offset: 10, limit: 5, shard: -1},
+		},
+		{
+			query: "shards=4&shard=3",
+			want:  &targetFilter{labels: map[string]string{}, shards: 4, shard: 3},
+		},
+		{
+			query: "shards=4",
+			want:  &targetFilter{labels: map[string]string{}, shards: 4, shard: -1},
+		},
+		{query: "label=team", wantErr: "not name=value"},
+		{query: "label==db", wantErr: "not name=value"},
+		{query: "group=node", wantErr: "unknown group"},
+		{query: "offset=-1", wantErr: "offset"},
+		{query: "limit=ten", wantErr: "limit"},
+		{query: "shards=x", wantErr: "shards"},
+		{query: "shard=0", wantErr: "not below shards=0"},
+		{query: "shards=2&shard=2", wantErr: "not below shards=2"},
+		{query: "shards=2&shard=-1", wantErr: "not below shards=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseTargetFilter(q)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseTargetFilter(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTargetFilter(%q) error = %v", tt.query, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTargetFilter(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	const shards = 3
+	seen := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		node := "web" + strings.Repeat("x", i)
+		s := shardOf(node, shards)
+		if s < 0 || s >= shards {
+			t.Fatalf("shardOf(%q, %d) = %d", node, shards, s)
+		}
+		if again := shardOf(node, shards); again != s {
+			t.Fatalf("shardOf(%q) = %d, then %d", node, s, again)
+		}
+		seen[s] = true
+	}
+	if len(seen) != shards {
+		t.Errorf("100 nodes fell in shards %v, want all %d", seen, shards)
+	}
+}
+
+func TestTargetFilterApply(t *testing.T) {
+	home, other := &tailnet{}, &tailnet{name: "other"}
+	endpoint := func(via *tailnet, node, exporter, target string, labels map[string]string) *Endpoint {
+		l := map[string]string{"__meta_tailmon_node_name": node, "__meta_tailmon_exporter_name": exporter}
+		for k, v := range labels {
+			l[k] = v
+		}
+		return &Endpoint{via: via, node: node, exporter: exporter, job: exporter, Targets: []string{target}, Labels: l}
+	}
+	endpoints := []*Endpoint{
+		endpoint(home, "web1", "node-exporter", "100.64.0.1:80", map[string]string{"team": "web"}),
+		endpoint(home, "web2", "node-exporter", "100.64.0.2:80", map[string]string{"team": "web"}),
+		endpoint(home, "db1", "node-exporter", "100.64.0.3:80", map[string]string{"team": "db"}),
+		endpoint(home, "db1", "mysqld", "100.64.0.3:80", map[string]string{"team": "db", "__metrics_path__": "/mysqld/metrics"}),
+		endpoint(other, "web9", "node-exporter", "100.64.0.1:80", map[string]string{"team": "web"}),
+	}
+	targets := func(eps []*Endpoint) [][]string {
+		var out [][]string
+		for _, ep := range eps {
+			out = append(out, ep.Targets)
+		}
+		return out
+	}
+	tests := []struct {
+		query string
+		want  [][]string
+	}{
+		{"", [][]string{{"100.64.0.1:80"}, {"100.64.0.2:80"}, {"100.64.0.3:80"}, {"100.64.0.3:80"}, {"100.64.0.1:80"}}},
+		{"exporter=mysqld", [][]string{{"100.64.0.3:80"}}},
+		{"node=web1&node=web9", [][]string{{"100.64.0.1:80"}, {"100.64.0.1:80"}}},
+		{"label=team=db&exporter=node-exporter", [][]string{{"100.64.0.3:80"}}},
+		{"job=none", nil},
+		// Grouping keeps the tailnets apart, though an address repeats.
+		{"group=exporter&exporter=node-exporter", [][]string{{"100.64.0.1:80", "100.64.0.2:80", "100.64.0.3:80"}, {"100.64.0.1:80"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			f, err := parseTargetFilter(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := targets(f.page(f.apply(endpoints))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("targets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("group labels", func(t *testing.T) {
+		f := &targetFilter{group: true, shard: -1}
+		groups := f.apply(endpoints[:3])
+		if len(groups) != 1 {
+			t.Fatalf("got %d groups, want 1", len(groups))
+		}
+		if _, ok := groups[0].Labels["team"]; ok {
+			t.Errorf("group kept team=%q, which its targets disagree on", groups[0].Labels["team"])
+		}
+		if _, ok := groups[0].Labels["__meta_tailmon_node_name"]; ok {
+			t.Errorf("group kept the node name")
+		}
+	})
+
+	t.Run("shards partition the targets", func(t *testing.T) {
+		total := 0
+		for shard := 0; shard < 2; shard++ {
+			f := &targetFilter{shards: 2, shard: shard, shardLabel: "__meta_tailmon_shard"}
+			for _, ep := range f.apply(endpoints) {
+				if got := ep.Labels["__meta_tailmon_shard"]; got != []string{"0", "1"}[shard] {
+					t.Errorf("%s in shard %d labeled %q", ep.node, shard, got)
+				}
+				total++
+			}
+		}
+		if total != len(endpoints) {
+			t.Errorf("shards hold %d targets, want %d", total, len(endpoints))
+		}
+		if _, ok := endpoints[0].Labels["__meta_tailmon_shard"]; ok {
+			t.Errorf("apply labeled the cached endpoint")
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		f := &targetFilter{offset: 1, limit: 2, shard: -1}
+		if got := f.page(endpoints); len(got) != 2 || got[0] != endpoints[1] {
+			t.Errorf("page = %v", targets(got))
+		}
+		f = &targetFilter{offset: 10, shard: -1}
+		if got := f.page(endpoints); len(got) != 0 {
+			t.Errorf("page past the end = %v", targets(got))
+		}
+	})
+}
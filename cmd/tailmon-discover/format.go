@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputFormat renders endpoints for one consumer, chosen on the SD
+// response with ?format=NAME.
+// The request carries any options the format takes, and prefix starts
+// the tailmon label names.
+type outputFormat struct {
+	contentType string
+	encode      func(w io.Writer, endpoints []*Endpoint, prefix string, r *http.Request) error
+}
+
+var outputFormats = map[string]outputFormat{
+	"json": {"application/json; charset=utf-8", func(w io.Writer, endpoints []*Endpoint, _ string, _ *http.Request) error {
+		return encodeEndpoints(w, endpoints)
+	}},
+	"static":       {"application/yaml; charset=utf-8", encodeStaticConfigs},
+	"scrapeconfig": {"application/yaml; charset=utf-8", encodeScrapeConfigs},
+	"zabbix":       {"application/json; charset=utf-8", encodeZabbixLLD},
+	"nagios":       {"text/plain; charset=utf-8", encodeNagios},
+	"icinga":       {"text/plain; charset=utf-8", encodeIcinga},
+	"datadog":      {"application/yaml; charset=utf-8", encodeDatadog},
+}
+
+func lookupFormat(name string) (outputFormat, error) {
+	if name == "" {
+		name = "json"
+	}
+	f, ok := outputFormats[name]
+	if !ok {
+		names := make([]string, 0, len(outputFormats))
+		for n := range outputFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return outputFormat{}, fmt.Errorf("unknown format %q, want one of %q", name, names)
+	}
+	return f, nil
+}
+
+// yamlString quotes s for YAML.  A JSON string is valid YAML.
+func yamlString(s string) string {
+	return strconv.Quote(s)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeStaticConfigs writes the endpoints as Prometheus static_configs,
+// to be pasted or templated into prometheus.yml.
+func encodeStaticConfigs(w io.Writer, endpoints []*Endpoint, _ string, _ *http.Request) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Generated by tailmon-discover.\n")
+	if len(endpoints) == 0 {
+		bw.WriteString("static_configs: []\n")
+		return bw.Flush()
+	}
+	bw.WriteString("static_configs:\n")
+	writeTargetGroups(bw, "  ", endpoints)
+	return bw.Flush()
+}
+
+// writeTargetGroups writes endpoints as a YAML list of targets and
+// labels, each line starting with indent.
+func writeTargetGroups(w io.Writer, indent string, endpoints []*Endpoint) {
+	for _, ep := range endpoints {
+		fmt.Fprintf(w, "%s- targets:\n", indent)
+		for _, target := range ep.Targets {
+			fmt.Fprintf(w, "%s    - %s\n", indent, yamlString(target))
+		}
+		if len(ep.Labels) > 0 {
+			fmt.Fprintf(w, "%s  labels:\n", indent)
+			for _, name := range sortedKeys(ep.Labels) {
+				fmt.Fprintf(w, "%s    %s: %s\n", indent, name, yamlString(ep.Labels[name]))
+			}
+		}
+	}
+}
+
+// encodeScrapeConfigs writes one Prometheus Operator ScrapeConfig per
+// job, for "kubectl apply -f -".  ?namespace= sets their namespace.
+func encodeScrapeConfigs(w io.Writer, endpoints []*Endpoint, prefix string, r *http.Request) error {
+	namespace := r.URL.Query().Get("namespace")
+	byJob := map[string][]*Endpoint{}
+	for _, ep := range endpoints {
+		byJob[ep.job] = append(byJob[ep.job], ep)
+	}
+	jobs := make([]string, 0, len(byJob))
+	for name := range byJob {
+		jobs = append(jobs, name)
+	}
+	sort.Strings(jobs)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Generated by tailmon-discover.\n")
+	for _, job := range jobs {
+		bw.WriteString("---\n")
+		bw.WriteString("apiVersion: monitoring.coreos.com/v1alpha1\n")
+		bw.WriteString("kind: ScrapeConfig\n")
+		bw.WriteString("metadata:\n")
+		fmt.Fprintf(bw, "  name: %s\n", yamlString(kubernetesName("tailmon-"+job)))
+		if namespace != "" {
+			fmt.Fprintf(bw, "  namespace: %s\n", yamlString(namespace))
+		}
+		bw.WriteString("  labels:\n")
+		bw.WriteString("    app.kubernetes.io/managed-by: tailmon-discover\n")
+		bw.WriteString("spec:\n")
+		bw.WriteString("  relabelings:\n")
+		fmt.Fprintf(bw, "    - sourceLabels: [%snode_name]\n", prefix)
+		bw.WriteString("      targetLabel: node\n")
+		bw.WriteString("  staticConfigs:\n")
+		writeTargetGroups(bw, "    ", byJob[job])
+	}
+	return bw.Flush()
+}
+
+// kubernetesName makes s a valid DNS-1123 resource name.
+func kubernetesName(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.') {
+			b[i] = '-'
+		}
+	}
+	name := strings.Trim(string(b), "-.")
+	if len(name) > 253 {
+		name = strings.TrimRight(name[:253], "-.")
+	}
+	return name
+}
+
+// encodeZabbixLLD writes the endpoints for Zabbix low-level discovery,
+// one object of macros per target, for HTTP agent item prototypes such
+// as {#METRICS_URL}.
+func encodeZabbixLLD(w io.Writer, endpoints []*Endpoint, _ string, _ *http.Request) error {
+	rows := []map[string]string{}
+	for _, ep := range endpoints {
+		for _, target := range ep.Targets {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				continue
+			}
+			rows = append(rows, map[string]string{
+				"{#TARGET}":      target,
+				"{#ADDRESS}":     host,
+				"{#PORT}":        port,
+				"{#EXPORTER}":    ep.exporter,
+				"{#NODE}":        ep.node,
+				"{#DNSNAME}":     strings.TrimSuffix(ep.Labels["__meta_tailscale_dns_name"], "."),
+				"{#METRICS_URL}": "http://" + target + metricsPath(ep),
+			})
+		}
+	}
+	return json.NewEncoder(w).Encode(rows)
+}
+
+// encodeDatadog writes a Datadog Agent openmetrics check, conf.d/
+// openmetrics.d/conf.yaml, with an instance per target tagged node,
+// exporter and tailnet.  Each exporter's metrics get its name as their
+// namespace.  ?metrics= is a comma list of the metric regexps to collect,
+// every metric by default; Datadog bills each as a custom metric.
+func encodeDatadog(w io.Writer, endpoints []*Endpoint, _ string, r *http.Request) error {
+	collect := splitList(r.URL.Query().Get("metrics"))
+	if len(collect) == 0 {
+		collect = []string{".*"}
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Generated by tailmon-discover.\n")
+	bw.WriteString("init_config:\n\n")
+	if len(endpoints) == 0 {
+		bw.WriteString("instances: []\n")
+		return bw.Flush()
+	}
+	bw.WriteString("instances:\n")
+	for _, ep := range endpoints {
+		tags := []string{"exporter:" + ep.exporter}
+		if ep.node != "" {
+			tags = append(tags, "node:"+ep.node)
+		}
+		if ep.via != nil && ep.via.name != "" {
+			tags = append(tags, "tailnet:"+ep.via.name)
+		}
+		for _, name := range sortedKeys(ep.Labels) {
+			if !strings.HasPrefix(name, "__") {
+				tags = append(tags, name+":"+ep.Labels[name])
+			}
+		}
+		for _, target := range ep.Targets {
+			fmt.Fprintf(bw, "  - openmetrics_endpoint: %s\n", yamlString("http://"+target+metricsPath(ep)))
+			fmt.Fprintf(bw, "    namespace: %s\n", yamlString(datadogNamespace(ep.exporter)))
+			bw.WriteString("    metrics:\n")
+			for _, m := range collect {
+				fmt.Fprintf(bw, "      - %s\n", yamlString(m))
+			}
+			bw.WriteString("    tags:\n")
+			for _, tag := range tags {
+				fmt.Fprintf(bw, "      - %s\n", yamlString(tag))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// datadogNamespace makes an exporter name a metric name prefix.
+func datadogNamespace(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// digestPath serves a summary of the current targets, so that discover
+// instances run side by side can check that they agree.
+const digestPath = "/digest"
+
+type digest struct {
+	Digest  string    `json:"digest"`
+	Targets int       `json:"targets"`
+	Changed time.Time `json:"changed"`
+}
+
+// digest summarizes the cached endpoints.  Instances that see the same
+// tailnet and receive the same heartbeats return the same Digest.
+func (d *discoverer) digest(ctx context.Context) (digest, error) {
+	snap, err := d.endpoints(ctx)
+	if err != nil {
+		return digest{}, err
+	}
+	return digest{
+		Digest:  hex.EncodeToString(snap.sum[:]),
+		Targets: len(snap.endpoints),
+		Changed: snap.changed.UTC(),
+	}, nil
+}
+
+func newDigestHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dg, err := d.digest(r.Context())
+		if err != nil {
+			logger.Error("digest", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(dg)
+	})
+}
+
+// peerChecker compares this instance's digest with other instances,
+// logging when they disagree and exporting whether they match.
+type peerChecker struct {
+	logger   *zap.Logger
+	d        *discoverer
+	auth     *httpAuth // sent to peers, which share it
+	client   *http.Client
+	peers    []string
+	interval time.Duration
+
+	mu         sync.Mutex
+	consistent map[string]bool
+}
+
+func (p *peerChecker) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *peerChecker) check(ctx context.Context) {
+	own, err := p.d.digest(ctx)
+	if err != nil {
+		p.logger.Error("digest", zap.Error(err))
+		return
+	}
+	for _, peer := range p.peers {
+		theirs, err := p.fetch(ctx, peer)
+		ok := err == nil && theirs.Digest == own.Digest
+
+		p.mu.Lock()
+		was, known := p.consistent[peer]
+		p.consistent[peer] = ok
+		p.mu.Unlock()
+		if known && was == ok {
+			continue
+		}
+		switch {
+		case err != nil:
+			p.logger.Warn("peer unreachable", zap.String("peer", peer), zap.Error(err))
+		case !ok:
+			p.logger.Warn("peer disagrees", zap.String("peer", peer),
+				zap.Int("targets", own.Targets), zap.Int("peer_targets", theirs.Targets))
+		default:
+			p.logger.Info("peer agrees", zap.String("peer", peer), zap.Int("targets", own.Targets))
+		}
+	}
+}
+
+func (p *peerChecker) fetch(ctx context.Context, peer string) (digest, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	url := strings.TrimSuffix(peer, "/") + digestPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return digest{}, err
+	}
+	p.auth.authorize(req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return digest{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return digest{}, fmt.Errorf("%s", resp.Status)
+	}
+	var dg digest
+	err = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&dg)
+	return dg, err
+}
+
+func (p *peerChecker) writePeerMetrics(w *metrics.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peers := make([]string, 0, len(p.consistent))
+	for peer := range p.consistent {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	w.Header("tailmon_discover_peer_consistent", "Whether another discover instance returns the same targets.", "gauge")
+	for _, peer := range peers {
+		w.Sample("tailmon_discover_peer_consistent", []string{"peer", peer}, boolValue(p.consistent[peer]))
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// maxProbes bounds how many targets are probed at once.
+const maxProbes = 16
+
+// healthChecker probes every discovered target's metrics path over the
+// tailnet it was found on.  Targets come from each fetch rather than
+// from the cache, so a target left out for being dead is still probed
+// and can come back.
+type healthChecker struct {
+	logger   *zap.Logger
+	interval time.Duration
+	timeout  time.Duration
+
+	// dropAfter leaves out targets that failed this many probes in
+	// a row.  Zero only labels them.
+	dropAfter int
+
+	mu      sync.Mutex
+	targets []*Endpoint
+	state   map[string]*targetHealth
+}
+
+type targetHealth struct {
+	exporter string
+	node     string
+	healthy  bool
+	failures int // in a row
+	duration time.Duration
+	probed   time.Time
+}
+
+// endpointKey identifies an endpoint by its address and metrics path,
+// and its tailnet when several are joined.
+func endpointKey(ep *Endpoint) string {
+	key := ep.Targets[0] + metricsPath(ep)
+	if ep.via != nil && ep.via.name != "" {
+		key = ep.via.name + "/" + key
+	}
+	return key
+}
+
+func metricsPath(ep *Endpoint) string {
+	if path := ep.Labels["__metrics_path__"]; path != "" {
+		return path
+	}
+	return "/metrics"
+}
+
+// setTargets replaces what the next round will probe.
+func (h *healthChecker) setTargets(endpoints []*Endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.targets = endpoints
+}
+
+// status returns the last probe result for ep, if it was probed.
+func (h *healthChecker) status(ep *Endpoint) (targetHealth, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	th, ok := h.state[endpointKey(ep)]
+	if !ok {
+		return targetHealth{}, false
+	}
+	return *th, true
+}
+
+// exclude returns the endpoints that are not persistently dead, in a
+// new slice.
+func (h *healthChecker) exclude(endpoints []*Endpoint) []*Endpoint {
+	if h.dropAfter <= 0 {
+		return endpoints
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []*Endpoint{}
+	for _, ep := range endpoints {
+		if th, ok := h.state[endpointKey(ep)]; ok && th.failures >= h.dropAfter {
+			continue
+		}
+		out = append(out, ep)
+	}
+	return out
+}
+
+func (h *healthChecker) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round probes every target once and forgets targets that are gone.
+func (h *healthChecker) round(ctx context.Context) {
+	h.mu.Lock()
+	targets := h.targets
+	h.mu.Unlock()
+
+	type result struct {
+		key string
+		ep  *Endpoint
+		ok  bool
+		dur time.Duration
+	}
+	results := make([]result, len(targets))
+	sem := make(chan struct{}, maxProbes)
+	var wg sync.WaitGroup
+	for i, ep := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ep *Endpoint) {
+			defer func() { <-sem; wg.Done() }()
+			start := time.Now()
+			ok := h.probe(ctx, ep)
+			results[i] = result{endpointKey(ep), ep, ok, time.Since(start)}
+		}(i, ep)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := make(map[string]*targetHealth, len(results))
+	for _, r := range results {
+		th := h.state[r.key]
+		if th == nil {
+			th = &targetHealth{}
+		}
+		switch {
+		case r.ok && !th.healthy && !th.probed.IsZero():
+			h.logger.Info("healthy", zap.String("target", r.key))
+		case !r.ok && (th.healthy || th.probed.IsZero()):
+			h.logger.Info("unhealthy", zap.String("target", r.key))
+		}
+		if r.ok {
+			th.failures = 0
+		} else {
+			th.failures++
+		}
+		th.exporter = r.ep.exporter
+		th.node = r.ep.node
+		th.healthy, th.duration, th.probed = r.ok, r.dur, now
+		state[r.key] = th
+	}
+	h.state = state
+}
+
+// probe reports whether the target answers its metrics path with 200.
+func (h *healthChecker) probe(ctx context.Context, ep *Endpoint) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ep.Targets[0]+metricsPath(ep), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := ep.via.client.Do(req)
+	if err != nil {
+		h.logger.Debug("probe", zap.String("target", ep.Targets[0]), zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+	// The status is enough; don't pull a whole scrape.
+	_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+	return resp.StatusCode == http.StatusOK
+}
+
+// writeHealthMetrics exports the last probe of every target.
+func (h *healthChecker) writeHealthMetrics(w *metrics.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	families := []struct {
+		name, help string
+		value      func(th *targetHealth) float64
+	}{
+		{"tailmon_target_up", "Whether the target answered its last probe.",
+			func(th *targetHealth) float64 { return boolValue(th.healthy) }},
+		{"tailmon_target_probe_failures", "Probes the target has failed in a row.",
+			func(th *targetHealth) float64 { return float64(th.failures) }},
+		{"tailmon_target_probe_duration_seconds", "How long the last probe took.",
+			func(th *targetHealth) float64 { return th.duration.Seconds() }},
+	}
+	keys := make([]string, 0, len(h.state))
+	for key := range h.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, f := range families {
+		w.Header(f.name, f.help, "gauge")
+		for _, key := range keys {
+			th := h.state[key]
+			w.Sample(f.name, []string{"target", key, "exporter", th.exporter, "node", th.node}, f.value(th))
+		}
+	}
+}
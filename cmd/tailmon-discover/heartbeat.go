@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
+
+	"github.com/jamessanford/tailmon/internal/heartbeat"
+	"github.com/jamessanford/tailmon/internal/metrics"
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+// heartbeatMisses is how many intervals may pass without a heartbeat
+// before a node is no longer considered alive.
+const heartbeatMisses = 3
+
+// heartbeatForget is how many intervals an old heartbeat is kept,
+// so a node that goes away is eventually forgotten.
+const heartbeatForget = 100
+
+type heartbeatRecord struct {
+	heartbeat.Heartbeat
+	received time.Time
+
+	// tailscaleVersion is the sender's, from its Hostinfo.
+	tailscaleVersion string
+}
+
+// heartbeats holds the latest heartbeat from each tailmon node,
+// keyed by the sender's node ID as reported by WhoIs.
+type heartbeats struct {
+	mu    sync.Mutex
+	nodes map[tailcfg.StableNodeID]heartbeatRecord
+}
+
+func newHeartbeats() *heartbeats {
+	return &heartbeats{nodes: make(map[tailcfg.StableNodeID]heartbeatRecord)}
+}
+
+func (h *heartbeats) put(id tailcfg.StableNodeID, hb heartbeat.Heartbeat, tailscaleVersion string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes[id] = heartbeatRecord{Heartbeat: hb, received: now, tailscaleVersion: tailscaleVersion}
+	for id, rec := range h.nodes {
+		if now.Sub(rec.received) > heartbeatForget*rec.Interval {
+			delete(h.nodes, id)
+		}
+	}
+}
+
+func (h *heartbeats) get(id tailcfg.StableNodeID) (heartbeatRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rec, ok := h.nodes[id]
+	return rec, ok
+}
+
+// alive reports whether the heartbeat is recent enough.
+func (r heartbeatRecord) alive(now time.Time) bool {
+	return now.Sub(r.received) <= heartbeatMisses*r.Interval
+}
+
+// writeBuildInfo exports the versions each node last reported, so that
+// nodes running an old tailmon can be found without scraping them.
+func (h *heartbeats) writeBuildInfo(w *metrics.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recs := make([]heartbeatRecord, 0, len(h.nodes))
+	for _, rec := range h.nodes {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Node < recs[j].Node })
+	w.Header("tailmon_node_build_info", "The versions a tailmon node last reported in its heartbeat, always 1.", "gauge")
+	for _, rec := range recs {
+		w.Sample("tailmon_node_build_info", []string{
+			"node", rec.Node,
+			"version", rec.Version,
+			"go_version", rec.GoVersion,
+			"tailscale_version", rec.tailscaleVersion,
+		}, 1)
+	}
+}
+
+// label adds the labels the node registered for an exporter.  Reserved
+// names and labels discover already set, which would let a node change
+// its own address or tailmon labels, are skipped.
+func (r heartbeatRecord) label(exporter string, labels map[string]string) {
+	for _, ep := range r.Exporters {
+		if ep.Name != exporter {
+			continue
+		}
+		for name, value := range ep.Labels {
+			if _, taken := labels[name]; !taken && labelName.MatchString(name) && !strings.HasPrefix(name, "__") {
+				labels[name] = value
+			}
+		}
+	}
+}
+
+// up returns whether the named exporter was up, if it was reported.
+func (r heartbeatRecord) up(name string) (bool, bool) {
+	for _, ep := range r.Exporters {
+		if ep.Name == name {
+			return ep.Up, true
+		}
+	}
+	return false, false
+}
+
+// newHeartbeatHandler accepts heartbeats from tailmon nodes.  The sender
+// is identified with WhoIs, through tshttp.Identify, rather than trusting
+// the heartbeat body.
+func newHeartbeatHandler(logger *zap.Logger, store *heartbeats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Requests off the tailnet, such as through Funnel, have no
+		// identity and are refused.
+		id, err := tshttp.IdentityFrom(r)
+		if err != nil {
+			logger.Debug("heartbeat from unknown peer", zap.String("addr", r.RemoteAddr), zap.Error(err))
+			http.Error(w, "unknown peer", http.StatusForbidden)
+			return
+		}
+
+		var hb heartbeat.Heartbeat
+		data, err := io.ReadAll(io.LimitReader(r.Body, heartbeat.MaxSize))
+		if err == nil {
+			err = json.Unmarshal(data, &hb)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if hb.Interval <= 0 {
+			http.Error(w, "interval must be positive", http.StatusBadRequest)
+			return
+		}
+
+		who := id.WhoIs
+		var tailscaleVersion string
+		if hi := who.Node.Hostinfo; hi.Valid() {
+			tailscaleVersion = hi.IPNVersion()
+		}
+		store.put(who.Node.StableID, hb, tailscaleVersion, time.Now())
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+// watchSettle lets a burst of netmap updates settle into one refresh.
+const watchSettle = time.Second
+
+// watch wakes the refresh loop whenever via's peers change, so a node
+// that joins is listed without waiting for the next refresh.  Updates
+// that only move endpoints or DERP homes are ignored.
+func (d *discoverer) watch(ctx context.Context, logger *zap.Logger, via *tailnet, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	for {
+		err := d.watchBus(ctx, via)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("watch", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (d *discoverer) watchBus(ctx context.Context, via *tailnet) error {
+	lc, err := via.srv.LocalClient()
+	if err != nil {
+		return err
+	}
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	var last [sha256.Size]byte
+	for first := true; ; first = false {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap == nil {
+			continue
+		}
+		if sum := peersSum(n.NetMap); sum != last {
+			last = sum
+			if !first {
+				d.wakeRefresh()
+			}
+		}
+	}
+}
+
+// peersSum summarizes what discovery reads from each peer.
+func peersSum(nm *netmap.NetworkMap) [sha256.Size]byte {
+	h := sha256.New()
+	for _, p := range nm.Peers {
+		var hostname string
+		if p.Hostinfo.Valid() {
+			hostname = p.Hostinfo.Hostname()
+		}
+		online := p.Online != nil && *p.Online
+		fmt.Fprintf(h, "%s %q %q %q %v %v %v\n", p.StableID, p.Name, hostname, p.Tags, p.Addresses, online, p.User)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// wakeRefresh asks the refresh loop to fetch now.
+func (d *discoverer) wakeRefresh() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
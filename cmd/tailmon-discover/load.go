@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// loadEstimator scrapes a few random targets of each exporter every
+// interval and scales their series and bytes up to all of the exporter's
+// targets, estimating what one scrape of everything discovered costs the
+// Prometheus servers.
+type loadEstimator struct {
+	logger   *zap.Logger
+	d        *discoverer
+	interval time.Duration
+	timeout  time.Duration
+	sample   int // targets per exporter per round
+
+	mu        sync.Mutex
+	estimates map[string]loadEstimate
+}
+
+// loadEstimate is an exporter's average scrape, and how many targets it
+// was taken from, out of how many.
+type loadEstimate struct {
+	targets, sampled int
+	samples, bytes   float64
+}
+
+// loadScrape is one scrape's size; ok is false if it failed.
+type loadScrape struct {
+	ok             bool
+	samples, bytes int
+}
+
+func (e *loadEstimator) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *loadEstimator) round(ctx context.Context) {
+	snap, err := e.d.endpoints(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.logger.Error("endpoints", zap.Error(err))
+		}
+		return
+	}
+	byExporter := map[string][]*Endpoint{}
+	for _, ep := range snap.endpoints {
+		if ep.via.local() {
+			byExporter[ep.exporter] = append(byExporter[ep.exporter], ep)
+		}
+	}
+
+	type job struct {
+		exporter string
+		ep       *Endpoint
+	}
+	var jobs []job
+	for exporter, eps := range byExporter {
+		eps = append([]*Endpoint(nil), eps...)
+		rand.Shuffle(len(eps), func(i, j int) { eps[i], eps[j] = eps[j], eps[i] })
+		for _, ep := range eps[:min(len(eps), e.sample)] {
+			jobs = append(jobs, job{exporter, ep})
+		}
+	}
+	scrapes := make([]loadScrape, len(jobs))
+	sem := make(chan struct{}, maxProbes)
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ep *Endpoint) {
+			defer func() { <-sem; wg.Done() }()
+			scrapes[i] = e.scrape(ctx, ep)
+		}(i, j.ep)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	previous := e.estimates
+	e.estimates = map[string]loadEstimate{}
+	for exporter, eps := range byExporter {
+		est := loadEstimate{targets: len(eps)}
+		var samples, bytes int
+		for i, j := range jobs {
+			if j.exporter == exporter && scrapes[i].ok {
+				est.sampled++
+				samples += scrapes[i].samples
+				bytes += scrapes[i].bytes
+			}
+		}
+		if est.sampled > 0 {
+			est.samples = float64(samples) / float64(est.sampled)
+			est.bytes = float64(bytes) / float64(est.sampled)
+		} else if last, ok := previous[exporter]; ok {
+			// Every sampled target failed this time.
+			est.samples, est.bytes = last.samples, last.bytes
+		}
+		e.estimates[exporter] = est
+	}
+}
+
+func (e *loadEstimator) scrape(ctx context.Context, ep *Endpoint) loadScrape {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	families, n, err := federateScrape(ctx, ep)
+	if err != nil {
+		e.logger.Debug("scrape", zap.String("target", ep.Targets[0]), zap.Error(err))
+		return loadScrape{}
+	}
+	s := loadScrape{ok: true, bytes: n}
+	for _, f := range families {
+		s.samples += len(f.Samples)
+	}
+	return s
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func (e *loadEstimator) writeLoadMetrics(w *metrics.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exporters := make([]string, 0, len(e.estimates))
+	for exporter := range e.estimates {
+		exporters = append(exporters, exporter)
+	}
+	sort.Strings(exporters)
+
+	w.Header("tailmon_discover_load_sampled_targets", "Targets whose scrape the last load estimate is from.", "gauge")
+	for _, exporter := range exporters {
+		w.Sample("tailmon_discover_load_sampled_targets", []string{"exporter", exporter}, float64(e.estimates[exporter].sampled))
+	}
+	w.Header("tailmon_discover_load_target_samples", "Average samples in one scrape of a target.", "gauge")
+	for _, exporter := range exporters {
+		w.Sample("tailmon_discover_load_target_samples", []string{"exporter", exporter}, e.estimates[exporter].samples)
+	}
+	w.Header("tailmon_discover_load_target_bytes", "Average uncompressed size of one scrape of a target.", "gauge")
+	for _, exporter := range exporters {
+		w.Sample("tailmon_discover_load_target_bytes", []string{"exporter", exporter}, e.estimates[exporter].bytes)
+	}
+	w.Header("tailmon_discover_load_samples", "Estimated samples in one scrape of every target.", "gauge")
+	for _, exporter := range exporters {
+		est := e.estimates[exporter]
+		w.Sample("tailmon_discover_load_samples", []string{"exporter", exporter}, est.samples*float64(est.targets))
+	}
+	w.Header("tailmon_discover_load_bytes", "Estimated uncompressed size of one scrape of every target.", "gauge")
+	for _, exporter := range exporters {
+		est := e.estimates[exporter]
+		w.Sample("tailmon_discover_load_bytes", []string{"exporter", exporter}, est.bytes*float64(est.targets))
+	}
+}
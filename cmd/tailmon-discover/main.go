@@ -2,24 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"io"
-	"net"
+	"fmt"
 	"net/http"
-	"net/netip"
 	"os"
 	"os/signal"
-	"sort"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"tailscale.com/envknob"
 	"tailscale.com/logtail"
-	"tailscale.com/tsnet"
 
+	"github.com/jamessanford/tailmon/internal/envflag"
+	"github.com/jamessanford/tailmon/internal/heartbeat"
 	"github.com/jamessanford/tailmon/internal/log"
+	"github.com/jamessanford/tailmon/internal/metrics"
+	"github.com/jamessanford/tailmon/internal/secret"
 	"github.com/jamessanford/tailmon/internal/tshttp"
 )
 
@@ -32,10 +35,18 @@ and returns a Prometheus HTTP SD response containing all "tailmon" nodes.
 Run a single "tailmon-discover" along with many "tailmon" nodes to
 automatically discover and monitor metrics endpoints over tailscale.
 
-See example usage at https://github.com/jamessanford/tailmon/
+See example usage, the query parameters, and the other endpoints such as
+/config/prometheus, /ui and /metrics at https://github.com/jamessanford/tailmon/
+
+-auth-key, -state-key, -bearer, -basic-auth, -sign-key and -api-key read their
+secret from a file:PATH, cred:NAME for a systemd LoadCredential=, env:NAME, or
+the output of exec:COMMAND.
 
 Custom tailscale control servers may be set with TS_CONTROL_URL or --control-url
 
+Every flag may also be set from the environment, like TAILMON_STATE for -state
+or TAILMON_CONTROL_URL for -control-url.  Flags on the command line win.
+
 Flags:
 `
 
@@ -45,105 +56,242 @@ func usage() {
 	os.Exit(1)
 }
 
-type Endpoint struct {
-	ip      netip.Addr        // for output sort
-	Targets []string          `json:"targets"`
-	Labels  map[string]string `json:"labels"`
+// NewDiscoverHandler serves discover on the tailnet via.  Every joined
+// tailnet serves the same targets.
+func NewDiscoverHandler(logger *zap.Logger, d *discoverer, via *tailnet, peers *peerChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(heartbeat.Path, newHeartbeatHandler(logger.Named("heartbeat"), d.heartbeats))
+	mux.Handle(digestPath, newDigestHandler(logger, d))
+	mux.Handle(eventsPath, newEventsHandler(logger, d))
+	mux.Handle(historyPath, newHistoryHandler(&d.audit))
+	mux.Handle(configPath, newConfigHandler(d.labelPrefix))
+	mux.Handle(uiPath, newUIHandler(logger, d))
+	mux.Handle(serviceDiscoveryPath, newServiceDiscoveryHandler(logger, d))
+	mux.Handle(nodePath, newNodeHandler(logger, d))
+	mux.Handle(alertmanagersPath, newAlertmanagersHandler(logger, d))
+	mux.Handle(targetsPath, newExporterTargetsHandler(logger, d))
+	if d.federateTimeout > 0 {
+		mux.Handle(federatePath, newFederateHandler(logger.Named("federate"), d, d.federateTimeout))
+	}
+	mux.Handle(scrapePath, newScrapeProxy(logger.Named("scrape"), d))
+	mux.Handle(nodesPath, newNodesProxy(logger.Named("scrape"), d))
+	ta := newTargetAllocatorHandler(logger, d)
+	mux.Handle("/scrape_configs", ta)
+	mux.Handle("/jobs", ta)
+	mux.Handle("/jobs/", ta)
+	mux.Handle("/", newSDHandler(logger, d))
+	var collect []func(w *metrics.Writer)
+	if d.health != nil {
+		collect = append(collect, d.health.writeHealthMetrics)
+	}
+	if peers != nil {
+		collect = append(collect, peers.writePeerMetrics)
+	}
+	if d.upstreams != nil {
+		collect = append(collect, d.upstreams.writeUpstreamMetrics)
+	}
+	if d.api != nil {
+		collect = append(collect, d.api.writeAPIMetrics)
+	}
+	if d.ping != nil {
+		collect = append(collect, d.ping.writePingMetrics)
+	}
+	if d.load != nil {
+		collect = append(collect, d.load.writeLoadMetrics)
+	}
+	if d.enrich != nil {
+		collect = append(collect, d.enrich.writeEnrichMetrics)
+	}
+	collect = append(collect, d.writeMissingMetrics, d.heartbeats.writeBuildInfo, via.whois.writeWhoisMetrics)
+	mux.Handle("/metrics", newTailnetMetricsHandler(logger, via.srv, collect...))
+	return mux
 }
 
-func findTailmonEndpoints(ctx context.Context, tailnet *tsnet.Server) ([]*Endpoint, error) {
-	lc, err := tailnet.LocalClient()
-	if err != nil {
-		return nil, err
-	}
+var labelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
-	status, err := lc.Status(ctx)
-	if err != nil {
-		return nil, err
+// parseLabels parses a comma separated list of name=value labels.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, kv := range splitList(s) {
+		name, value, ok := strings.Cut(kv, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !labelName.MatchString(name) {
+			return nil, fmt.Errorf("%q is not name=value with a Prometheus label name", kv)
+		}
+		labels[name] = strings.TrimSpace(value)
 	}
+	return labels, nil
+}
 
-	var endpoints []*Endpoint
-
-	for _, v := range status.Peer {
-		// NOTE: Ideally use Tags or Services to identify the
-		// exporters, but that information is not present.
-		// For now, use tailmon prefix.
-		prefix := "tailmon/"
-		if !strings.HasPrefix(v.HostName, prefix) {
-			continue
+// parseScrapeHints parses a comma separated list of
+// EXPORTER=INTERVAL[/TIMEOUT], like smartctl-exporter=5m/1m.
+func parseScrapeHints(s string) (map[string]scrapeHint, error) {
+	hints := map[string]scrapeHint{}
+	for _, field := range splitList(s) {
+		exporter, durations, ok := strings.Cut(field, "=")
+		exporter = strings.TrimSpace(exporter)
+		if !ok || exporter == "" {
+			return nil, fmt.Errorf("%q is not EXPORTER=INTERVAL[/TIMEOUT]", field)
 		}
-		if len(v.TailscaleIPs) == 0 {
-			continue
+		interval, timeout, _ := strings.Cut(durations, "/")
+		var hint scrapeHint
+		var err error
+		if interval = strings.TrimSpace(interval); interval != "" {
+			if hint.interval, err = time.ParseDuration(interval); err != nil || hint.interval <= 0 {
+				return nil, fmt.Errorf("%q has no valid interval", field)
+			}
 		}
-
-		exporter, node, ok := strings.Cut(strings.TrimPrefix(v.HostName, prefix), "/")
-		if !ok {
-			exporter = v.HostName
-			node = "unknown"
+		if timeout = strings.TrimSpace(timeout); timeout != "" {
+			if hint.timeout, err = time.ParseDuration(timeout); err != nil || hint.timeout <= 0 {
+				return nil, fmt.Errorf("%q has no valid timeout", field)
+			}
+		}
+		if hint.interval > 0 && hint.timeout > hint.interval {
+			return nil, fmt.Errorf("%q has a timeout longer than its interval", field)
 		}
+		hints[exporter] = hint
+	}
+	return hints, nil
+}
 
-		// Prometheus scrapes all endpoints we provide,
-		// so only provide one address per peer.
-		endpoint := &Endpoint{
-			ip:      v.TailscaleIPs[0], // for sorting
-			Targets: []string{net.JoinHostPort(v.TailscaleIPs[0].String(), "80")},
-			Labels: map[string]string{
-				"__meta_tailmon_node_name":     node,
-				"__meta_tailmon_exporter_name": exporter,
-				"__meta_tailscale_dns_name":    v.DNSName,
-			},
+// parseJobs parses -jobs, a comma separated list of EXPORTER=JOB or
+// tag:TAG=JOB.
+func parseJobs(s string) ([]jobRule, error) {
+	var rules []jobRule
+	for _, field := range splitList(s) {
+		match, job, ok := strings.Cut(field, "=")
+		match, job = strings.TrimSpace(match), strings.TrimSpace(job)
+		if !ok || match == "" || job == "" {
+			return nil, fmt.Errorf("%q is not EXPORTER=JOB or tag:TAG=JOB", field)
+		}
+		if !jobName.MatchString(job) {
+			return nil, fmt.Errorf("job %q may only use letters, digits and _.:-", job)
+		}
+		rule := jobRule{exporter: match, job: job}
+		if strings.HasPrefix(match, "tag:") {
+			rule = jobRule{tag: match, job: job}
 		}
-		endpoints = append(endpoints, endpoint)
+		rules = append(rules, rule)
 	}
+	return rules, nil
+}
 
-	sort.SliceStable(endpoints, func(i, j int) bool {
-		return endpoints[i].ip.Less(endpoints[j].ip)
-	})
+var tailnetName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
 
-	return endpoints, nil
+// joinedTailnet is one entry of -join, NAME or NAME=CONTROL_URL.
+type joinedTailnet struct {
+	name       string
+	controlURL string
 }
 
-func marshalEndpoints(ctx context.Context, tailnet *tsnet.Server) ([]byte, error) {
-	endpoints, err := findTailmonEndpoints(ctx, tailnet)
-	if err != nil {
-		return nil, err
+func parseJoin(s, main string) ([]joinedTailnet, error) {
+	seen := map[string]bool{main: true}
+	var joined []joinedTailnet
+	for _, field := range splitList(s) {
+		name, controlURL, _ := strings.Cut(field, "=")
+		if !tailnetName.MatchString(name) {
+			return nil, fmt.Errorf("tailnet name %q may only use letters, digits and _.-", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("tailnet %q is given twice", name)
+		}
+		seen[name] = true
+		joined = append(joined, joinedTailnet{name, controlURL})
 	}
-	return json.MarshalIndent(endpoints, "", "    ")
+	return joined, nil
 }
 
-func NewDiscoverHandler(logger *zap.Logger, tailnet *tsnet.Server) http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			w.WriteHeader(http.StatusNotFound)
-			io.WriteString(w, "tailmon-discover\n")
-			return
-		}
+// anchoredRegexp compiles expr to match whole strings, as Prometheus
+// relabeling does.  An empty expr is nil.
+func anchoredRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
 
-		data, err := marshalEndpoints(r.Context(), tailnet)
-		if err != nil {
-			logger.Error("marshalEndpoints", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = io.WriteString(w, err.Error())
-		}
-
-		w.Header().Set("content-type", "application/json; charset=utf-8")
-		_, _ = w.Write(data)
-	})
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Add a /metrics endpoint to expose the entire tailnet.
-		// (Use Status and WhoIs to export Hostinfo)
-		return
-	})
-	return mux
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
 }
 
 func main() {
 	flagDebug := flag.Bool("debug", false, "print debug logs")
 	flagState := flag.String("state", "", "path to store tailnet state")
+	flagRateLimit := flag.Float64("rate-limit", 10, "requests per second each client address may make, 0 for no limit")
+	flagRateBurst := flag.Int("rate-burst", 20, "requests a client may make at once above -rate-limit")
+	flagMaxInflight := flag.Int("max-inflight", 64, "requests served at once before answering 503, not counting /events streams; 0 for no limit")
+	flagAllow := flag.String("allow", "", "comma separated tailnet users, tags or MagicDNS names allowed to use discover, like tag:prometheus; empty allows all")
+	flagWhoisTTL := flag.Duration("whois-ttl", time.Minute, "how long to remember who a tailnet peer is, for heartbeats and -allow, 0 to always ask")
+	flagBearer := flag.String("bearer", "", "require this bearer token, read from a secret SOURCE, on every request but heartbeats")
+	flagBasicAuth := flag.String("basic-auth", "", "require this user:password, read from a secret SOURCE, on every request but heartbeats")
+	flagSignKey := flag.String("sign-key", "", "sign SD responses with HMAC-SHA256 in the Tailmon-Signature header, keyed by a secret SOURCE")
+	flagTailnet := flag.String("tailnet", "", "name of this tailnet, to label its targets with; required with -join")
+	flagJoin := flag.String("join", "", "comma separated NAME or NAME=CONTROL_URL of more tailnets to also find targets on, each a node with its own state under -state")
+	flagTailnetListen := flag.String("tailnet-listen", ":80", "comma separated tailnet addresses to serve on, like :80,:9090")
+	flagFunnelPort := flag.Int("funnel-port", 0, "also serve HTTPS to the public internet through Tailscale Funnel on this port, 443, 8443 or 10000; requires -bearer or -basic-auth")
+	flagTLSPort := flag.Int("tls-port", 0, "also serve HTTPS on this tailnet port, like 443, with a tailscale certificate for the MagicDNS name")
+	flagListen := flag.String("listen", "", "also serve on these comma separated addresses of normal interfaces, like 127.0.0.1:8080 for a Prometheus on this host or :8080 for one off the tailnet")
+	flagStateKey := flag.String("state-key", "", "encrypt tailnet state with the key from `source`: file:PATH, cred:NAME, env:NAME or exec:COMMAND")
+	flagAuthKey := flag.String("auth-key", "", "read the tailscale auth key for new nodes from `source`, like -state-key")
 	flagNoLogs := flag.Bool("no-logs-no-support", true, "disable logtail uploading")
 	controlURL := flag.String("control-url", os.Getenv("TS_CONTROL_URL"), "URL of custom tailscale control server")
+	flagTags := flag.String("tags", "", "comma separated ACL tags, like tag:tailmon, that mark tailmon nodes")
+	flagMatchHostname := flag.Bool("match-hostname", true, "discover nodes whose hostname starts with tailmon/")
+	flagLabels := flag.String("labels", "", "comma separated name=value labels added to every target, like tailnet=prod,region=eu")
+	flagScrapeHints := flag.String("scrape-hints", "", "comma separated EXPORTER=INTERVAL[/TIMEOUT], like smartctl-exporter=5m/1m, labeling targets with __scrape_interval__ and __scrape_timeout__")
+	flagJobs := flag.String("jobs", "", "comma separated EXPORTER=JOB or tag:TAG=JOB, like node-exporter=node,tag:db=databases, labeling targets with __meta_tailmon_job instead of the exporter name")
+	flagLabelPrefix := flag.String("label-prefix", "__meta_tailmon_", "start of the tailmon label names; empty keeps them as plain target labels")
+	flagInclude := flag.String("include", "", "only discover nodes whose whole hostname matches this regexp, like 'tailmon/(node|postgres)-exporter/.*'")
+	flagExclude := flag.String("exclude", "", "never discover nodes whose whole hostname matches this regexp, like '.*staging.*'")
+	flagAddressFamily := flag.String("address-family", familyFirst, "which tailnet address targets use: first, ipv4, ipv6, or both for a target per family")
+	flagMagicDNS := flag.Bool("magicdns-targets", false, "list targets by MagicDNS name, like web1.example.ts.net:80, instead of address")
+	flagAllPeers := flag.String("all-peers", "", "also list every other peer as comma separated EXPORTER:PORT[/PATH], like node-exporter:9100, for exporters reachable without tailmon")
+	flagGrace := flag.Duration("grace", 0, "keep a target that disappears for this long, so brief blips do not recreate series; 0 drops it at once")
+	flagForgetMissing := flag.Duration("forget-missing", 7*24*time.Hour, "stop exporting a vanished node as tailmon_target_missing after this long, 0 to keep it until restart")
+	flagAlertmanagerTags := flag.String("alertmanager-tags", "", "comma separated ACL tags, like tag:alertmanager, that mark Alertmanagers for /alertmanagers")
+	flagAlertmanagerPort := flag.Int("alertmanager-port", 9093, "port of Alertmanagers whose name gives none")
+	flagOfflineAfter := flag.Duration("offline-after", 0, "leave out nodes offline for longer than this, 0 to list them all")
+	flagFederate := flag.Bool("federate", false, "serve /federate, which scrapes every target when asked and returns all of their samples")
+	flagFederateTimeout := flag.Duration("federate-timeout", 10*time.Second, "how long /federate waits for its scrapes")
+	flagTargetCache := flag.String("target-cache", "", "save the targets to this file, and serve them labeled stale after a restart until the tailnet is up")
+	flagAuditLog := flag.String("audit-log", "", "append every target added or removed to this file, as JSON lines")
+	flagFileSD := flag.String("file-sd", "", "comma separated paths to also write targets to, for Prometheus file_sd_configs")
+	flagFileSDInterval := flag.Duration("file-sd-interval", 30*time.Second, "how often to update -file-sd")
+	flagDNSDomain := flag.String("dns-domain", "", "answer DNS SRV and A queries for targets under this domain, like tailmon.")
+	flagDNSPort := flag.Int("dns-port", 53, "tailnet port for -dns-domain, over UDP and TCP")
+	flagCacheMaxAge := flag.Duration("cache-max-age", 30*time.Second, "serve targets from cache for up to this long, 0 to ask tailscale on every request")
+	flagHealthInterval := flag.Duration("health-interval", 0, "probe every target's metrics path this often, 0 to disable")
+	flagHealthTimeout := flag.Duration("health-timeout", 5*time.Second, "how long a health probe may take")
+	flagHealthDropAfter := flag.Int("health-drop-after", 0, "leave out targets that failed this many probes in a row, 0 to only label them")
+	flagPingInterval := flag.Duration("ping-interval", 0, "ping every tailmon node this often and export latency and DERP metrics, 0 to disable")
+	flagPingTimeout := flag.Duration("ping-timeout", 10*time.Second, "how long a ping may take")
+	flagEnrich := flag.String("enrich", "", "run this command, without a shell, with the targets as JSON on stdin and serve the groups it writes back, to add labels or drop targets")
+	flagEnrichTimeout := flag.Duration("enrich-timeout", 10*time.Second, "how long -enrich may run")
+	flagLoadInterval := flag.Duration("load-interval", 0, "scrape a few targets of each exporter this often and export the estimated size of scraping them all, 0 to disable")
+	flagLoadSample := flag.Int("load-sample", 3, "targets of each exporter to scrape per -load-interval")
+	flagAPIKey := flag.String("api-key", "", "read a Tailscale API access token, or an OAuth client's ID:SECRET, from a secret SOURCE, to label targets and find hidden tailmon nodes")
+	flagAPITailnet := flag.String("api-tailnet", "-", "tailnet for -api-key, - for the key's own")
+	flagAPIURL := flag.String("api-url", "https://api.tailscale.com", "Tailscale API for -api-key")
+	flagAPIInterval := flag.Duration("api-interval", 5*time.Minute, "how often to read devices with -api-key")
+	flagDeleteOffline := flag.Duration("delete-offline", 0, "with -api-key, delete tailmon devices offline this long, 0 to keep them")
+	flagPeers := flag.String("peers", "", "comma separated URLs of other tailmon-discover instances to compare targets with")
+	flagPeerCheckInterval := flag.Duration("peer-check-interval", 30*time.Second, "how often to compare targets with -peers")
+	flagUpstreams := flag.String("upstreams", "", "comma separated NAME=URL of other tailmon-discover instances whose targets to merge, labeled source")
+	flagUpstreamInterval := flag.Duration("upstream-interval", 30*time.Second, "how often to fetch targets from -upstreams")
+	flagWatch := flag.Bool("watch", true, "also refresh targets as soon as the tailnet's peers change")
+	flagRefreshInterval := flag.Duration("refresh-interval", 10*time.Second, "how often to refresh the target cache in the background")
 	flag.Usage = usage
+	if err := envflag.Apply(flag.CommandLine, "TAILMON_"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 	flag.Parse()
 
 	if flag.NArg() > 0 {
@@ -155,27 +303,402 @@ func main() {
 		flag.Usage()
 	}
 
+	if !*flagMatchHostname && *flagTags == "" {
+		flag.CommandLine.Output().Write([]byte("ERROR: -match-hostname=false requires -tags\n\n"))
+		flag.Usage()
+	}
+
+	if *flagDeleteOffline > 0 && *flagAPIKey == "" {
+		flag.CommandLine.Output().Write([]byte("ERROR: -delete-offline requires -api-key\n\n"))
+		flag.Usage()
+	}
+
+	if *flagFunnelPort != 0 && *flagBearer == "" && *flagBasicAuth == "" {
+		flag.CommandLine.Output().Write([]byte("ERROR: -funnel-port requires -bearer or -basic-auth\n\n"))
+		flag.Usage()
+	}
+
+	if *flagFileSD != "" && *flagFileSDInterval <= 0 {
+		flag.CommandLine.Output().Write([]byte("ERROR: -file-sd-interval must be positive\n\n"))
+		flag.Usage()
+	}
+
+	staticLabels, err := parseLabels(*flagLabels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-labels: %s\n", err)
+		os.Exit(1)
+	}
+	scrapeHints, err := parseScrapeHints(*flagScrapeHints)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-scrape-hints: %s\n", err)
+		os.Exit(1)
+	}
+	jobs, err := parseJobs(*flagJobs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-jobs: %s\n", err)
+		os.Exit(1)
+	}
+	if *flagLabelPrefix != "" && !labelName.MatchString(*flagLabelPrefix) {
+		fmt.Fprintf(os.Stderr, "-label-prefix: %q may only use letters, digits and _\n", *flagLabelPrefix)
+		os.Exit(1)
+	}
+
+	var allPeers *tailmonNode
+	if *flagAllPeers != "" {
+		if allPeers, err = parseAllPeers(*flagAllPeers); err != nil {
+			fmt.Fprintf(os.Stderr, "-all-peers: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch *flagAddressFamily {
+	case familyFirst, familyIPv4, familyIPv6, familyBoth:
+	default:
+		fmt.Fprintf(os.Stderr, "-address-family: %q is not first, ipv4, ipv6 or both\n", *flagAddressFamily)
+		os.Exit(1)
+	}
+
+	include, err := anchoredRegexp(*flagInclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-include: %s\n", err)
+		os.Exit(1)
+	}
+	exclude, err := anchoredRegexp(*flagExclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-exclude: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *flagJoin != "" && *flagTailnet == "" {
+		flag.CommandLine.Output().Write([]byte("ERROR: -join requires -tailnet\n\n"))
+		flag.Usage()
+	}
+	if *flagTailnet != "" && !tailnetName.MatchString(*flagTailnet) {
+		fmt.Fprintf(os.Stderr, "-tailnet: %q may only use letters, digits and _.-\n", *flagTailnet)
+		os.Exit(1)
+	}
+	joined, err := parseJoin(*flagJoin, *flagTailnet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-join: %s\n", err)
+		os.Exit(1)
+	}
+	upstreamList, err := parseUpstreams(*flagUpstreams)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-upstreams: %s\n", err)
+		os.Exit(1)
+	}
+	for _, up := range upstreamList {
+		if up.name == *flagTailnet || slices.ContainsFunc(joined, func(j joinedTailnet) bool { return j.name == up.name }) {
+			fmt.Fprintf(os.Stderr, "-upstreams: %q is also a joined tailnet\n", up.name)
+			os.Exit(1)
+		}
+	}
+
+	var dnsDomain string
+	if *flagDNSDomain != "" {
+		var err error
+		if dnsDomain, err = fqdn(*flagDNSDomain); err != nil {
+			fmt.Fprintf(os.Stderr, "-dns-domain: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *flagNoLogs {
 		logtail.Disable()
 		envknob.SetNoLogsNoSupport() // NOTE: This may not do anything.
 	}
 
+	var stateKey []byte
+	if *flagStateKey != "" {
+		var err error
+		stateKey, err = secret.Read(context.Background(), *flagStateKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-state-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var authKey []byte
+	if *flagAuthKey != "" {
+		var err error
+		authKey, err = secret.Read(context.Background(), *flagAuthKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-auth-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var bearer, basicAuth []byte
+	if *flagBearer != "" {
+		var err error
+		bearer, err = secret.Read(context.Background(), *flagBearer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-bearer: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagBasicAuth != "" {
+		var err error
+		basicAuth, err = secret.Read(context.Background(), *flagBasicAuth)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-basic-auth: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var signKey []byte
+	if *flagSignKey != "" {
+		var err error
+		signKey, err = secret.Read(context.Background(), *flagSignKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-sign-key: %s\n", err)
+			os.Exit(1)
+		}
+		signKey = []byte(strings.TrimSpace(string(signKey)))
+	}
+	var apiKey []byte
+	if *flagAPIKey != "" {
+		var err error
+		apiKey, err = secret.Read(context.Background(), *flagAPIKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-api-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	auth, err := newHTTPAuth(bearer, basicAuth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-basic-auth: %s\n", err)
+		os.Exit(1)
+	}
+
 	logger := log.MustZapLogger(*flagDebug)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// /federate answers after its scrapes, and the default write
+	// timeout would cut off a long -federate-timeout.
+	writeTimeout := max(30*time.Second, *flagFederateTimeout+5*time.Second)
 	srv := &tshttp.Server{
 		Logger:     logger,
 		Name:       "tailmon-discover",
 		ControlURL: *controlURL,
 		StateDir:   *flagState,
+		StateKey:   stateKey,
+		AuthKey:    string(authKey),
 		Debug:      *flagDebug,
+		Addrs:      splitList(*flagTailnetListen),
+		TLSPort:    *flagTLSPort,
+		FunnelPort: *flagFunnelPort,
+		LocalAddrs: splitList(*flagListen),
+
+		WriteTimeout: writeTimeout,
 	}
-	tailnet := srv.Tailnet()
-	handler := NewDiscoverHandler(logger, tailnet)
-	if err := srv.Start(handler); err != nil {
-		logger.Fatal("unable to initialize", zap.Error(err))
+	servers := []*tshttp.Server{srv}
+	for _, j := range joined {
+		control := j.controlURL
+		if control == "" {
+			control = *controlURL
+		}
+		servers = append(servers, &tshttp.Server{
+			Logger:     logger.With(zap.String("tailnet", j.name)),
+			Name:       "tailmon-discover",
+			ControlURL: control,
+			StateDir:   filepath.Join(*flagState, "tailnet-"+j.name),
+			StateKey:   stateKey,
+			Debug:      *flagDebug,
+			Addrs:      splitList(*flagTailnetListen),
+
+			WriteTimeout: writeTimeout,
+		})
+	}
+	d := &discoverer{
+		tailnets:      []*tailnet{newTailnet(*flagTailnet, srv.Tailnet(), *flagWhoisTTL)},
+		heartbeats:    newHeartbeats(),
+		matchHostname: *flagMatchHostname,
+		tags:          splitList(*flagTags),
+		allPeers:      allPeers,
+		maxAge:        *flagCacheMaxAge,
+		family:        *flagAddressFamily,
+		magicDNS:      *flagMagicDNS,
+		include:       include,
+		exclude:       exclude,
+		offlineAfter:  *flagOfflineAfter,
+		grace:         *flagGrace,
+		forgetMissing: *flagForgetMissing,
+		wake:          make(chan struct{}, 1),
+		labelPrefix:   *flagLabelPrefix,
+		staticLabels:  staticLabels,
+		scrapeHints:   scrapeHints,
+		jobs:          jobs,
+		signKey:       signKey,
+
+		alertmanagerTags: splitList(*flagAlertmanagerTags),
+		alertmanagerPort: *flagAlertmanagerPort,
+	}
+	for i, j := range joined {
+		d.tailnets = append(d.tailnets, newTailnet(j.name, servers[i+1].Tailnet(), *flagWhoisTTL))
+	}
+	if *flagAuditLog != "" {
+		if err := d.audit.open(logger.Named("audit"), *flagAuditLog); err != nil {
+			logger.Fatal("audit log", zap.Error(err))
+		}
+		defer d.audit.close()
+	}
+	if *flagFederate {
+		d.federateTimeout = *flagFederateTimeout
+	}
+	if *flagTargetCache != "" {
+		d.cache = &targetCache{logger: logger.Named("cache"), path: *flagTargetCache}
+		d.ready = srv.Ready()
+		stale, err := d.cache.load(d)
+		if err != nil {
+			logger.Warn("last targets", zap.Error(err))
+		}
+		d.stale = stale
+	}
+	if *flagHealthInterval > 0 {
+		d.health = &healthChecker{
+			logger:    logger.Named("health"),
+			interval:  *flagHealthInterval,
+			timeout:   *flagHealthTimeout,
+			dropAfter: *flagHealthDropAfter,
+		}
+	}
+	if *flagPingInterval > 0 {
+		d.ping = &pinger{
+			logger:   logger.Named("ping"),
+			d:        d,
+			interval: *flagPingInterval,
+			timeout:  *flagPingTimeout,
+		}
+	}
+	if *flagEnrich != "" {
+		if d.enrich, err = newEnricher(logger.Named("enrich"), d, *flagEnrich, *flagEnrichTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "-enrich: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagLoadInterval > 0 {
+		d.load = &loadEstimator{
+			logger:   logger.Named("load"),
+			d:        d,
+			interval: *flagLoadInterval,
+			timeout:  min(*flagLoadInterval, 30*time.Second),
+			sample:   max(*flagLoadSample, 1),
+		}
+	}
+	if len(apiKey) > 0 {
+		d.api = &adminAPI{
+			logger:   logger.Named("api"),
+			d:        d,
+			client:   &http.Client{Timeout: 30 * time.Second},
+			base:     strings.TrimSuffix(*flagAPIURL, "/"),
+			tailnet:  *flagAPITailnet,
+			interval: *flagAPIInterval,
+			key:      strings.TrimSpace(string(apiKey)),
+
+			deleteAfter: *flagDeleteOffline,
+		}
+	}
+	var peers *peerChecker
+	if urls := splitList(*flagPeers); len(urls) > 0 {
+		peers = &peerChecker{
+			logger:     logger.Named("peers"),
+			d:          d,
+			auth:       auth,
+			client:     d.tailnets[0].client,
+			peers:      urls,
+			interval:   *flagPeerCheckInterval,
+			consistent: map[string]bool{},
+		}
+	}
+	if len(upstreamList) > 0 {
+		d.upstreams = &upstreams{
+			logger:   logger.Named("upstreams"),
+			d:        d,
+			auth:     auth,
+			tailnet:  d.tailnets[0].client,
+			direct:   &http.Client{Timeout: *flagUpstreamInterval},
+			list:     upstreamList,
+			interval: *flagUpstreamInterval,
+			targets:  map[string][]*Endpoint{},
+			up:       map[string]bool{},
+		}
+	}
+	allow := splitList(*flagAllow)
+	limiter := newRateLimiter(*flagRateLimit, *flagRateBurst, *flagMaxInflight)
+	for i, via := range d.tailnets {
+		whois := via.whois
+		servers[i].Middlewares = []tshttp.Middleware{
+			countRequests,
+			tshttp.Recover(logger.Named("http")),
+			tshttp.Identify(whois.whois),
+			func(h http.Handler) http.Handler {
+				return limiter.wrap(h, []string{eventsPath}, []string{scrapePath, nodesPath, federatePath})
+			},
+			// Heartbeats are checked by the sender's tailnet identity instead.
+			func(h http.Handler) http.Handler { return auth.wrap(h, heartbeat.Path) },
+			func(h http.Handler) http.Handler {
+				return allowPeers(logger.Named("allow"), allow, h, heartbeat.Path)
+			},
+		}
+		handler := NewDiscoverHandler(logger, d, via, peers)
+		if err := servers[i].StartContext(ctx, handler); err != nil {
+			logger.Fatal("unable to initialize", zap.String("tailnet", via.name), zap.Error(err))
+		}
+	}
+
+	if *flagCacheMaxAge > 0 && *flagRefreshInterval > 0 {
+		go d.refresh(ctx, logger.Named("refresh"), *flagRefreshInterval, srv.Ready())
+		if *flagWatch {
+			for i, via := range d.tailnets {
+				go d.watch(ctx, logger.Named("watch"), via, servers[i].Ready())
+			}
+		}
+	}
+
+	if d.health != nil {
+		go d.health.run(ctx, srv.Ready())
+	}
+
+	if peers != nil {
+		go peers.run(ctx, srv.Ready())
+	}
+
+	if d.upstreams != nil {
+		go d.upstreams.run(ctx, srv.Ready())
+	}
+
+	if d.api != nil {
+		go d.api.run(ctx, srv.Ready())
+	}
+
+	if d.ping != nil {
+		go d.ping.run(ctx, srv.Ready())
+	}
+
+	if d.load != nil {
+		go d.load.run(ctx, srv.Ready())
+	}
+
+	if dnsDomain != "" {
+		for _, via := range d.tailnets {
+			dns := &dnsServer{logger: logger.Named("dns"), d: d, via: via, domain: dnsDomain}
+			if err := dns.serve(ctx, *flagDNSPort); err != nil {
+				logger.Fatal("dns", zap.String("tailnet", via.name), zap.Error(err))
+			}
+		}
+	}
+
+	if paths := splitList(*flagFileSD); len(paths) > 0 {
+		f := &fileSDWriter{
+			logger:   logger.Named("file_sd"),
+			d:        d,
+			paths:    paths,
+			interval: *flagFileSDInterval,
+			ready:    srv.Ready(),
+		}
+		go f.run(ctx)
 	}
 
 	sigs := make(chan os.Signal, 1)
@@ -184,5 +707,8 @@ func main() {
 	case <-sigs:
 	case <-ctx.Done():
 	}
-	srv.Shutdown()
+	d.events.close()
+	for _, s := range servers {
+		s.Shutdown()
+	}
 }
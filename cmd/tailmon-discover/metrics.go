@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// peerFamily is a per-peer metric.  value returns false to skip a peer,
+// such as for a timestamp that is not known.
+type peerFamily struct {
+	name  string
+	help  string
+	typ   string
+	value func(p *ipnstate.PeerStatus) (float64, bool)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func timestamp(t time.Time) (float64, bool) {
+	if t.IsZero() {
+		return 0, false
+	}
+	return float64(t.UnixNano()) / 1e9, true
+}
+
+var peerFamilies = []peerFamily{
+	{"tailscale_peer_online", "Whether the peer is connected to the control plane.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return boolValue(p.Online), true }},
+	{"tailscale_peer_active", "Whether there has been recent traffic with the peer.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return boolValue(p.Active), true }},
+	{"tailscale_peer_expired", "Whether the peer's node key has expired.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return boolValue(p.Expired), true }},
+	{"tailscale_peer_rx_bytes_total", "Bytes received from the peer.", "counter",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return float64(p.RxBytes), true }},
+	{"tailscale_peer_tx_bytes_total", "Bytes sent to the peer.", "counter",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return float64(p.TxBytes), true }},
+	{"tailscale_peer_created_timestamp_seconds", "When the peer was added to the tailnet.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return timestamp(p.Created) }},
+	{"tailscale_peer_last_seen_timestamp_seconds", "When the peer was last connected to the control plane, if offline.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return timestamp(p.LastSeen) }},
+	{"tailscale_peer_last_handshake_timestamp_seconds", "When the last WireGuard handshake with the peer happened.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) { return timestamp(p.LastHandshake) }},
+	{"tailscale_peer_key_expiry_timestamp_seconds", "When the peer's node key expires.", "gauge",
+		func(p *ipnstate.PeerStatus) (float64, bool) {
+			if p.KeyExpiry == nil {
+				return 0, false
+			}
+			return timestamp(*p.KeyExpiry)
+		}},
+}
+
+// peerName identifies a peer in metric labels by its MagicDNS name.
+func peerName(p *ipnstate.PeerStatus) string {
+	return strings.TrimSuffix(p.DNSName, ".")
+}
+
+// writeTailnetMetrics writes the state of every peer that this node
+// can see.  tailscale_peer_info carries the descriptive labels, to be
+// joined on "peer" with the other families.
+func writeTailnetMetrics(w *metrics.Writer, status *ipnstate.Status) {
+	peers := make([]*ipnstate.PeerStatus, 0, len(status.Peer))
+	for _, p := range status.Peer {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peerName(peers[i]) < peerName(peers[j]) })
+
+	w.Header("tailscale_peers", "Peers visible to tailmon-discover.", "gauge")
+	w.Sample("tailscale_peers", nil, float64(len(peers)))
+
+	w.Header("tailscale_peer_info", "Information about a tailnet peer, always 1.", "gauge")
+	for _, p := range peers {
+		var tags []string
+		if p.Tags != nil {
+			tags = p.Tags.AsSlice()
+		}
+		user := ""
+		if profile, ok := status.User[p.UserID]; ok {
+			user = profile.LoginName
+		}
+		var ips []string
+		for _, ip := range p.TailscaleIPs {
+			ips = append(ips, ip.String())
+		}
+		w.Sample("tailscale_peer_info", []string{
+			"peer", peerName(p),
+			"id", string(p.ID),
+			"hostname", p.HostName,
+			"os", p.OS,
+			"user", user,
+			"tags", strings.Join(tags, ","),
+			"ips", strings.Join(ips, ","),
+			"relay", p.Relay,
+		}, 1)
+	}
+
+	for _, f := range peerFamilies {
+		w.Header(f.name, f.help, f.typ)
+		for _, p := range peers {
+			if v, ok := f.value(p); ok {
+				w.Sample(f.name, []string{"peer", peerName(p)}, v)
+			}
+		}
+	}
+}
+
+// newTailnetMetricsHandler exports the whole tailnet, as seen by this node,
+// followed by each of collect and discover's own metrics.
+func newTailnetMetricsHandler(logger *zap.Logger, tailnet *tsnet.Server, collect ...func(w *metrics.Writer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lc, err := tailnet.LocalClient()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status, err := lc.Status(r.Context())
+		if err != nil {
+			logger.Error("Status", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := metrics.NewWriter(w)
+		writeTailnetMetrics(mw, status)
+		for _, fn := range collect {
+			fn(mw)
+		}
+		_ = mw.Flush()
+		_, _ = selfMetrics.WriteTo(w)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+
+	"github.com/jamessanford/tailmon/internal/heartbeat"
+)
+
+// nodePath returns everything discover knows about one peer as JSON, for
+// inventory and other tools beyond Prometheus: /node/NAME, where NAME is
+// its hostname, tailmon node name, MagicDNS name or a Tailscale address.
+// ?tailnet= picks among joined tailnets.
+const nodePath = "/node/"
+
+// nodeView is a peer as discover sees it.
+type nodeView struct {
+	Tailnet   string               `json:"tailnet,omitempty"`
+	ID        tailcfg.StableNodeID `json:"id"`
+	Hostname  string               `json:"hostname"`
+	DNSName   string               `json:"dns_name"`
+	OS        string               `json:"os,omitempty"`
+	User      string               `json:"user,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+	Addresses []netip.Addr         `json:"addresses"`
+	Online    bool                 `json:"online"`
+	LastSeen  *time.Time           `json:"last_seen,omitempty"`
+	Created   *time.Time           `json:"created,omitempty"`
+	Hostinfo  *tailcfg.Hostinfo    `json:"hostinfo,omitempty"`
+
+	// Heartbeat is the node's latest, if it sends them.
+	Heartbeat *nodeHeartbeat `json:"heartbeat,omitempty"`
+
+	// Node and Exporters are what discovery made of the peer, and
+	// Reason why it did not become targets.
+	Node      string   `json:"node,omitempty"`
+	Exporters []string `json:"exporters,omitempty"`
+	Matched   bool     `json:"matched"`
+	Reason    string   `json:"reason,omitempty"`
+
+	// Targets are the peer's in the current SD response, with the
+	// labels served.
+	Targets []*Endpoint `json:"targets"`
+}
+
+type nodeHeartbeat struct {
+	heartbeat.Heartbeat
+	Received time.Time `json:"received"`
+	Alive    bool      `json:"alive"`
+}
+
+func newNodeHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, nodePath)
+		if name == "" || strings.Contains(name, "/") {
+			http.Error(w, "want "+nodePath+"NAME", http.StatusNotFound)
+			return
+		}
+		views, err := d.nodeViews(r.Context(), name, r.URL.Query().Get("tailnet"))
+		if err != nil {
+			logger.Error("node", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch len(views) {
+		case 0:
+			http.Error(w, "no such node", http.StatusNotFound)
+			return
+		case 1:
+		default:
+			http.Error(w, fmt.Sprintf("%q matches %d peers, use a MagicDNS name, an address or tailnet=", name, len(views)), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(views[0]); err != nil {
+			logger.Debug("node", zap.Error(err))
+		}
+	})
+}
+
+// nodeViews describes the peers that go by name.
+func (d *discoverer) nodeViews(ctx context.Context, name, tailnet string) ([]*nodeView, error) {
+	snap, err := d.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var views []*nodeView
+	now := time.Now()
+	for _, via := range d.tailnets {
+		if tailnet != "" && via.name != tailnet {
+			continue
+		}
+		lc, err := via.srv.LocalClient()
+		if err != nil {
+			return nil, err
+		}
+		status, err := lc.Status(ctx)
+		if err != nil {
+			if len(d.tailnets) > 1 {
+				err = fmt.Errorf("tailnet %s: %w", via.name, err)
+			}
+			return nil, err
+		}
+		for _, v := range status.Peer {
+			if d.nodeNamed(v, name) {
+				views = append(views, d.nodeView(ctx, snap, status, via, v, now))
+			}
+		}
+	}
+	return views, nil
+}
+
+// nodeNamed reports whether name is one of v's names or addresses.
+func (d *discoverer) nodeNamed(v *ipnstate.PeerStatus, name string) bool {
+	dnsName := strings.TrimSuffix(v.DNSName, ".")
+	machine, _, _ := strings.Cut(dnsName, ".")
+	if name == v.HostName || name == dnsName || name == machine {
+		return true
+	}
+	if tn, ok := d.lookup(v); ok && name == tn.node {
+		return true
+	}
+	return slices.ContainsFunc(v.TailscaleIPs, func(ip netip.Addr) bool { return name == ip.String() })
+}
+
+func (d *discoverer) nodeView(ctx context.Context, snap *snapshot, status *ipnstate.Status, via *tailnet, v *ipnstate.PeerStatus, now time.Time) *nodeView {
+	view := &nodeView{
+		Tailnet:   via.name,
+		ID:        v.ID,
+		Hostname:  v.HostName,
+		DNSName:   strings.TrimSuffix(v.DNSName, "."),
+		OS:        v.OS,
+		Addresses: v.TailscaleIPs,
+		Online:    v.Online,
+		Targets:   []*Endpoint{},
+	}
+	if v.Tags != nil {
+		view.Tags = v.Tags.AsSlice()
+	}
+	if profile, ok := status.User[v.UserID]; ok {
+		view.User = profile.LoginName
+	}
+	if !v.LastSeen.IsZero() {
+		view.LastSeen = &v.LastSeen
+	}
+	if !v.Created.IsZero() {
+		view.Created = &v.Created
+	}
+	// Status leaves out most of Hostinfo; WhoIs has all of it.
+	if len(v.TailscaleIPs) > 0 {
+		who, err := via.whois.whois(ctx, netip.AddrPortFrom(v.TailscaleIPs[0], 0).String())
+		if err == nil && who.Node != nil && who.Node.Hostinfo.Valid() {
+			view.Hostinfo = who.Node.Hostinfo.AsStruct()
+		}
+	}
+	if beat, ok := d.heartbeats.get(v.ID); ok {
+		view.Heartbeat = &nodeHeartbeat{beat.Heartbeat, beat.received, beat.alive(now)}
+	}
+
+	if tn, ok := d.lookup(v); ok {
+		view.Node, view.Exporters = tn.node, tn.exporters
+	}
+	endpoints, reason := d.peerEndpoints(status, via, v, now)
+	view.Matched, view.Reason = len(endpoints) > 0, reason
+	// A peer's addresses are its own within a tailnet.
+	for _, ep := range snap.endpoints {
+		if ep.via == via && slices.Contains(v.TailscaleIPs, ep.ip) {
+			view.Targets = append(view.Targets, ep)
+		}
+	}
+	return view
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// newTargetAllocatorHandler serves the HTTP API of the OpenTelemetry
+// Operator's target allocator, so an OpenTelemetry Collector's
+// prometheus receiver can use tailmon-discover as its target_allocator:
+//
+//	/scrape_configs             one scrape config per exporter
+//	/jobs                       links to each job's targets
+//	/jobs/JOB/targets           that job's targets, in HTTP SD format
+//
+// Each job from -jobs, by default each exporter, is a job.  Every
+// collector_id is given every target.
+func newTargetAllocatorHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap, err := d.endpoints(r.Context())
+		if err != nil {
+			logger.Error("endpoints", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs := map[string][]*Endpoint{}
+		for _, ep := range snap.endpoints {
+			jobs[ep.job] = append(jobs[ep.job], ep)
+		}
+
+		var v any
+		switch path := r.URL.Path; {
+		case path == "/scrape_configs":
+			configs := map[string]taScrapeConfig{}
+			for job := range jobs {
+				configs[job] = newTAScrapeConfig(job, d.label("node_name"))
+			}
+			v = configs
+		case path == "/jobs":
+			links := map[string]taLink{}
+			for job := range jobs {
+				links[job] = taLink{"/jobs/" + url.PathEscape(job) + "/targets"}
+			}
+			v = links
+		case strings.HasPrefix(path, "/jobs/") && strings.HasSuffix(path, "/targets"):
+			job, err := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(r.URL.EscapedPath(), "/jobs/"), "/targets"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			eps, ok := jobs[job]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Query().Get("collector_id") == "" {
+				// Without a collector, the target allocator lists
+				// targets per collector.
+				v = map[string]taCollectorTargets{"tailmon": {Link: r.URL.EscapedPath() + "?collector_id=tailmon", Targets: eps}}
+				break
+			}
+			v = eps
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			logger.Debug("encode", zap.Error(err))
+		}
+	})
+}
+
+type taLink struct {
+	Link string `json:"_link"`
+}
+
+type taCollectorTargets struct {
+	Link    string      `json:"_link"`
+	Targets []*Endpoint `json:"targets"`
+}
+
+// taScrapeConfig is the part of a Prometheus scrape_config that a job
+// needs; the collector fills in its own defaults for the rest.
+type taScrapeConfig struct {
+	JobName        string            `json:"job_name"`
+	MetricsPath    string            `json:"metrics_path"`
+	RelabelConfigs []taRelabelConfig `json:"relabel_configs"`
+}
+
+type taRelabelConfig struct {
+	SourceLabels []string `json:"source_labels"`
+	TargetLabel  string   `json:"target_label"`
+	Action       string   `json:"action"`
+}
+
+func newTAScrapeConfig(job, nodeLabel string) taScrapeConfig {
+	return taScrapeConfig{
+		JobName:     job,
+		MetricsPath: "/metrics",
+		RelabelConfigs: []taRelabelConfig{
+			{SourceLabels: []string{nodeLabel}, TargetLabel: "node", Action: "replace"},
+		},
+	}
+}
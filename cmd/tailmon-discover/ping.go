@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// pinger pings every tailmon node through the LocalClient and exports
+// the latency and the path scrapes take to it, direct or relayed
+// through a DERP region.
+type pinger struct {
+	logger   *zap.Logger
+	d        *discoverer
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	results map[string]pingResult
+}
+
+type pingResult struct {
+	node, address, tailnet string
+	ok                     bool
+	latency                time.Duration
+	direct                 bool
+	derpRegion             string // when relayed
+}
+
+func (p *pinger) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round pings each node once, however many exporters it has.
+func (p *pinger) round(ctx context.Context) {
+	snap, err := p.d.endpoints(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.logger.Error("endpoints", zap.Error(err))
+		}
+		return
+	}
+	nodes := map[string]*Endpoint{}
+	for _, ep := range snap.endpoints {
+		if !ep.via.local() {
+			continue
+		}
+		key := ep.via.name + "/" + ep.ip.String()
+		if _, ok := nodes[key]; !ok {
+			nodes[key] = ep
+		}
+	}
+
+	results := map[string]pingResult{}
+	var resultsMu sync.Mutex
+	sem := make(chan struct{}, maxProbes)
+	var wg sync.WaitGroup
+	for key, ep := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string, ep *Endpoint) {
+			defer func() { <-sem; wg.Done() }()
+			r := p.ping(ctx, ep)
+			resultsMu.Lock()
+			results[key] = r
+			resultsMu.Unlock()
+		}(key, ep)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	p.mu.Lock()
+	p.results = results
+	p.mu.Unlock()
+}
+
+func (p *pinger) ping(ctx context.Context, ep *Endpoint) pingResult {
+	r := pingResult{node: ep.node, address: ep.ip.String(), tailnet: ep.via.name}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	lc, err := ep.via.srv.LocalClient()
+	if err != nil {
+		return r
+	}
+	res, err := lc.Ping(ctx, ep.ip, tailcfg.PingDisco)
+	if err == nil && res.Err != "" {
+		err = errors.New(res.Err)
+	}
+	if err != nil {
+		p.logger.Debug("ping", zap.String("node", ep.node), zap.Stringer("ip", ep.ip), zap.Error(err))
+		return r
+	}
+	r.ok = true
+	r.latency = time.Duration(res.LatencySeconds * float64(time.Second))
+	r.direct = res.Endpoint != ""
+	if !r.direct {
+		r.derpRegion = res.DERPRegionCode
+		if r.derpRegion == "" && res.DERPRegionID != 0 {
+			r.derpRegion = strconv.Itoa(res.DERPRegionID)
+		}
+	}
+	return r
+}
+
+// writePingMetrics exports the last ping of every node.
+func (p *pinger) writePingMetrics(w *metrics.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.results))
+	for key := range p.results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := func(r pingResult) []string {
+		l := []string{"node", r.node, "address", r.address}
+		if r.tailnet != "" {
+			l = append(l, "tailnet", r.tailnet)
+		}
+		return l
+	}
+
+	w.Header("tailmon_peer_ping_success", "Whether the node answered its last ping.", "gauge")
+	for _, key := range keys {
+		r := p.results[key]
+		w.Sample("tailmon_peer_ping_success", labels(r), boolValue(r.ok))
+	}
+	w.Header("tailmon_peer_ping_latency_seconds", "Round trip time of the last ping.", "gauge")
+	for _, key := range keys {
+		if r := p.results[key]; r.ok {
+			w.Sample("tailmon_peer_ping_latency_seconds", labels(r), r.latency.Seconds())
+		}
+	}
+	w.Header("tailmon_peer_ping_direct", "Whether the last ping went directly rather than through derp_region.", "gauge")
+	for _, key := range keys {
+		if r := p.results[key]; r.ok {
+			w.Sample("tailmon_peer_ping_direct", append(labels(r), "derp_region", r.derpRegion), boolValue(r.direct))
+		}
+	}
+}
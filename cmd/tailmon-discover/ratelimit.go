@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var limitedRequests = selfMetrics.Counter("tailmon_discover_requests_limited_total",
+	"HTTP requests turned away by -rate-limit or -max-inflight.", "reason")
+
+// rateLimiter keeps a misconfigured client from starving everyone else:
+// each client address gets rate requests per second with bursts of
+// burst, and slots caps the requests served at once.
+type rateLimiter struct {
+	rate  float64 // zero for no per-client limit
+	burst float64
+	slots chan struct{} // nil for no cap
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*bucket
+	swept   time.Time
+}
+
+// bucket holds a client's tokens as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst, inflight int) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(max(burst, 1)), clients: map[netip.Addr]*bucket{}}
+	if inflight > 0 {
+		l.slots = make(chan struct{}, inflight)
+	}
+	return l
+}
+
+// allow takes a token for client, reporting false when it has none.
+func (l *rateLimiter) allow(client netip.Addr, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets clients whose buckets have refilled, which are the same
+// as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// wrap limits requests to next.  Paths in unbounded, such as event
+// streams that stay open, are rate limited but take no slot.  Paths in
+// exempt, or under them if they end in a slash, are not limited at all:
+// those are Prometheus scraping targets through discover, which a server
+// does many times a second by design.
+func (l *rateLimiter) wrap(next http.Handler, unbounded, exempt []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.ContainsFunc(exempt, func(p string) bool { return underPath(r.URL.Path, p) }) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.allow(remoteAddr(r), time.Now()) {
+			limitedRequests.With("rate").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(max(1, 1/l.rate))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if l.slots != nil && !slices.Contains(unbounded, r.URL.Path) {
+			select {
+			case l.slots <- struct{}{}:
+				defer func() { <-l.slots }()
+			default:
+				limitedRequests.With("inflight").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// underPath reports whether path is p or, for a p ending in a slash,
+// anything below it.
+func underPath(path, p string) bool {
+	return path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)
+}
+
+// remoteAddr is the client's address, without its port.
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
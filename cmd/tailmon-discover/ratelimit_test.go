@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	a, b := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2")
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		client netip.Addr
+		after  time.Duration
+		want   bool
+	}{
+		{"burst 1", a, 0, true},
+		{"burst 2", a, 0, true},
+		{"burst 3", a, 0, true},
+		{"empty", a, 0, false},
+		{"other client has its own bucket", b, 0, true},
+		{"half a token", a, 250 * time.Millisecond, false},
+		{"refilled one token", a, 250 * time.Millisecond, true},
+		{"spent it", a, 0, false},
+		{"refill stops at the burst", a, time.Hour, true},
+		{"burst 2 after refill", a, 0, true},
+		{"burst 3 after refill", a, 0, true},
+		{"empty after refill", a, 0, false},
+	}
+	l := newRateLimiter(2, 3, 0)
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		if got := l.allow(tt.client, now); got != tt.want {
+			t.Errorf("%s: allow = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Only the buckets that are full again are forgotten.
+	l.allow(b, now)
+	l.sweep(now.Add(time.Second))
+	if _, ok := l.clients[b]; ok {
+		t.Errorf("sweep kept a refilled client")
+	}
+	if _, ok := l.clients[a]; !ok {
+		t.Errorf("sweep forgot a client still below its burst")
+	}
+
+	if unlimited := newRateLimiter(0, 0, 0); !unlimited.allow(a, now) || len(unlimited.clients) != 0 {
+		t.Errorf("a zero rate limits or tracks clients")
+	}
+}
+
+func TestRateLimiterWrap(t *testing.T) {
+	block := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("block") {
+			<-block
+		}
+	})
+	l := newRateLimiter(1, 1, 1)
+	h := l.wrap(next, []string{eventsPath}, []string{scrapePath, nodesPath})
+	get := func(target, addr string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name, target, addr string
+		want               int
+	}{
+		{"first request", "/", "100.64.0.1:1000", http.StatusOK},
+		{"over the rate", "/", "100.64.0.1:1001", http.StatusTooManyRequests},
+		{"scrape is exempt", "/scrape?target=web1", "100.64.0.1:1002", http.StatusOK},
+		{"nodes is exempt", "/nodes/web1/node-exporter/metrics", "100.64.0.1:1003", http.StatusOK},
+		{"nodes prefix only", "/nodesx", "100.64.0.1:1004", http.StatusTooManyRequests},
+		{"mapped IPv4", "/", "[::ffff:100.64.0.1]:1005", http.StatusTooManyRequests},
+		{"another client", "/", "[fd7a:115c:a1e0::1]:1006", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := get(tt.target, tt.addr); got != tt.want {
+			t.Errorf("%s: %s = %d, want %d", tt.name, tt.target, got, tt.want)
+		}
+	}
+
+	// One request in flight fills the only slot; events streams and
+	// exempt paths take none.
+	done := make(chan int)
+	go func() { done <- get("/?block=1", "100.64.0.9:1000") }()
+	for len(l.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := get("/", "100.64.0.10:1000"); got != http.StatusServiceUnavailable {
+		t.Errorf("with no slot free = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	if got := get(eventsPath, "100.64.0.11:1000"); got != http.StatusOK {
+		t.Errorf("events with no slot free = %d, want %d", got, http.StatusOK)
+	}
+	if got := get(scrapePath, "100.64.0.10:1000"); got != http.StatusOK {
+		t.Errorf("scrape with no slot free = %d, want %d", got, http.StatusOK)
+	}
+	close(block)
+	if got := <-done; got != http.StatusOK {
+		t.Errorf("blocked request = %d", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// scrapePath proxies a scrape over the tailnet, for a Prometheus that
+// is not on it:
+//
+//	/scrape?target=NODE&exporter=EXPORTER
+//
+// With several tailnets joined, &tailnet=NAME picks between nodes of the
+// same name.
+const scrapePath = "/scrape"
+
+// nodesPath is the same proxy at a URL to browse to, like
+// /nodes/web1/node-exporter/metrics, also taking &tailnet=NAME.
+const nodesPath = "/nodes/"
+
+type scrapeEndpointKey struct{}
+
+// newScrapeProxy finds the discovered target and passes the scrape to it.
+// Only discovered targets can be reached, so this is not an open proxy
+// into the tailnet.
+func newScrapeProxy(logger *zap.Logger, d *discoverer) http.Handler {
+	proxy := newTargetProxy(logger)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		node, exporter, tailnet := q.Get("target"), q.Get("exporter"), q.Get("tailnet")
+		if node == "" || exporter == "" {
+			http.Error(w, "need target=NODE and exporter=EXPORTER", http.StatusBadRequest)
+			return
+		}
+		serveTarget(logger, d, proxy, w, r, node, exporter, tailnet)
+	})
+}
+
+// newNodesProxy serves nodesPath.
+func newNodesProxy(logger *zap.Logger, d *discoverer) http.Handler {
+	proxy := newTargetProxy(logger)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, nodesPath), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] != "metrics" {
+			http.Error(w, "want "+nodesPath+"NODE/EXPORTER/metrics", http.StatusNotFound)
+			return
+		}
+		serveTarget(logger, d, proxy, w, r, parts[0], parts[1], r.URL.Query().Get("tailnet"))
+	})
+}
+
+func newTargetProxy(logger *zap.Logger) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			ep := r.In.Context().Value(scrapeEndpointKey{}).(*Endpoint)
+			r.Out.URL = &url.URL{Scheme: "http", Host: ep.Targets[0], Path: metricsPath(ep)}
+			r.Out.Host = ep.Targets[0]
+			r.Out.Header.Del("Authorization")
+			r.Out.Header.Del("Cookie")
+		},
+		// Dial over whichever tailnet the target was found on.
+		Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ctx.Value(scrapeEndpointKey{}).(*Endpoint).via.srv.Dial(ctx, network, addr)
+		}},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if !errors.Is(err, context.Canceled) {
+				logger.Warn("scrape", zap.String("url", r.URL.String()), zap.Error(err))
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// serveTarget passes r to the discovered target.
+func serveTarget(logger *zap.Logger, d *discoverer, proxy http.Handler, w http.ResponseWriter, r *http.Request, node, exporter, tailnet string) {
+	snap, err := d.endpoints(r.Context())
+	if err != nil {
+		logger.Error("endpoints", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var found *Endpoint
+	for _, ep := range snap.endpoints {
+		if ep.node == node && ep.exporter == exporter && (tailnet == "" || ep.via.name == tailnet) && ep.via.local() {
+			found = ep
+			break
+		}
+	}
+	if found == nil {
+		http.Error(w, "no such target", http.StatusNotFound)
+		return
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scrapeEndpointKey{}, found)))
+}
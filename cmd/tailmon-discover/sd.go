@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sdVersions are the schema versions of the SD response, oldest first.
+// Version 1 is the list of targets and labels served since the start.
+// A client that asks for no version gets version 1, so that a change to
+// labels or structure comes as a new version without breaking existing
+// Prometheus configs.
+var sdVersions = []int{1}
+
+// sdVersionHeader tells the client which version it got.
+const sdVersionHeader = "Tailmon-Sd-Version"
+
+// totalCountHeader counts the matching targets across every page.
+const totalCountHeader = "Tailmon-Total-Count"
+
+// signatureHeader carries, with -sign-key, "sha256=" and the hex
+// HMAC-SHA256 of the response body before any Content-Encoding, so a
+// client fetching through proxies or caches can check the targets came
+// from discover unchanged.
+const signatureHeader = "Tailmon-Signature"
+
+func signBody(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sdVersion is the schema version r asks for with ?version=N, or else
+// with a version parameter in Accept, like "application/json; version=1".
+func sdVersion(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("version")
+	if s == "" {
+		for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+			if _, params, err := mime.ParseMediaType(part); err == nil && params["version"] != "" {
+				s = params["version"]
+				break
+			}
+		}
+	}
+	if s == "" {
+		return sdVersions[0], nil
+	}
+	if s == "latest" {
+		return sdVersions[len(sdVersions)-1], nil
+	}
+	v, err := strconv.Atoi(s)
+	if err == nil {
+		for _, known := range sdVersions {
+			if v == known {
+				return v, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown version %q, want one of %v or latest", s, sdVersions)
+}
+
+// newSDHandler serves the Prometheus HTTP SD response, or another
+// ?format=, in the schema version the client asks for.
+func newSDHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "tailmon-discover\n")
+			return
+		}
+		serveSD(logger, d, w, r, nil)
+	})
+}
+
+// serveSD answers r with the endpoints its filters match, passed through
+// prepare when set.  Targets are encoded straight to the client, gzipped
+// when it accepts that, and unchanged targets are answered with 304 Not
+// Modified.
+func serveSD(logger *zap.Logger, d *discoverer, w http.ResponseWriter, r *http.Request, prepare func([]*Endpoint) []*Endpoint) {
+	query := r.URL.Query()
+	filter, err := parseTargetFilter(query)
+	var format outputFormat
+	if err == nil {
+		filter.shardLabel = d.label("shard")
+		format, err = lookupFormat(query.Get("format"))
+	}
+	var version int
+	if err == nil {
+		version, err = sdVersion(r)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+
+	snap, err := d.endpoints(r.Context())
+	if err != nil {
+		logger.Error("endpoints", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+
+	gz := acceptsGzip(r)
+	tag := snap.etag(r.URL.Path+"?"+query.Encode()+" "+strconv.Itoa(version), gz)
+	h := w.Header()
+	h.Set("ETag", tag)
+	h.Set("Last-Modified", snap.changed.UTC().Format(http.TimeFormat))
+	h.Set("Vary", "Accept, Accept-Encoding")
+	h.Set(sdVersionHeader, strconv.Itoa(version))
+	endpoints := filter.apply(snap.endpoints)
+	if prepare != nil {
+		endpoints = prepare(endpoints)
+	}
+	total := len(endpoints)
+	endpoints = filter.page(endpoints)
+	h.Set(totalCountHeader, strconv.Itoa(total))
+	if next := filter.offset + len(endpoints); filter.limit > 0 && next < total {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(next))
+		h.Set("Link", "<"+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+	}
+	if remaining := d.maxAge - time.Since(snap.fetched); remaining > 0 {
+		h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(remaining.Seconds())))
+	}
+	if notModified(r, tag, snap.changed) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("content-type", format.contentType)
+	// A signed body must be whole before its header is sent.
+	var body []byte
+	if len(d.signKey) > 0 {
+		var buf bytes.Buffer
+		if err := format.encode(&buf, endpoints, d.labelPrefix, r); err != nil {
+			logger.Error("encode", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = io.WriteString(w, err.Error())
+			return
+		}
+		body = buf.Bytes()
+		h.Set(signatureHeader, signBody(d.signKey, body))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	var out io.Writer = w
+	if gz {
+		h.Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	}
+	if body != nil {
+		_, err = out.Write(body)
+	} else {
+		err = format.encode(out, endpoints, d.labelPrefix, r)
+	}
+	if err != nil {
+		logger.Debug("encode", zap.Error(err))
+	}
+}
+
+// etag is a strong entity tag for the response to query.  It comes from
+// the endpoints' digest rather than the body, which is never held in
+// memory.
+func (s *snapshot) etag(query string, gz bool) string {
+	h := sha256.New()
+	h.Write(s.sum[:])
+	io.WriteString(h, query)
+	tag := hex.EncodeToString(h.Sum(nil)[:16])
+	if gz {
+		tag += "-gzip"
+	}
+	return `"` + tag + `"`
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// notModified follows RFC 9110: If-None-Match wins over
+// If-Modified-Since, and tags compare weakly.
+func notModified(r *http.Request, tag string, changed time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == tag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !changed.Truncate(time.Second).After(ims)
+	}
+	return false
+}
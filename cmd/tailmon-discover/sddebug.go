@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serviceDiscoveryPath lists every peer of every joined tailnet, like
+// Prometheus' own service discovery page: whether it became targets,
+// and if not which rule passed over it, or with the targets' final
+// labels.  It answers "why isn't my node showing up?".  The SD filters
+// apply, to show what a job's own URL would drop, and ?format=json
+// returns the same as JSON.
+const serviceDiscoveryPath = "/service-discovery"
+
+// sdCandidate is a peer and what discovery made of it.
+type sdCandidate struct {
+	Tailnet   string       `json:"tailnet,omitempty"`
+	Hostname  string       `json:"hostname"`
+	DNSName   string       `json:"dns_name"`
+	Addresses []netip.Addr `json:"addresses"`
+	Online    bool         `json:"online"`
+	Matched   bool         `json:"matched"`
+	Reason    string       `json:"reason,omitempty"`
+	Targets   []*Endpoint  `json:"targets,omitempty"`
+}
+
+var serviceDiscoveryTemplate = template.Must(template.New("sd").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tailmon-discover service discovery</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.labels { font-family: monospace; font-size: 85%; color: #555; }
+.dropped { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Service discovery</h1>
+<p>{{.Matched}} of {{len .Candidates}} peers are targets.</p>
+<table>
+<tr><th>Tailnet</th><th>Hostname</th><th>Addresses</th><th>Online</th><th>Result</th><th>Targets and labels</th></tr>
+{{range .Candidates}}
+<tr>
+<td>{{.Tailnet}}</td>
+<td>{{.Hostname}}<br><span class="labels">{{.DNSName}}</span></td>
+<td>{{range .Addresses}}{{.}}<br>{{end}}</td>
+<td>{{.Online}}</td>
+{{if .Matched}}<td>discovered</td>{{else}}<td class="dropped">{{.Reason}}</td>{{end}}
+<td>{{range .Targets}}{{range .Targets}}<b>{{.}}</b>{{end}}<div class="labels">{{range $k, $v := .Labels}}{{$k}}="{{$v}}"<br>{{end}}</div>{{end}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func newServiceDiscoveryHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseTargetFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Grouping and paging apply to targets, not peers.
+		filter.group, filter.offset, filter.limit = false, 0, 0
+		candidates, err := d.candidates(r.Context(), filter)
+		if err != nil {
+			logger.Error("candidates", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if query.Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if err := json.NewEncoder(w).Encode(candidates); err != nil {
+				logger.Debug("service discovery", zap.Error(err))
+			}
+			return
+		}
+		matched := 0
+		for _, c := range candidates {
+			if c.Matched {
+				matched++
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = serviceDiscoveryTemplate.Execute(w, struct {
+			Candidates []sdCandidate
+			Matched    int
+		}{candidates, matched})
+		if err != nil {
+			logger.Debug("service discovery", zap.Error(err))
+		}
+	})
+}
+
+// candidates explains every peer as of now, targets first.  Unlike the
+// SD response it is never cached.
+func (d *discoverer) candidates(ctx context.Context, filter *targetFilter) ([]sdCandidate, error) {
+	candidates := []sdCandidate{}
+	now := time.Now()
+	for _, via := range d.tailnets {
+		lc, err := via.srv.LocalClient()
+		if err != nil {
+			return nil, err
+		}
+		status, err := lc.Status(ctx)
+		if err != nil {
+			if len(d.tailnets) > 1 {
+				err = fmt.Errorf("tailnet %s: %w", via.name, err)
+			}
+			return nil, err
+		}
+		for _, v := range status.Peer {
+			endpoints, reason := d.peerEndpoints(status, via, v, now)
+			if len(endpoints) > 0 {
+				if endpoints = filter.apply(endpoints); len(endpoints) == 0 {
+					reason = "dropped by the query's filters"
+				}
+			}
+			candidates = append(candidates, sdCandidate{
+				Tailnet:   via.name,
+				Hostname:  v.HostName,
+				DNSName:   strings.TrimSuffix(v.DNSName, "."),
+				Addresses: v.TailscaleIPs,
+				Online:    v.Online,
+				Matched:   len(endpoints) > 0,
+				Reason:    reason,
+				Targets:   endpoints,
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Matched != b.Matched {
+			return a.Matched
+		}
+		if a.Tailnet != b.Tailnet {
+			return a.Tailnet < b.Tailnet
+		}
+		return a.Hostname < b.Hostname
+	})
+	return candidates, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/heartbeat"
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+var (
+	selfMetrics = metrics.NewRegistry()
+
+	targetsByExporter = selfMetrics.Gauge("tailmon_discover_targets",
+		"Targets currently discovered, by exporter.", "exporter")
+	refreshes = selfMetrics.Counter("tailmon_discover_refreshes_total",
+		"Times the tailnet status was fetched to find targets.", "result")
+	refreshDuration = selfMetrics.Gauge("tailmon_discover_refresh_duration_seconds",
+		"How long the last fetch of the tailnet status took.")
+	lastRefresh = selfMetrics.Gauge("tailmon_discover_last_refresh_timestamp_seconds",
+		"When targets were last found successfully.")
+	targetChanges = selfMetrics.Counter("tailmon_discover_target_changes_total",
+		"Targets added, updated or removed.", "change")
+	requests = selfMetrics.Counter("tailmon_discover_requests_total",
+		"HTTP requests served.", "path", "code")
+	requestSeconds = selfMetrics.Counter("tailmon_discover_request_duration_seconds_total",
+		"Total time spent serving HTTP requests.", "path")
+)
+
+// recordFetch updates the metrics for one fetch of the endpoints.
+func recordFetch(start time.Time, snap *snapshot, err error) {
+	refreshDuration.With().Set(time.Since(start).Seconds())
+	if err != nil {
+		refreshes.With("error").Inc()
+		return
+	}
+	refreshes.With("ok").Inc()
+	lastRefresh.With().Set(float64(snap.fetched.UnixNano()) / 1e9)
+	counts := map[string]int{}
+	for _, ep := range snap.endpoints {
+		counts[ep.exporter]++
+	}
+	targetsByExporter.Reset()
+	for exporter, n := range counts {
+		targetsByExporter.With(exporter).Set(float64(n))
+	}
+}
+
+func recordChanges(events []targetEvent) {
+	for _, ev := range events {
+		targetChanges.With(ev.kind).Inc()
+	}
+}
+
+// routes are the paths counted by name; anything else is "other", so
+// that scanners cannot grow the metrics without bound.
+var routes = []string{"/", heartbeat.Path, digestPath, eventsPath, federatePath, historyPath, scrapePath, uiPath, serviceDiscoveryPath, alertmanagersPath, "/metrics", "/scrape_configs", "/jobs"}
+
+func routeLabel(path string) string {
+	if strings.HasPrefix(path, configPath) {
+		return configPath
+	}
+	if strings.HasPrefix(path, targetsPath) {
+		return targetsPath
+	}
+	if strings.HasPrefix(path, nodesPath) {
+		return nodesPath
+	}
+	if strings.HasPrefix(path, nodePath) {
+		return nodePath
+	}
+	if strings.HasPrefix(path, "/jobs/") {
+		return "/jobs"
+	}
+	for _, r := range routes {
+		if path == r {
+			return r
+		}
+	}
+	return "other"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and deadlines.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countRequests records every request's path, status and duration.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeLabel(r.URL.Path)
+		requests.With(route, strconv.Itoa(rec.status)).Inc()
+		requestSeconds.With(route).Add(time.Since(start).Seconds())
+	})
+}
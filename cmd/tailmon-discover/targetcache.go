@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/atomicfile"
+)
+
+// targetCache keeps the last targets on disk, so that after a restart
+// they are served, labeled stale, until the tailnet is up again rather
+// than Prometheus dropping every target in the meantime.
+type targetCache struct {
+	logger *zap.Logger
+	path   string
+}
+
+// cachedTargets is the file's contents.
+type cachedTargets struct {
+	Saved         time.Time        `json:"saved"`
+	Endpoints     []cachedEndpoint `json:"endpoints"`
+	Alertmanagers []cachedEndpoint `json:"alertmanagers,omitempty"`
+}
+
+// cachedEndpoint is an Endpoint with what it keeps unexported.
+type cachedEndpoint struct {
+	IP       netip.Addr        `json:"ip"`
+	Tailnet  string            `json:"tailnet,omitempty"`
+	Node     string            `json:"node"`
+	Exporter string            `json:"exporter"`
+	Job      string            `json:"job,omitempty"`
+	Targets  []string          `json:"targets"`
+	Labels   map[string]string `json:"labels"`
+}
+
+func (c *targetCache) save(snap *snapshot) {
+	data, err := json.Marshal(cachedTargets{
+		Saved:         snap.fetched.UTC(),
+		Endpoints:     cacheEndpoints(snap.endpoints),
+		Alertmanagers: cacheEndpoints(snap.alertmanagers),
+	})
+	if err == nil {
+		err = atomicfile.WriteFile(c.path, data, 0o644)
+	}
+	if err != nil {
+		c.logger.Error("save", zap.String("path", c.path), zap.Error(err))
+	}
+}
+
+func cacheEndpoints(endpoints []*Endpoint) []cachedEndpoint {
+	out := make([]cachedEndpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		c := cachedEndpoint{IP: ep.ip, Node: ep.node, Exporter: ep.exporter, Job: ep.job, Targets: ep.Targets, Labels: ep.Labels}
+		if ep.via != nil {
+			c.Tailnet = ep.via.name
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// load reads the saved targets back, labeled stale.  Targets on a
+// tailnet no longer joined are dropped.  It returns nil if nothing was
+// saved.
+func (c *targetCache) load(d *discoverer) (*snapshot, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved cachedTargets
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	snap := &snapshot{
+		endpoints:     d.restoreEndpoints(saved.Endpoints),
+		alertmanagers: d.restoreEndpoints(saved.Alertmanagers),
+		fetched:       saved.Saved,
+		changed:       saved.Saved,
+	}
+	if snap.sum, err = endpointsSum(snap.endpoints); err != nil {
+		return nil, err
+	}
+	c.logger.Info("loaded last targets", zap.Int("targets", len(snap.endpoints)), zap.Time("saved", saved.Saved))
+	return snap, nil
+}
+
+func (d *discoverer) restoreEndpoints(cached []cachedEndpoint) []*Endpoint {
+	vias := map[string]*tailnet{}
+	for _, via := range d.tailnets {
+		vias[via.name] = via
+	}
+	out := make([]*Endpoint, 0, len(cached))
+	for _, c := range cached {
+		via, ok := vias[c.Tailnet]
+		if !ok || len(c.Targets) == 0 {
+			continue
+		}
+		ep := &Endpoint{ip: c.IP, via: via, node: c.Node, exporter: c.Exporter, job: c.Job, Targets: c.Targets, Labels: maps.Clone(c.Labels)}
+		if ep.Labels == nil {
+			ep.Labels = map[string]string{}
+		}
+		if ep.job == "" {
+			ep.job = ep.exporter
+		}
+		ep.Labels[d.label("stale")] = "true"
+		out = append(out, ep)
+	}
+	sortEndpoints(out)
+	return out
+}
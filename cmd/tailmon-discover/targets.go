@@ -0,0 +1,52 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// targetsPath serves an HTTP SD URL per exporter, like
+// /targets/node-exporter, for a job that needs no relabel_configs: only
+// that exporter's targets, without nodes whose heartbeats stopped, and
+// already labeled node, exporter and instance as /config/prometheus
+// would.  The other SD parameters still apply.
+const targetsPath = "/targets/"
+
+func newExporterTargetsHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exporter := strings.TrimPrefix(r.URL.Path, targetsPath)
+		if exporter == "" || strings.Contains(exporter, "/") {
+			http.Error(w, "want "+targetsPath+"EXPORTER", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		q.Set("exporter", exporter)
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		serveSD(logger, d, w, r, d.plainTargets)
+	})
+}
+
+// plainTargets copies the live endpoints with the labels a Prometheus
+// job would otherwise relabel them to.
+func (d *discoverer) plainTargets(endpoints []*Endpoint) []*Endpoint {
+	out := make([]*Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if ep.Labels[d.label("alive")] == "false" {
+			continue
+		}
+		plain := *ep
+		plain.Labels = maps.Clone(ep.Labels)
+		plain.Labels["exporter"] = ep.exporter
+		// Grouped endpoints have no single node.
+		if ep.node != "" {
+			plain.Labels["node"] = ep.node
+			plain.Labels["instance"] = ep.node
+		}
+		out = append(out, &plain)
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// uiPath is a page listing the targets, for a quick look without
+// opening Prometheus.  It takes the SD filters and ?q=TEXT, which
+// matches any label value.
+const uiPath = "/ui"
+
+var uiTemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tailmon-discover</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.labels { font-family: monospace; font-size: 85%; color: #555; }
+.down { color: #b00; }
+</style>
+</head>
+<body>
+<h1>tailmon-discover</h1>
+<form method="get" action="">
+<input name="q" value="{{.Query}}" placeholder="filter" autofocus>
+<button>Filter</button>
+{{len .Targets}} targets, {{.Changed}}
+</form>
+<table>
+<tr><th>Node</th><th>Exporter</th><th>Target</th><th>DNS name</th><th>Online</th><th>Healthy</th><th>Last seen</th><th>Labels</th></tr>
+{{range .Targets}}
+<tr>
+<td>{{.Node}}</td>
+<td>{{.Exporter}}</td>
+<td>{{range .Targets}}{{.}} {{end}}</td>
+<td>{{.Labels.__meta_tailscale_dns_name}}</td>
+<td{{if eq .Labels.__meta_tailscale_online "false"}} class="down"{{end}}>{{.Labels.__meta_tailscale_online}}</td>
+<td{{if eq .Healthy "false"}} class="down"{{end}}>{{.Healthy}}</td>
+<td>{{.Labels.__meta_tailscale_last_seen}}</td>
+<td class="labels">{{range $k, $v := .Labels}}{{$k}}="{{$v}}"<br>{{end}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func newUIHandler(logger *zap.Logger, d *discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseTargetFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		snap, err := d.endpoints(r.Context())
+		if err != nil {
+			logger.Error("endpoints", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		text := strings.ToLower(query.Get("q"))
+		var targets []uiTarget
+		for _, ep := range filter.apply(snap.endpoints) {
+			if text == "" || matchesText(ep, text) {
+				targets = append(targets, uiTarget{ep, ep.node, ep.exporter, ep.Labels[d.label("healthy")]})
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = uiTemplate.Execute(w, struct {
+			Query   string
+			Targets []uiTarget
+			Changed string
+		}{query.Get("q"), targets, "changed " + snap.changed.Format("2006-01-02 15:04:05 MST")})
+		if err != nil {
+			logger.Debug("ui", zap.Error(err))
+		}
+	})
+}
+
+// uiTarget is a row of the page, with what the template cannot find by
+// label name alone.
+type uiTarget struct {
+	*Endpoint
+	Node, Exporter, Healthy string
+}
+
+func matchesText(ep *Endpoint, text string) bool {
+	for _, t := range ep.Targets {
+		if strings.Contains(strings.ToLower(t), text) {
+			return true
+		}
+	}
+	for _, v := range ep.Labels {
+		if strings.Contains(strings.ToLower(v), text) {
+			return true
+		}
+	}
+	return false
+}
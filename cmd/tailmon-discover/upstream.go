@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/net/tsaddr"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// maxUpstreamSize bounds one upstream's SD response.
+const maxUpstreamSize = 64 << 20
+
+// upstreams fetches the targets of other discover instances, such as
+// ones on other tailnets or network segments, so that one SD URL covers
+// them all.  Their targets are labeled source with the upstream's name.
+// This instance cannot reach them itself, so they are left out of
+// probing, pings, /scrape and /federate.
+type upstreams struct {
+	logger   *zap.Logger
+	d        *discoverer
+	auth     *httpAuth // sent to upstreams, which share it
+	tailnet  *http.Client
+	direct   *http.Client
+	list     []upstream
+	interval time.Duration
+
+	mu      sync.Mutex
+	targets map[string][]*Endpoint // the last good fetch per upstream
+	up      map[string]bool
+}
+
+// upstream is an entry of -upstreams.
+type upstream struct {
+	name string
+	url  string
+	via  *tailnet // names the targets' source; it has no server
+}
+
+// parseUpstreams parses -upstreams, a comma separated list of NAME=URL.
+func parseUpstreams(s string) ([]upstream, error) {
+	var list []upstream
+	seen := map[string]bool{}
+	for _, field := range splitList(s) {
+		name, rawURL, ok := strings.Cut(field, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !tailnetName.MatchString(name) {
+			return nil, fmt.Errorf("%q is not NAME=URL", field)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%q is listed twice", name)
+		}
+		seen[name] = true
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q has no http or https URL", field)
+		}
+		list = append(list, upstream{name: name, url: u.String(), via: &tailnet{name: name}})
+	}
+	return list, nil
+}
+
+// onTailnet reports whether host is reached over the tailnet: a MagicDNS
+// name, short or under ts.net, or a Tailscale address.
+func onTailnet(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return tsaddr.IsTailscaleIP(ip)
+	}
+	return !strings.Contains(host, ".") || strings.HasSuffix(strings.TrimSuffix(host, "."), ".ts.net")
+}
+
+func (u *upstreams) run(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		u.fetchAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *upstreams) fetchAll(ctx context.Context) {
+	for _, up := range u.list {
+		eps, err := u.fetch(ctx, up)
+		if ctx.Err() != nil {
+			return
+		}
+		u.mu.Lock()
+		was, known := u.up[up.name]
+		u.up[up.name] = err == nil
+		if err == nil {
+			u.targets[up.name] = eps
+		}
+		u.mu.Unlock()
+		switch {
+		case err != nil && (!known || was):
+			u.logger.Warn("upstream unreachable, keeping its last targets", zap.String("upstream", up.name), zap.Error(err))
+		case err == nil && (!known || !was):
+			u.logger.Info("upstream ok", zap.String("upstream", up.name), zap.Int("targets", len(eps)))
+		}
+	}
+}
+
+func (u *upstreams) fetch(ctx context.Context, up upstream) ([]*Endpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.interval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, up.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	u.auth.authorize(req)
+	client := u.direct
+	if onTailnet(req.URL.Hostname()) {
+		client = u.tailnet
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var groups []*Endpoint
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxUpstreamSize)).Decode(&groups); err != nil {
+		return nil, err
+	}
+	eps := make([]*Endpoint, 0, len(groups))
+	for _, g := range groups {
+		if g == nil || len(g.Targets) == 0 {
+			continue
+		}
+		if g.Labels == nil {
+			g.Labels = map[string]string{}
+		}
+		// The upstream is expected to use the same -label-prefix.
+		g.via = up.via
+		g.node = g.Labels[u.d.label("node_name")]
+		g.exporter = g.Labels[u.d.label("exporter_name")]
+		g.job = g.Labels[u.d.label("job")]
+		if g.job == "" {
+			g.job = g.exporter
+		}
+		g.ip, _ = netip.ParseAddr(g.Labels["__meta_tailscale_ip"])
+		g.Labels[u.d.label("source")] = up.name
+		eps = append(eps, g)
+	}
+	return eps, nil
+}
+
+// merge adds the upstreams' targets to the local ones, which win over
+// the same node, exporter and address from an upstream, as earlier
+// upstreams win over later ones.
+func (u *upstreams) merge(local []*Endpoint) []*Endpoint {
+	if u == nil {
+		return local
+	}
+	key := func(ep *Endpoint) string {
+		return ep.node + "\x00" + ep.exporter + "\x00" + ep.Targets[0]
+	}
+	seen := make(map[string]bool, len(local))
+	for _, ep := range local {
+		seen[key(ep)] = true
+	}
+	merged := local
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, up := range u.list {
+		for _, ep := range u.targets[up.name] {
+			if !seen[key(ep)] {
+				seen[key(ep)] = true
+				merged = append(merged, ep)
+			}
+		}
+	}
+	if len(merged) > len(local) {
+		sortEndpoints(merged)
+	}
+	return merged
+}
+
+func (u *upstreams) writeUpstreamMetrics(w *metrics.Writer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	names := make([]string, 0, len(u.up))
+	for name := range u.up {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header("tailmon_discover_upstream_up", "Whether the last fetch from an upstream discover instance worked.", "gauge")
+	for _, name := range names {
+		w.Sample("tailmon_discover_upstream_up", []string{"upstream", name}, boolValue(u.up[name]))
+	}
+	w.Header("tailmon_discover_upstream_targets", "Targets last fetched from an upstream discover instance.", "gauge")
+	for _, name := range names {
+		w.Sample("tailmon_discover_upstream_targets", []string{"upstream", name}, float64(len(u.targets[name])))
+	}
+}
+
+// local reports whether discover joined tn itself, rather than it
+// naming an upstream.
+func (tn *tailnet) local() bool {
+	return tn.srv != nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tsnet"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+)
+
+// whoisNegativeTTL is how long a failed lookup is remembered, so that an
+// unknown peer retrying cannot turn every request into a local API call,
+// while a node that just joined is recognized soon.
+const whoisNegativeTTL = 5 * time.Second
+
+// whoisMaxEntries bounds the cache; past it, expired entries are dropped,
+// and if none have expired, all of them.
+const whoisMaxEntries = 4096
+
+// whoisCache remembers WhoIs answers per peer address for ttl, since
+// each heartbeat and each request under -allow asks for one.  A peer's
+// tailnet addresses do not change, so only its details can go stale.
+type whoisCache struct {
+	srv *tsnet.Server
+	ttl time.Duration // zero to always ask
+
+	mu      sync.Mutex
+	entries map[netip.Addr]whoisEntry
+	hits    int
+	misses  int
+}
+
+type whoisEntry struct {
+	who     *apitype.WhoIsResponse
+	err     error
+	expires time.Time
+}
+
+func newWhoisCache(srv *tsnet.Server, ttl time.Duration) *whoisCache {
+	return &whoisCache{srv: srv, ttl: ttl, entries: map[netip.Addr]whoisEntry{}}
+}
+
+// whois looks up the peer at remoteAddr, an IP:PORT.  Callers must not
+// modify the answer, which is shared.
+func (c *whoisCache) whois(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil || c.ttl <= 0 {
+		return c.lookup(ctx, remoteAddr)
+	}
+	addr := ap.Addr().Unmap()
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	if ok && now.Before(e.expires) {
+		c.hits++
+		c.mu.Unlock()
+		return e.who, e.err
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	who, err := c.lookup(ctx, remoteAddr)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// Says nothing about the peer.
+		return who, err
+	}
+	ttl := c.ttl
+	if err != nil {
+		ttl = min(ttl, whoisNegativeTTL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= whoisMaxEntries {
+		for a, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, a)
+			}
+		}
+		if len(c.entries) >= whoisMaxEntries {
+			c.entries = map[netip.Addr]whoisEntry{}
+		}
+	}
+	c.entries[addr] = whoisEntry{who, err, now.Add(ttl)}
+	return who, err
+}
+
+func (c *whoisCache) lookup(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	lc, err := c.srv.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.WhoIs(ctx, remoteAddr)
+}
+
+func (c *whoisCache) writeWhoisMetrics(w *metrics.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header("tailmon_discover_whois_lookups_total", "WhoIs lookups of peers, by whether they were cached.", "counter")
+	w.Sample("tailmon_discover_whois_lookups_total", []string{"result", "hit"}, float64(c.hits))
+	w.Sample("tailmon_discover_whois_lookups_total", []string{"result", "miss"}, float64(c.misses))
+	w.Header("tailmon_discover_whois_cached", "Peers whose WhoIs answer is cached, some possibly expired.", "gauge")
+	w.Sample("tailmon_discover_whois_cached", nil, float64(len(c.entries)))
+}
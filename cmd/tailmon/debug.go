@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+// captureMaxBody is the most of an upstream body kept for debugging.
+const captureMaxBody = 4 << 20
+
+// redactHeaders are request headers whose values are not shown.
+var redactHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// capturedScrape is one upstream exchange, as the exporter sent it
+// before any validation or rewriting.
+type capturedScrape struct {
+	start         time.Time
+	headerTime    time.Duration
+	bodyTime      time.Duration
+	method        string
+	url           string
+	requestHeader http.Header
+	status        string
+	header        http.Header
+	body          []byte
+	truncated     bool
+	err           error
+}
+
+// scrapeCapture keeps the most recent upstream exchange for an exporter.
+type scrapeCapture struct {
+	mu   sync.Mutex
+	last *capturedScrape
+}
+
+func (c *scrapeCapture) store(s *capturedScrape) {
+	c.mu.Lock()
+	c.last = s
+	c.mu.Unlock()
+}
+
+func (c *scrapeCapture) get() *capturedScrape {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// captureTransport records each request it makes in capture.  It
+// wraps the whole upstream transport, so only the final response
+// after retries and redirects is kept.
+type captureTransport struct {
+	base    http.RoundTripper
+	capture *scrapeCapture
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := &capturedScrape{
+		start:         time.Now(),
+		method:        req.Method,
+		url:           req.URL.String(),
+		requestHeader: req.Header.Clone(),
+	}
+	resp, err := t.base.RoundTrip(req)
+	s.headerTime = time.Since(s.start)
+	if err != nil {
+		s.err = err
+		t.capture.store(s)
+		return nil, err
+	}
+	s.status = resp.Status
+	s.header = resp.Header.Clone()
+	resp.Body = &captureBody{ReadCloser: resp.Body, scrape: s, capture: t.capture}
+	return resp, nil
+}
+
+// captureBody copies what is read and stores the capture on Close.
+type captureBody struct {
+	io.ReadCloser
+	scrape  *capturedScrape
+	capture *scrapeCapture
+	buf     bytes.Buffer
+	once    sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := captureMaxBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+		b.scrape.truncated = n > room
+	} else if n > 0 {
+		b.scrape.truncated = true
+	}
+	if err != nil && err != io.EOF {
+		b.scrape.err = err
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.scrape.bodyTime = time.Since(b.scrape.start)
+		b.scrape.body = b.buf.Bytes()
+		b.capture.store(b.scrape)
+	})
+	return err
+}
+
+// peerAllowed reports whether a tailnet peer's login name or one of
+// its node's tags is in allow.
+func peerAllowed(who *apitype.WhoIsResponse, allow []string) bool {
+	for _, a := range allow {
+		if who.UserProfile != nil && who.UserProfile.LoginName == a {
+			return true
+		}
+		if who.Node != nil {
+			for _, tag := range who.Node.Tags {
+				if tag == a {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// newLastScrapeHandler shows the most recent upstream exchange, in
+// the style of curl -v, to peers listed in allow.  Nodes serving
+// several exporters take ?exporter=NAME.
+func newLastScrapeHandler(captures map[string]*scrapeCapture, allow []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := tshttp.IdentityFrom(r)
+		if err != nil || !peerAllowed(id.WhoIs, allow) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		name := r.URL.Query().Get("exporter")
+		if name == "" && len(captures) == 1 {
+			for name = range captures {
+			}
+		}
+		capture, ok := captures[name]
+		if !ok {
+			var names []string
+			for name := range captures {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			http.Error(w, "use ?exporter= with one of: "+strings.Join(names, ", "), http.StatusNotFound)
+			return
+		}
+		s := capture.get()
+		if s == nil {
+			http.Error(w, name+": no scrapes yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(w, "* %s\n", s.start.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "> %s %s\n", s.method, s.url)
+		writeHeaders(w, "> ", s.requestHeader)
+		if s.status != "" {
+			fmt.Fprintf(w, "< %s\n", s.status)
+			writeHeaders(w, "< ", s.header)
+		}
+		fmt.Fprintf(w, "* headers after %s, body after %s\n", s.headerTime, s.bodyTime)
+		if s.err != nil {
+			fmt.Fprintf(w, "* error: %s\n", s.err)
+		}
+		if s.truncated {
+			fmt.Fprintf(w, "* body truncated to %d bytes\n", len(s.body))
+		}
+		fmt.Fprintf(w, "\n")
+
+		body := s.body
+		if s.header.Get("Content-Encoding") == "gzip" && !s.truncated {
+			if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+				if plain, err := io.ReadAll(zr); err == nil {
+					body = plain
+				}
+			}
+		}
+		_, _ = w.Write(body)
+	})
+}
+
+func writeHeaders(w io.Writer, prefix string, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			if redactHeaders[k] {
+				v = "<redacted>"
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
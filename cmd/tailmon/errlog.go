@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	stdlog "log"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errorLogWindow is how long identical proxy errors are summarized
+// rather than logged one by one.
+const errorLogWindow = time.Minute
+
+var proxyErrors = selfMetrics.Counter("tailmon_proxy_errors_total",
+	"Errors proxying to the upstream exporter, including those not logged.", "name")
+
+// errorThrottle logs the first of a run of identical errors, then a
+// single "repeated" summary at the end of the window, so that a down
+// exporter does not log the same line on every scrape.
+type errorThrottle struct {
+	logger *zap.Logger
+	name   string
+	window time.Duration
+
+	mu      sync.Mutex
+	repeats map[string]int
+}
+
+func newErrorThrottle(logger *zap.Logger, name string, window time.Duration) *errorThrottle {
+	return &errorThrottle{
+		logger:  logger,
+		name:    name,
+		window:  window,
+		repeats: make(map[string]int),
+	}
+}
+
+// Error logs err unless the same message was already logged within the window.
+func (t *errorThrottle) Error(msg string, err error) {
+	proxyErrors.With(t.name).Inc()
+	key := msg + ": " + err.Error()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.repeats[key]; ok {
+		t.repeats[key]++
+		return
+	}
+	t.repeats[key] = 0
+	t.logger.Error(msg, zap.Error(err))
+	time.AfterFunc(t.window, func() { t.flush(key, msg, err) })
+}
+
+func (t *errorThrottle) flush(key, msg string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := t.repeats[key]; n > 0 {
+		t.logger.Error(msg+" repeated", zap.Error(err), zap.Int("times", n), zap.Duration("within", t.window))
+	}
+	delete(t.repeats, key)
+}
+
+// StdLogger returns a log.Logger, for httputil.ReverseProxy.ErrorLog,
+// that goes through the throttle.
+func (t *errorThrottle) StdLogger() *stdlog.Logger {
+	return stdlog.New(throttleWriter{t}, "", 0)
+}
+
+type throttleWriter struct{ t *errorThrottle }
+
+func (w throttleWriter) Write(p []byte) (int, error) {
+	w.t.Error("proxy", errors.New(strings.TrimSpace(string(p))))
+	return len(p), nil
+}
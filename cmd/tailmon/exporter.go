@@ -1,37 +1,233 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/secret"
 )
 
 type exporter struct {
 	name     string
+	host     string
 	port     int
 	hostname string
+	path     string
+	options  url.Values
+
+	// tailnetPort is where the node serves on the tailnet.  Ports
+	// other than 80 are added to the node name for tailmon-discover.
+	tailnetPort int
+}
+
+// nodeName adds a non-default tailnet port to a node name.
+func nodeName(name string, tailnetPort int) string {
+	if tailnetPort != 0 && tailnetPort != 80 {
+		name += "/" + strconv.Itoa(tailnetPort)
+	}
+	return name
 }
 
 func (e *exporter) TailscaleNodeName() string {
-	return fmt.Sprintf("tailmon/%s/%s", e.name, e.hostname)
+	return nodeName(fmt.Sprintf("tailmon/%s/%s", e.name, e.hostname), e.tailnetPort)
+}
+
+// UpstreamURL returns the local URL that /metrics is proxied to.
+func (e *exporter) UpstreamURL() *url.URL {
+	scheme := e.options.Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(e.host, strconv.Itoa(e.port)),
+		Path:   e.path,
+	}
+}
+
+// proxyOptions returns the defaults with any per-exporter options applied.
+func (e *exporter) proxyOptions(defaults proxyOptions) (proxyOptions, error) {
+	opts := defaults
+	for key, values := range e.options {
+		value := values[len(values)-1]
+		var err error
+		switch key {
+		case "scheme":
+			if value != "http" && value != "https" {
+				err = errors.New("must be http or https")
+			}
+		case "insecure":
+			opts.Insecure, err = strconv.ParseBool(value)
+		case "redirects":
+			opts.Redirects = value
+		case "max_redirects":
+			opts.MaxRedirects, err = strconv.Atoi(value)
+		case "validate":
+			opts.Validate, err = strconv.ParseBool(value)
+		case "strip_timestamps":
+			opts.StripTimestamps, err = strconv.ParseBool(value)
+		case "retries":
+			opts.Retries, err = strconv.Atoi(value)
+		case "retry_backoff":
+			opts.RetryBackoff, err = time.ParseDuration(value)
+		case "retry_status":
+			opts.RetryStatus, err = parseStatusList(value)
+		case "header_allow":
+			opts.HeaderAllow = splitList(value)
+		case "header_strip":
+			opts.HeaderStrip = splitList(value)
+		case "forwarded_for":
+			opts.ForwardedFor, err = strconv.ParseBool(value)
+		case "max_idle_conns":
+			opts.MaxIdleConns, err = strconv.Atoi(value)
+		case "idle_timeout":
+			opts.IdleTimeout, err = time.ParseDuration(value)
+		case "h2c":
+			opts.H2C, err = strconv.ParseBool(value)
+		case "http2":
+			opts.HTTP2, err = strconv.ParseBool(value)
+		case "transform":
+			var fn transformFunc
+			if fn, err = loadTransform(value); err == nil {
+				name := e.name
+				opts.Transform = func(in io.Reader, out io.Writer) error {
+					return fn(name, in, out)
+				}
+			}
+		case "max_concurrent":
+			opts.MaxConcurrent, err = strconv.Atoi(value)
+		case "cache_max_age":
+			opts.CacheMaxAge, err = time.ParseDuration(value)
+		case "bearer":
+			var token []byte
+			if token, err = secret.Read(context.Background(), value); err == nil {
+				opts.Authorization = "Bearer " + string(token)
+			}
+		case "basic_auth":
+			var userpass []byte
+			if userpass, err = secret.Read(context.Background(), value); err == nil {
+				if !bytes.ContainsRune(userpass, ':') {
+					err = errors.New("secret must be user:password")
+				}
+				opts.Authorization = "Basic " + base64.StdEncoding.EncodeToString(userpass)
+			}
+		case "allow":
+			opts.Allow = splitList(value)
+			for _, a := range opts.Allow {
+				if !strings.HasPrefix(a, "/") {
+					err = errors.New("paths must start with /")
+				}
+			}
+		case "labels":
+			// Sent to tailmon-discover with the heartbeats.
+			_, err = parseLabels(value)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return opts, fmt.Errorf("option %q: %w", key, err)
+		}
+	}
+	return opts, opts.validate()
+}
+
+var labelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseLabels parses the labels option, a comma separated list of
+// name=value.
+func parseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, kv := range splitList(s) {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%q is not name=value", kv)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
+}
+
+// sharedNodeName returns the name of a single tailnet node serving all
+// of the exporters, like "tailmon/node-exporter,postgres-exporter/node1".
+func sharedNodeName(exporters []exporter) string {
+	var names []string
+	for _, ep := range exporters {
+		names = append(names, ep.name)
+	}
+	return nodeName(fmt.Sprintf("tailmon/%s/%s", strings.Join(names, ","), exporters[0].hostname), exporters[0].tailnetPort)
 }
 
 // newExporter takes a name like "node-exporter:9100"
 // and saves the name, port, and hostname.
+//
+// The upstream host defaults to localhost, and may be given before the
+// port, as in "node-exporter:127.0.0.1:9100" or "node-exporter:[::1]:9100".
+//
+// An upstream path and options may follow the port, as in
+// "envoy:15090/stats/prometheus" or "app:8443?scheme=https&insecure=true".
 func newExporter(value string) (exporter, error) {
 	ep := exporter{}
 
-	name, portStr, ok := strings.Cut(value, ":")
+	name, rest, ok := strings.Cut(value, ":")
 	if !ok {
-		return ep, errors.New("use name-exporter:port format")
+		return ep, errors.New("use name-exporter:[host:]port[/path][?options] format")
+	}
+	if strings.ContainsAny(name, ",/") {
+		return ep, errors.New("exporter name may not contain ',' or '/'")
+	}
+
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	options, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ep, err
+	}
+
+	hostPort, path, hasPath := strings.Cut(rest, "/")
+	path = "/" + path
+	if !hasPath {
+		path = "/metrics"
+	}
+
+	host, portStr := "localhost", hostPort
+	if strings.Contains(hostPort, ":") {
+		host, portStr, err = net.SplitHostPort(hostPort)
+		if err != nil {
+			return ep, err
+		}
 	}
 
-	port, err := strconv.ParseInt(portStr, 10, 64)
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
 		return ep, err
 	}
+	if port == 0 {
+		return ep, errors.New("upstream port must be 1-65535")
+	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -39,7 +235,10 @@ func newExporter(value string) (exporter, error) {
 	}
 
 	ep.name = name
+	ep.host = host
 	ep.port = int(port)
 	ep.hostname = hostname
+	ep.path = path
+	ep.options = options
 	return ep, nil
 }
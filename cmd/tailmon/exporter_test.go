@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExporter(t *testing.T) {
+	tests := []struct {
+		value   string
+		name    string
+		host    string
+		port    int
+		path    string
+		url     string
+		wantErr string
+	}{
+		{value: "node-exporter:9100", name: "node-exporter", host: "localhost", port: 9100, path: "/metrics", url: "http://localhost:9100/metrics"},
+		{value: "app:127.0.0.1:8080", name: "app", host: "127.0.0.1", port: 8080, path: "/metrics", url: "http://127.0.0.1:8080/metrics"},
+		{value: "app:[::1]:8080", name: "app", host: "::1", port: 8080, path: "/metrics", url: "http://[::1]:8080/metrics"},
+		{value: "app:[fe80::1%eth0]:8080/x", name: "app", host: "fe80::1%eth0", port: 8080, path: "/x", url: "http://[fe80::1%25eth0]:8080/x"},
+		{value: "envoy:15090/stats/prometheus", name: "envoy", host: "localhost", port: 15090, path: "/stats/prometheus", url: "http://localhost:15090/stats/prometheus"},
+		{value: "app:9000/", name: "app", host: "localhost", port: 9000, path: "/", url: "http://localhost:9000/"},
+		{value: "app:8443?scheme=https&insecure=true", name: "app", host: "localhost", port: 8443, path: "/metrics", url: "https://localhost:8443/metrics"},
+		{value: "app:[::1]:8443/m?scheme=https", name: "app", host: "::1", port: 8443, path: "/m", url: "https://[::1]:8443/m"},
+
+		{value: "node-exporter", wantErr: "format"},
+		{value: "a,b:9100", wantErr: "may not contain"},
+		{value: "a/b:9100", wantErr: "may not contain"},
+		{value: "app:0", wantErr: "1-65535"},
+		{value: "app:65536", wantErr: "out of range"},
+		{value: "app:http", wantErr: "invalid syntax"},
+		{value: "app:::1:8080", wantErr: "too many colons"},
+		{value: "app:9100?%zz", wantErr: "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ep, err := newExporter(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newExporter(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newExporter(%q) error = %v", tt.value, err)
+			}
+			if ep.name != tt.name || ep.host != tt.host || ep.port != tt.port || ep.path != tt.path {
+				t.Errorf("newExporter(%q) = %s %s %d %s, want %s %s %d %s", tt.value,
+					ep.name, ep.host, ep.port, ep.path, tt.name, tt.host, tt.port, tt.path)
+			}
+			if got := ep.UpstreamURL().String(); got != tt.url {
+				t.Errorf("UpstreamURL() = %s, want %s", got, tt.url)
+			}
+		})
+	}
+}
+
+func TestProxyOptions(t *testing.T) {
+	defaults := proxyOptions{Redirects: "rewrite", MaxRedirects: 5}
+	tests := []struct {
+		query   string
+		check   func(proxyOptions) bool
+		wantErr string
+	}{
+		{query: "", check: func(o proxyOptions) bool { return reflect.DeepEqual(o, defaults) }},
+		{query: "insecure=true&strip_timestamps=1", check: func(o proxyOptions) bool { return o.Insecure && o.StripTimestamps }},
+		{query: "redirects=follow&max_redirects=2", check: func(o proxyOptions) bool { return o.Redirects == "follow" && o.MaxRedirects == 2 }},
+		{query: "retries=3&retry_backoff=250ms&retry_status=502,503", check: func(o proxyOptions) bool {
+			return o.Retries == 3 && o.RetryBackoff == 250*time.Millisecond && reflect.DeepEqual(o.RetryStatus, map[int]bool{502: true, 503: true})
+		}},
+		{query: "allow=/api/,/-/healthy", check: func(o proxyOptions) bool { return reflect.DeepEqual(o.Allow, []string{"/api/", "/-/healthy"}) }},
+		{query: "header_strip=Cookie,%20X-Debug", check: func(o proxyOptions) bool { return reflect.DeepEqual(o.HeaderStrip, []string{"Cookie", "X-Debug"}) }},
+		// Repeated options take the last value.
+		{query: "max_concurrent=1&max_concurrent=4", check: func(o proxyOptions) bool { return o.MaxConcurrent == 4 }},
+		// Labels are only checked here; the heartbeat sends them.
+		{query: "labels=team=db,tier=1", check: func(o proxyOptions) bool { return reflect.DeepEqual(o, defaults) }},
+
+		{query: "scheme=ftp", wantErr: `option "scheme": must be http or https`},
+		{query: "insecure=maybe", wantErr: `option "insecure"`},
+		{query: "redirects=sometimes", wantErr: "unknown redirect mode"},
+		{query: "max_redirects=-1", wantErr: "must not be negative"},
+		{query: "allow=api", wantErr: "paths must start with /"},
+		{query: "labels=__address__=x", wantErr: `option "labels"`},
+		{query: "colour=blue", wantErr: `option "colour": unknown option`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			ep, err := newExporter("app:9100?" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := ep.proxyOptions(defaults)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("proxyOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proxyOptions() error = %v", err)
+			}
+			if !tt.check(opts) {
+				t.Errorf("proxyOptions() = %+v", opts)
+			}
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "team=db", want: map[string]string{"team": "db"}},
+		{value: "team=db, tier=1,", want: map[string]string{"team": "db", "tier": "1"}},
+		{value: "empty=", want: map[string]string{"empty": ""}},
+		{value: "team", wantErr: true},
+		{value: "1team=db", wantErr: true},
+		{value: "__address__=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLabels(tt.value)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLabels(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNodeName(t *testing.T) {
+	ep := exporter{name: "node-exporter", hostname: "web1"}
+	tests := []struct {
+		tailnetPort int
+		want        string
+	}{
+		{0, "tailmon/node-exporter/web1"},
+		{80, "tailmon/node-exporter/web1"},
+		{9100, "tailmon/node-exporter/web1/9100"},
+	}
+	for _, tt := range tests {
+		ep.tailnetPort = tt.tailnetPort
+		if got := ep.TailscaleNodeName(); got != tt.want {
+			t.Errorf("port %d: TailscaleNodeName() = %q, want %q", tt.tailnetPort, got, tt.want)
+		}
+		if got := sharedNodeName([]exporter{ep, {name: "mysqld", hostname: "web1"}}); got != strings.Replace(tt.want, "node-exporter", "node-exporter,mysqld", 1) {
+			t.Errorf("port %d: sharedNodeName() = %q", tt.tailnetPort, got)
+		}
+	}
+}
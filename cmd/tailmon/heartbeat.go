@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/heartbeat"
+	"github.com/jamessanford/tailmon/internal/version"
+)
+
+// heartbeater tells tailmon-discover that a node is alive, along with
+// its exporters and whether they are up.  It sends through the node's
+// own tailnet connection so discover can check who sent it, and gives
+// the hostname the withdrawer last set, so that a shared node does not
+// register again the exporters it withdrew.
+type heartbeater struct {
+	logger    *zap.Logger
+	sup       *supervisor
+	exporters []exporter
+	url       string
+	interval  time.Duration
+}
+
+func (h *heartbeater) run(ctx context.Context) {
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: h.sup.Dial},
+		Timeout:   h.interval,
+	}
+	url := strings.TrimSuffix(h.url, "/") + heartbeat.Path
+
+	select {
+	case <-h.sup.Ready():
+	case <-ctx.Done():
+		return
+	}
+
+	var lastErr string
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		err := h.send(ctx, client, url)
+		// Only log changes, so an unreachable discover does not
+		// log on every heartbeat.
+		switch {
+		case err != nil && err.Error() != lastErr:
+			h.logger.Warn("heartbeat failed", zap.String("url", url), zap.Error(err))
+			lastErr = err.Error()
+		case err == nil && lastErr != "":
+			h.logger.Info("heartbeat ok", zap.String("url", url))
+			lastErr = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *heartbeater) send(ctx context.Context, client *http.Client, url string) error {
+	hb := heartbeat.Heartbeat{
+		Node:      h.sup.Hostname(),
+		Port:      h.exporters[0].tailnetPort,
+		Version:   version.Version(),
+		GoVersion: runtime.Version(),
+		Interval:  h.interval,
+	}
+	for _, ep := range h.exporters {
+		err := probeUpstream(ctx, ep, h.interval/2)
+		labels, _ := parseLabels(ep.options.Get("labels"))
+		hb.Exporters = append(hb.Exporters, heartbeat.Exporter{Name: ep.name, Up: err == nil, Labels: labels})
+	}
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/heartbeat"
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+func TestHeartbeatSharedPartialWithdraw(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	a := exporter{name: "a", host: "127.0.0.1", port: up.Addr().(*net.TCPAddr).Port, hostname: "web1"}
+	b := exporter{name: "b", host: "127.0.0.1", port: down.Addr().(*net.TCPAddr).Port, hostname: "web1"}
+	sup := &supervisor{name: sharedNodeName([]exporter{a, b})}
+	w := &withdrawer{sup: sup, exporters: []exporter{a, b}, shared: true}
+	h := &heartbeater{sup: sup, exporters: []exporter{a, b}, interval: time.Second}
+
+	var got heartbeat.Heartbeat
+	discover := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer discover.Close()
+	send := func() {
+		t.Helper()
+		if err := h.send(context.Background(), discover.Client(), discover.URL+heartbeat.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// As run renames the node once b has been down for -withdraw-after.
+	srv := &tshttp.Server{}
+	sup.setServer(srv)
+	sup.setHostname(srv, w.nodeName([]exporter{a}))
+	send()
+	if got.Node != "tailmon/a/web1" {
+		t.Errorf("heartbeat node = %q, want the withdrawer's tailmon/a/web1", got.Node)
+	}
+	if len(got.Exporters) != 2 || !got.Exporters[0].Up || got.Exporters[1].Up {
+		t.Errorf("heartbeat exporters = %+v, want a up and b down", got.Exporters)
+	}
+
+	// A restarted server is back to the full name.
+	sup.setServer(&tshttp.Server{})
+	send()
+	if got.Node != "tailmon/a,b/web1" {
+		t.Errorf("after restart heartbeat node = %q, want tailmon/a,b/web1", got.Node)
+	}
+}
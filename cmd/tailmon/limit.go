@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cacheMaxBody is the largest scrape kept for serving to waiting scrapers.
+const cacheMaxBody = 32 << 20
+
+var (
+	scrapeWaits = selfMetrics.Counter("tailmon_scrape_waits_total",
+		"Scrapes that waited because the upstream already had the maximum concurrent scrapes.", "name")
+	scrapeCacheHits = selfMetrics.Counter("tailmon_scrape_cache_hits_total",
+		"Scrapes served from the last upstream response instead of waiting.", "name")
+)
+
+// cachedScrape is a complete upstream response, along with the request
+// headers that affect its encoding.
+type cachedScrape struct {
+	accept   string
+	encoding string
+	status   int
+	header   http.Header
+	body     []byte
+	at       time.Time
+}
+
+// scrapeLimiter bounds concurrent requests to a fragile exporter.
+// Requests beyond the limit are served the last response if it is
+// younger than maxAge, and otherwise wait their turn.
+type scrapeLimiter struct {
+	next   http.Handler
+	name   string
+	slots  chan struct{}
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	cached *cachedScrape
+}
+
+func newScrapeLimiter(next http.Handler, name string, limit int, maxAge time.Duration) *scrapeLimiter {
+	return &scrapeLimiter{
+		next:   next,
+		name:   name,
+		slots:  make(chan struct{}, limit),
+		maxAge: maxAge,
+	}
+}
+
+func (l *scrapeLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if l.serveCached(w, r) {
+			return
+		}
+		scrapeWaits.With(l.name).Inc()
+		select {
+		case l.slots <- struct{}{}:
+		case <-r.Context().Done():
+			http.Error(w, l.name+": too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		}
+		// Whoever held the slot may have just left a fresh response.
+		if l.serveCached(w, r) {
+			<-l.slots
+			return
+		}
+	}
+	defer func() { <-l.slots }()
+
+	if l.maxAge <= 0 {
+		l.next.ServeHTTP(w, r)
+		return
+	}
+	rec := &captureWriter{ResponseWriter: w}
+	l.next.ServeHTTP(rec, r)
+	if rec.status == http.StatusOK && !rec.overflow {
+		l.mu.Lock()
+		l.cached = &cachedScrape{
+			accept:   r.Header.Get("Accept"),
+			encoding: r.Header.Get("Accept-Encoding"),
+			status:   rec.status,
+			header:   w.Header().Clone(),
+			body:     rec.body.Bytes(),
+			at:       time.Now(),
+		}
+		l.mu.Unlock()
+	}
+}
+
+// serveCached writes the cached response if it suits the request.
+func (l *scrapeLimiter) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	if l.maxAge <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	c := l.cached
+	l.mu.Unlock()
+	if c == nil || time.Since(c.at) > l.maxAge ||
+		c.accept != r.Header.Get("Accept") || c.encoding != r.Header.Get("Accept-Encoding") {
+		return false
+	}
+
+	scrapeCacheHits.With(l.name).Inc()
+	for k, v := range c.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(c.at).Seconds())))
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+	w.WriteHeader(c.status)
+	_, _ = w.Write(c.body)
+	return true
+}
+
+// captureWriter keeps a copy of what is written, up to cacheMaxBody.
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow {
+		if c.body.Len()+len(b) > cacheMaxBody {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -7,24 +7,30 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/logtail"
 
+	"github.com/jamessanford/tailmon/internal/envflag"
 	"github.com/jamessanford/tailmon/internal/log"
+	"github.com/jamessanford/tailmon/internal/otlp"
+	"github.com/jamessanford/tailmon/internal/sdnotify"
+	"github.com/jamessanford/tailmon/internal/secret"
+	"github.com/jamessanford/tailmon/internal/trace"
 	"github.com/jamessanford/tailmon/internal/tshttp"
 )
 
 var usageMessage = `Usage:
-    tailmon -state <dir> EXPORTER:PORT [EXPORTER:PORT ...]
+    tailmon -state <dir> EXPORTER:[HOST:]PORT[/PATH][?OPTIONS] [...]
 
 Register one or more prometheus exporters on a tailscale network.  Requests to
 port 80 on the tailnet will be proxied to a prometheus exporter on localhost.
@@ -33,8 +39,31 @@ For example, to register "node-exporter" and "postgres-exporter", run:
 
     tailmon -state /var/lib/tailmon node-exporter:9100 postgres-exporter:9187
 
+The host defaults to localhost and may be an IPv6 literal in brackets, the
+path defaults to /metrics, and options follow as a query:
+
+    envoy:15090/stats/prometheus
+    node-exporter:[::1]:9100
+    app:8443?scheme=https&insecure=true
+
+Options: scheme, insecure, redirects, max_redirects, validate, strip_timestamps,
+         retries, retry_backoff, retry_status, allow, header_allow,
+         header_strip, forwarded_for, max_idle_conns, idle_timeout, h2c, http2,
+         transform, max_concurrent, cache_max_age, bearer, basic_auth, labels
+
+See what the options do, and example usage of -shared, -discover-url,
+-withdraw-after and the other flags, at https://github.com/jamessanford/tailmon/
+
+-auth-key, -state-key and the bearer and basic_auth (user:password) options
+read their secret from a file:PATH, cred:NAME for a systemd LoadCredential=,
+env:NAME, or the output of exec:COMMAND.
+
 Custom tailscale control servers may be set with TS_CONTROL_URL or --control-url
 
+Every flag may also be set from the environment, like TAILMON_STATE for -state
+or TAILMON_CONTROL_URL for -control-url.  Flags on the command line win.
+Exporters may be given in TAILMON_EXPORTERS, separated by spaces.
+
 Flags:
 `
 
@@ -44,47 +73,119 @@ func usage() {
 	os.Exit(1)
 }
 
-func NewProxyHandler(logger *zap.Logger, upstreamURL *url.URL, name string) http.Handler {
-
-	// NOTE: go1.20 introduces something new to replace Director.
-	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		// TODO: Add X-Forwarded-For header
-		originalDirector(req)
-	}
-	stdlogger, err := zap.NewStdLogAt(logger.Named("proxy"), zap.ErrorLevel)
-	if err == nil {
-		proxy.ErrorLog = stdlogger
-	}
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/metrics" {
-			logger.Info("accept", zap.String("path", r.URL.Path))
-			proxy.ServeHTTP(w, r)
-		} else {
-			logger.Info("reject", zap.String("path", r.URL.Path))
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "%s\n", name)
+// NewSharedHandler serves several exporters from one tailnet node.
+// Requests for /EXPORTER/metrics are passed to that exporter's handler
+// as /metrics.  With a single exporter, /metrics is also accepted.
+func NewSharedHandler(handlers map[string]http.Handler, name string) http.Handler {
+	mux := http.NewServeMux()
+	for epName, handler := range handlers {
+		mux.Handle("/"+epName+"/", http.StripPrefix("/"+epName, handler))
+		if len(handlers) == 1 {
+			mux.Handle("/metrics", handler)
 		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s\n", name)
 	})
+	return mux
 }
 
 func main() {
 	flagDebug := flag.Bool("debug", false, "Print debug logs")
 	flagState := flag.String("state", "", "Path to store tailnet state")
+	flagStateKey := flag.String("state-key", "", "Encrypt tailnet state with the key from `source`: file:PATH, cred:NAME, env:NAME or exec:COMMAND")
+	flagAuthKey := flag.String("auth-key", "", "Read the tailscale auth key for new nodes from `source`, like -state-key")
 	flagNoLogs := flag.Bool("no-logs-no-support", true, "Disable logtail uploading")
 	controlURL := flag.String("control-url", os.Getenv("TS_CONTROL_URL"), "URL of custom tailscale control server")
+	flagTailnetPort := flag.Int("tailnet-port", 80, "Tailnet port to serve on; other ports are added to the node name")
+	flagShared := flag.Bool("shared", false, "Serve all exporters from a single tailnet node")
+	flagRedirects := flag.String("redirects", "rewrite", "Upstream redirect handling: rewrite, follow, or pass")
+	flagMaxRedirects := flag.Int("max-redirects", 5, "Maximum same-host redirects to follow with -redirects=follow")
+	flagValidate := flag.Bool("validate", true, "Return 502 when an upstream response does not look like metrics")
+	flagOTLPEndpoint := flag.String("otlp-endpoint", "", "Also send metrics to this OTLP/HTTP collector, like http://otel-collector:4318")
+	flagOTLPInterval := flag.Duration("otlp-interval", 60*time.Second, "How often to send metrics to -otlp-endpoint")
+	flagOTLPHeaders := flag.String("otlp-headers", "", "Comma separated key=value headers to send to -otlp-endpoint")
+	flagOTLPMetrics := flag.Bool("otlp-metrics", true, "Send metrics to -otlp-endpoint")
+	flagOTLPTraces := flag.Bool("otlp-traces", false, "Send traces of proxied requests to -otlp-endpoint")
+	flagUser := flag.String("user", "", "Switch to this user once every tailnet node is running")
+	flagGroup := flag.String("group", "", "Switch to this group with -user, instead of the user's primary group")
+	flagDebugAllow := flag.String("debug-allow", "", "Comma separated login names or tags allowed to see /tailmon/debug/last-scrape")
+	flagDiscoverURL := flag.String("discover-url", "", "Send heartbeats to tailmon-discover at these comma separated URLs, like http://tailmon-discover")
+	flagHeartbeatInterval := flag.Duration("heartbeat-interval", 30*time.Second, "How often to send heartbeats to -discover-url")
+	flagTraceSample := flag.Float64("trace-sample", 1, "Fraction of new traces to record with -otlp-traces; incoming traceparent sampling is followed")
+	flagWithdrawAfter := flag.Duration("withdraw-after", 0, "Withdraw a node from discovery after its upstream is unreachable this long (0 disables)")
+	flagCheckInterval := flag.Duration("upstream-check-interval", 15*time.Second, "How often to check that upstream exporters accept connections")
+	flagRetries := flag.Int("retries", 0, "Retry upstream connection errors and -retry-status responses this many times")
+	flagRetryBackoff := flag.Duration("retry-backoff", 250*time.Millisecond, "Wait before the first retry, doubling after each attempt")
+	flagRetryStatus := flag.String("retry-status", "502,503,504", "Comma separated upstream status codes to retry")
+	flagHeaderAllow := flag.String("header-allow", "", "Comma separated request headers to pass upstream, dropping all others")
+	flagHeaderStrip := flag.String("header-strip", "", "Comma separated request headers to remove before passing upstream")
+	flagForwardedFor := flag.Bool("forwarded-for", true, "Send the scraper's tailnet address upstream in X-Forwarded-For")
+	flagMaxIdleConns := flag.Int("upstream-max-idle-conns", 4, "Keep-alive connections to keep open to each upstream")
+	flagIdleTimeout := flag.Duration("upstream-idle-timeout", 90*time.Second, "Close idle upstream connections after this long")
+	flagMaxConcurrent := flag.Int("upstream-max-concurrent", 2, "Most simultaneous scrapes of each upstream, 0 for no limit")
+	flagCacheMaxAge := flag.Duration("upstream-cache-max-age", 0, "Give scrapes over -upstream-max-concurrent the last response if younger than this, instead of waiting")
+	flagHTTP2 := flag.Bool("upstream-http2", true, "Allow HTTP/2 with https upstreams")
+	flagDrainTimeout := flag.Duration("drain-timeout", 15*time.Second, "On shutdown, wait this long for in-flight scrapes to finish")
+	flagStripTimestamps := flag.String("strip-timestamps", "", "Comma separated exporter names to strip sample timestamps from")
 	flag.Usage = usage
+	if err := envflag.Apply(flag.CommandLine, "TAILMON_"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 	flag.Parse()
 
+	retryStatus, err := parseStatusList(*flagRetryStatus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-retry-status: %s\n", err)
+		os.Exit(1)
+	}
+
+	proxyOpts := proxyOptions{
+		Redirects:     *flagRedirects,
+		MaxRedirects:  *flagMaxRedirects,
+		Validate:      *flagValidate,
+		Retries:       *flagRetries,
+		RetryBackoff:  *flagRetryBackoff,
+		RetryStatus:   retryStatus,
+		HeaderAllow:   splitList(*flagHeaderAllow),
+		HeaderStrip:   splitList(*flagHeaderStrip),
+		ForwardedFor:  *flagForwardedFor,
+		MaxIdleConns:  *flagMaxIdleConns,
+		IdleTimeout:   *flagIdleTimeout,
+		MaxConcurrent: *flagMaxConcurrent,
+		CacheMaxAge:   *flagCacheMaxAge,
+		HTTP2:         *flagHTTP2,
+	}
+	if err := proxyOpts.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	stripTimestamps := make(map[string]bool)
+	for _, name := range splitList(*flagStripTimestamps) {
+		stripTimestamps[name] = true
+	}
+
 	var exporters []exporter
-	for _, epStr := range flag.Args() {
+	exporterOpts := make(map[string]proxyOptions)
+	args := flag.Args()
+	if len(args) == 0 {
+		args = strings.Fields(os.Getenv("TAILMON_EXPORTERS"))
+	}
+	for _, epStr := range args {
 		ep, err := newExporter(epStr)
+		if err == nil {
+			opts := proxyOpts
+			opts.StripTimestamps = stripTimestamps[ep.name]
+			exporterOpts[ep.name], err = ep.proxyOptions(opts)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %s\n", epStr, err)
 			os.Exit(1)
 		}
+		ep.tailnetPort = *flagTailnetPort
 		exporters = append(exporters, ep)
 	}
 
@@ -93,6 +194,21 @@ func main() {
 		flag.Usage()
 	}
 
+	if *flagOTLPTraces && *flagOTLPEndpoint == "" {
+		fmt.Fprintf(os.Stderr, "-otlp-traces requires -otlp-endpoint\n")
+		os.Exit(1)
+	}
+
+	if *flagDiscoverURL != "" && *flagHeartbeatInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "-heartbeat-interval must be positive\n")
+		os.Exit(1)
+	}
+
+	if *flagTailnetPort < 1 || *flagTailnetPort > 65535 {
+		fmt.Fprintf(os.Stderr, "-tailnet-port must be between 1 and 65535\n")
+		os.Exit(1)
+	}
+
 	if len(exporters) == 0 {
 		flag.CommandLine.Output().Write([]byte("ERROR: Must specify one or more exporters to announce.\n\n"))
 		flag.Usage()
@@ -103,48 +219,195 @@ func main() {
 		envknob.SetNoLogsNoSupport() // NOTE: This may not do anything?
 	}
 
+	var stateKey []byte
+	if *flagStateKey != "" {
+		stateKey, err = secret.Read(context.Background(), *flagStateKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-state-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var authKey []byte
+	if *flagAuthKey != "" {
+		authKey, err = secret.Read(context.Background(), *flagAuthKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-auth-key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var uid, gid int
+	if *flagUser != "" {
+		err = canDropPrivileges()
+		if err == nil {
+			uid, gid, err = lookupIDs(*flagUser, *flagGroup)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-user: %s\n", err)
+			os.Exit(1)
+		}
+	} else if *flagGroup != "" {
+		fmt.Fprintf(os.Stderr, "-group requires -user\n")
+		os.Exit(1)
+	}
+
 	rootLogger := log.MustZapLogger(*flagDebug)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var srvs []*tshttp.Server
+	var srvs []*supervisor
+
+	var otlpClient *otlp.Client
+	if *flagOTLPEndpoint != "" {
+		headers := make(map[string]string)
+		for _, kv := range strings.Split(*flagOTLPHeaders, ",") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		// The collector is reached through the first node's tailnet.
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return srvs[0].Dial(ctx, network, addr)
+		}
+		otlpClient = &otlp.Client{
+			Endpoint:   *flagOTLPEndpoint,
+			Headers:    headers,
+			HTTPClient: &http.Client{Transport: &http.Transport{DialContext: dial}},
+		}
+	}
+
+	var tracer *trace.Tracer
+	if *flagOTLPTraces && otlpClient != nil {
+		hostname, _ := os.Hostname()
+		tracer = trace.NewTracer(otlpClient, map[string]string{
+			"service.name": "tailmon",
+			"host.name":    hostname,
+		}, otlp.Scope{Name: "tailmon"}, *flagTraceSample)
+		go runTraceExporter(ctx, rootLogger.Named("trace"), tracer)
+	}
+
+	debugAllow := splitList(*flagDebugAllow)
+	captures := make(map[string]*scrapeCapture)
+
+	startServer := func(logger *zap.Logger, name string, handler http.Handler, eps []exporter) {
+		var sup *supervisor
+		whois := func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			return sup.WhoIs(ctx, addr)
+		}
+		var lastScrape http.Handler
+		if len(debugAllow) > 0 {
+			nodeCaptures := make(map[string]*scrapeCapture)
+			for _, ep := range eps {
+				nodeCaptures[ep.name] = captures[ep.name]
+			}
+			lastScrape = newLastScrapeHandler(nodeCaptures, debugAllow)
+		}
+		handler = withSelfHandlers(handler, newAbout(name, eps, *flagShared), lastScrape)
+		middlewares := []tshttp.Middleware{tshttp.Recover(logger.Named("http")), tshttp.Identify(whois)}
+		if tracer != nil {
+			middlewares = append(middlewares, func(h http.Handler) http.Handler {
+				return traceHandler(tracer, name, h)
+			})
+		}
+		sup = newSupervisor(logger, name, handler, func() *tshttp.Server {
+			return &tshttp.Server{
+				Logger:          logger,
+				Name:            name,
+				ControlURL:      *controlURL,
+				StateDir:        *flagState,
+				StateKey:        stateKey,
+				AuthKey:         string(authKey),
+				Debug:           *flagDebug,
+				Port:            *flagTailnetPort,
+				ShutdownTimeout: *flagDrainTimeout,
+				Middlewares:     middlewares,
+			}
+		})
+		go sup.run(ctx)
+		srvs = append(srvs, sup)
+
+		for _, url := range splitList(*flagDiscoverURL) {
+			h := &heartbeater{
+				logger:    logger.Named("heartbeat"),
+				sup:       sup,
+				exporters: eps,
+				url:       url,
+				interval:  *flagHeartbeatInterval,
+			}
+			go h.run(ctx)
+		}
 
+		if *flagWithdrawAfter > 0 {
+			w := &withdrawer{
+				logger:    logger.Named("withdraw"),
+				sup:       sup,
+				exporters: eps,
+				shared:    *flagShared,
+				interval:  *flagCheckInterval,
+				after:     *flagWithdrawAfter,
+			}
+			go w.run(ctx)
+		}
+	}
+
+	handlers := make(map[string]http.Handler)
 	for _, ep := range exporters {
 		logger := rootLogger.With(zap.String("name", ep.name))
 
-		upstreamURL, err := url.Parse(fmt.Sprintf("http://%s:%d", "localhost", ep.port))
-		if err != nil {
-			logger.Fatal("unable to parse", zap.Error(err))
+		opts := exporterOpts[ep.name]
+		if *flagShared {
+			opts.Mount = "/" + ep.name
 		}
-		srv := &tshttp.Server{
-			Logger:     logger,
-			Name:       ep.TailscaleNodeName(),
-			ControlURL: *controlURL,
-			StateDir:   *flagState,
-			Debug:      *flagDebug,
+		if len(debugAllow) > 0 {
+			opts.Capture = &scrapeCapture{}
+			captures[ep.name] = opts.Capture
 		}
-		handler := NewProxyHandler(logger, upstreamURL, ep.TailscaleNodeName())
-		if err := srv.Start(handler); err != nil {
-			logger.Fatal("unable to initialize", zap.Error(err))
+		handler := NewProxyHandler(logger, ep.UpstreamURL(), ep.TailscaleNodeName(), opts)
+		if *flagShared {
+			if _, ok := handlers[ep.name]; ok {
+				logger.Fatal("duplicate exporter name")
+			}
+			handlers[ep.name] = handler
+			continue
 		}
-		srvs = append(srvs, srv)
+		startServer(logger, ep.TailscaleNodeName(), handler, []exporter{ep})
 	}
 
+	if *flagShared {
+		name := sharedNodeName(exporters)
+		startServer(rootLogger.With(zap.String("name", name)), name, NewSharedHandler(handlers, name), exporters)
+	}
+
+	if otlpClient != nil && *flagOTLPMetrics {
+		o := &otlpExporter{
+			logger:    rootLogger.Named("otlp"),
+			client:    otlpClient,
+			interval:  *flagOTLPInterval,
+			exporters: exporters,
+			opts:      exporterOpts,
+		}
+		go o.run(ctx)
+	}
+
+	if *flagUser != "" {
+		go dropWhenReady(ctx, rootLogger.Named("privdrop"), srvs, *flagState, uid, gid)
+	}
+
+	go notifySystemd(ctx, rootLogger.Named("systemd"), srvs)
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	select {
 	case <-sigs:
 	case <-ctx.Done():
 	}
+	_ = sdnotify.Notify(sdnotify.Stopping)
 
-	var wg sync.WaitGroup
+	// Each supervisor shuts down its own server once cancelled.
+	cancel()
 	for _, srv := range srvs {
-		wg.Add(1)
-		go func(srv *tshttp.Server) {
-			srv.Shutdown()
-			wg.Done()
-		}(srv)
+		srv.Wait()
 	}
-	wg.Wait()
 }
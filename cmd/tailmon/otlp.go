@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+	"github.com/jamessanford/tailmon/internal/otlp"
+)
+
+// otlpExporter periodically scrapes the local exporters and sends the
+// results to an OpenTelemetry collector, usually over the tailnet.
+type otlpExporter struct {
+	logger    *zap.Logger
+	client    *otlp.Client
+	interval  time.Duration
+	exporters []exporter
+	opts      map[string]proxyOptions
+	start     time.Time
+	clients   map[string]*http.Client
+}
+
+func (o *otlpExporter) run(ctx context.Context) {
+	o.start = time.Now()
+	o.clients = make(map[string]*http.Client)
+	for _, ep := range o.exporters {
+		o.clients[ep.name] = &http.Client{Transport: newUpstreamTransport(o.opts[ep.name])}
+	}
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := o.export(ctx); err != nil {
+			o.logger.Error("otlp export", zap.Error(err))
+		}
+	}
+}
+
+func (o *otlpExporter) export(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, o.interval)
+	defer cancel()
+
+	req := &otlp.MetricsRequest{}
+	for _, ep := range o.exporters {
+		families, err := o.scrape(ctx, ep)
+		if err != nil {
+			o.logger.Error("otlp scrape", zap.String("name", ep.name), zap.Error(err))
+			continue
+		}
+		resource := map[string]string{
+			"service.name":        ep.name,
+			"service.instance.id": ep.TailscaleNodeName(),
+			"host.name":           ep.hostname,
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics,
+			otlp.ResourceMetricsFromFamilies(resource, otlp.Scope{Name: "tailmon"}, families, o.start, time.Now()))
+	}
+	if len(req.ResourceMetrics) == 0 {
+		return nil
+	}
+	return o.client.ExportMetrics(ctx, req)
+}
+
+func (o *otlpExporter) scrape(ctx context.Context, ep exporter) ([]*exposition.Family, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.UpstreamURL().String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	// Send the exporter's credentials and headers as a proxied scrape would.
+	filterHeaders(req.Header, o.opts[ep.name])
+	resp, err := o.clients[ep.name].Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return exposition.Parse(resp.Body)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOTLPScrapeHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("up 1\n"))
+	}))
+	defer upstream.Close()
+
+	ep, err := newExporter("app:" + strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &otlpExporter{
+		exporters: []exporter{ep},
+		opts:      map[string]proxyOptions{"app": {Authorization: "Bearer s3cret", HeaderStrip: []string{"Accept"}}},
+		clients:   map[string]*http.Client{"app": upstream.Client()},
+	}
+	families, err := o.scrape(context.Background(), ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].Name != "up" {
+		t.Errorf("scrape = %+v", families)
+	}
+	if auth := got.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("Authorization = %q, want the bearer credentials", auth)
+	}
+	if accept := got.Get("Accept"); accept != "" {
+		t.Errorf("Accept = %q, want it stripped by header_strip", accept)
+	}
+}
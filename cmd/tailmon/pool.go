@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// proxyBuffers is shared by every proxy in the process, so copying many
+// large expositions does not allocate a new buffer per request.
+var proxyBuffers = newBufferPool(32 * 1024)
+
+// bufferPool implements httputil.BufferPool.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size}
+}
+
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) < p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
+
+var peekReaders = sync.Pool{
+	New: func() any { return bufio.NewReaderSize(nil, peekSize) },
+}
+
+// pooledBody is a response body read through a pooled bufio.Reader,
+// which is returned to the pool on Close.
+type pooledBody struct {
+	*bufio.Reader
+	body io.ReadCloser
+}
+
+func newPooledBody(body io.ReadCloser) *pooledBody {
+	br := peekReaders.Get().(*bufio.Reader)
+	br.Reset(body)
+	return &pooledBody{Reader: br, body: body}
+}
+
+func (b *pooledBody) Close() error {
+	err := b.body.Close()
+	if b.Reader != nil {
+		b.Reader.Reset(nil)
+		peekReaders.Put(b.Reader)
+		b.Reader = nil
+	}
+	return err
+}
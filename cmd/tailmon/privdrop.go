@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// lookupIDs finds the uid and gid to run as.  The group defaults to
+// the user's primary group.
+func lookupIDs(username, group string) (uid, gid int, err error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("user %s: %w", username, err)
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, fmt.Errorf("group %s: %w", gidStr, err)
+	}
+	return uid, gid, nil
+}
+
+// dropWhenReady switches to uid and gid once every node is running.
+// The state dir is handed to the new user first, so nodes can still
+// be restarted afterwards.  Failing to drop privileges is fatal.
+func dropWhenReady(ctx context.Context, logger *zap.Logger, srvs []*supervisor, stateDir string, uid, gid int) {
+	for _, srv := range srvs {
+		select {
+		case <-srv.Ready():
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := chownTree(stateDir, uid, gid); err != nil {
+		logger.Fatal("chown state dir", zap.Error(err))
+	}
+	if err := dropPrivileges(uid, gid); err != nil {
+		logger.Fatal("drop privileges", zap.Error(err))
+	}
+	logger.Info("dropped privileges", zap.Int("uid", uid), zap.Int("gid", gid))
+}
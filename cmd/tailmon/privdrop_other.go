@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+var errNoPrivDrop = errors.New("-user is not supported on this platform")
+
+func canDropPrivileges() error {
+	return errNoPrivDrop
+}
+
+func chownTree(dir string, uid, gid int) error {
+	return errNoPrivDrop
+}
+
+func dropPrivileges(uid, gid int) error {
+	return errNoPrivDrop
+}
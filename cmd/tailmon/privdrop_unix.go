@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// canDropPrivileges reports whether -user can work here.
+func canDropPrivileges() error {
+	if os.Geteuid() != 0 {
+		return errors.New("-user requires starting as root")
+	}
+	return nil
+}
+
+func chownTree(dir string, uid, gid int) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// dropPrivileges changes every thread to uid and gid, with gid as the
+// only supplementary group, so none of root's groups are kept.
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	if os.Geteuid() != uid || os.Getegid() != gid {
+		return errors.New("still running with the old ids")
+	}
+	return nil
+}
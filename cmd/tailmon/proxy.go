@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+)
+
+// proxyOptions control how requests are passed to an exporter.
+type proxyOptions struct {
+	// Redirects is one of "rewrite", "follow", or "pass".
+	//   rewrite: Location headers pointing at the upstream are made relative
+	//            to the node, as the path it serves them at
+	//   follow:  same-host redirects are followed, up to MaxRedirects
+	//   pass:    responses are returned untouched
+	Redirects    string
+	MaxRedirects int
+
+	// Insecure skips certificate verification for https upstreams.
+	Insecure bool
+
+	// Validate rejects upstream responses that are not metrics,
+	// such as HTML error pages, with a 502.
+	Validate bool
+
+	// StripTimestamps removes explicit sample timestamps from the body.
+	StripTimestamps bool
+
+	// Transform, if set, rewrites the body of each scrape.  It is
+	// loaded from a Go plugin with the transform option.
+	Transform func(in io.Reader, out io.Writer) error
+
+	// Retries is how many times to retry connection errors and
+	// RetryStatus responses, waiting RetryBackoff and doubling it
+	// between attempts.
+	Retries      int
+	RetryBackoff time.Duration
+	RetryStatus  map[int]bool
+
+	// Allow lists other request paths to pass through to the upstream
+	// unchanged, for exposing a whole service such as Alertmanager.
+	// Entries ending in "/" match as prefixes.
+	Allow []string
+
+	// HeaderAllow, when set, is the only request headers passed upstream.
+	// HeaderStrip headers are always removed.  Hop-by-hop headers are
+	// left for httputil.ReverseProxy to handle.
+	HeaderAllow []string
+	HeaderStrip []string
+
+	// ForwardedFor adds the scraper's tailnet address as X-Forwarded-For.
+	ForwardedFor bool
+
+	// Authorization, if set, replaces the Authorization header sent
+	// upstream.  It is read from a secret with the bearer or basic_auth
+	// option.
+	Authorization string
+
+	// MaxIdleConns and IdleTimeout size the keep-alive pool to the
+	// upstream.  H2C speaks cleartext HTTP/2 to http upstreams, and
+	// HTTP2 allows negotiating HTTP/2 with https upstreams.
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	H2C          bool
+	HTTP2        bool
+
+	// MaxConcurrent limits simultaneous scrapes of the upstream, zero
+	// for no limit.  Scrapes over the limit wait, or are given the last
+	// response if it is younger than CacheMaxAge.
+	MaxConcurrent int
+	CacheMaxAge   time.Duration
+
+	// Capture, if set, keeps the last upstream exchange for debugging.
+	Capture *scrapeCapture
+
+	// Mount is the path the tailnet node serves the exporter under,
+	// "/EXPORTER" with -shared, for rewriting redirects.
+	Mount string
+}
+
+// readCloser replaces a response body while keeping the original Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (o proxyOptions) validate() error {
+	switch o.Redirects {
+	case "rewrite", "follow", "pass":
+	default:
+		return fmt.Errorf("unknown redirect mode %q", o.Redirects)
+	}
+	if o.MaxRedirects < 0 {
+		return errors.New("max redirects must not be negative")
+	}
+	if o.Retries < 0 || o.RetryBackoff < 0 {
+		return errors.New("retries and retry backoff must not be negative")
+	}
+	if o.MaxIdleConns < 0 || o.IdleTimeout < 0 {
+		return errors.New("max idle conns and idle timeout must not be negative")
+	}
+	if o.MaxConcurrent < 0 || o.CacheMaxAge < 0 {
+		return errors.New("max concurrent and cache max age must not be negative")
+	}
+	return nil
+}
+
+// NewProxyHandler returns a handler that passes /metrics to upstreamURL,
+// which includes the upstream path, like "http://localhost:9100/metrics".
+func NewProxyHandler(logger *zap.Logger, upstreamURL *url.URL, name string, opts proxyOptions) http.Handler {
+
+	// NOTE: go1.20 introduces something new to replace Director.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: upstreamURL.Scheme, Host: upstreamURL.Host})
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		filterHeaders(req.Header, opts)
+		req.URL.Path = upstreamURL.Path
+		req.URL.RawPath = upstreamURL.RawPath
+		if opts.StripTimestamps || opts.Transform != nil {
+			// The body is rewritten, so ask for uncompressed text.
+			req.Header.Del("Accept-Encoding")
+			if strings.Contains(req.Header.Get("Accept"), "protobuf") {
+				req.Header.Set("Accept", "text/plain;version=0.0.4")
+			}
+		}
+	}
+	proxy.BufferPool = proxyBuffers
+	errlog := newErrorThrottle(logger.Named("proxy"), name, errorLogWindow)
+	proxy.ErrorLog = errlog.StdLogger()
+
+	var transport http.RoundTripper = &traceTransport{base: newUpstreamTransport(opts)}
+	if opts.Retries > 0 {
+		transport = &retryTransport{
+			base:    transport,
+			retries: opts.Retries,
+			backoff: opts.RetryBackoff,
+			status:  opts.RetryStatus,
+		}
+	}
+	proxy.Transport = transport
+
+	var modifiers []func(*http.Response) error
+	rewriteLocation := locationRewriter(upstreamURL, opts)
+
+	switch opts.Redirects {
+	case "follow":
+		proxy.Transport = &redirectTransport{
+			base:    transport,
+			maxHops: opts.MaxRedirects,
+		}
+		modifiers = append(modifiers, rewriteLocation)
+	case "rewrite":
+		modifiers = append(modifiers, rewriteLocation)
+	}
+
+	if opts.Capture != nil {
+		proxy.Transport = &captureTransport{base: proxy.Transport, capture: opts.Capture}
+	}
+
+	if opts.Validate {
+		modifiers = append(modifiers, validateResponse)
+	}
+	if opts.StripTimestamps {
+		modifiers = append(modifiers, stripTimestamps)
+	}
+	if opts.Transform != nil {
+		modifiers = append(modifiers, transformBody(opts.Transform))
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
+		errlog.Error("proxy", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "%s: %s\n", name, err)
+	}
+	proxy.ErrorHandler = errorHandler
+
+	// Allowed service paths are passed through as they are, without
+	// any of the metrics specific handling.
+	var service *httputil.ReverseProxy
+	if len(opts.Allow) > 0 {
+		service = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: upstreamURL.Scheme, Host: upstreamURL.Host})
+		service.BufferPool = proxyBuffers
+		service.ErrorLog = proxy.ErrorLog
+		service.ErrorHandler = errorHandler
+		service.Transport = transport
+		serviceDirector := service.Director
+		service.Director = func(req *http.Request) {
+			serviceDirector(req)
+			filterHeaders(req.Header, opts)
+		}
+		if opts.Redirects != "pass" {
+			service.ModifyResponse = rewriteLocation
+		}
+	}
+
+	var metrics http.Handler = proxy
+	if opts.MaxConcurrent > 0 {
+		metrics = newScrapeLimiter(proxy, name, opts.MaxConcurrent, opts.CacheMaxAge)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			logger.Info("accept", zap.String("path", r.URL.Path))
+			metrics.ServeHTTP(w, r)
+		} else if service != nil && pathAllowed(opts.Allow, r.URL.Path) {
+			logger.Info("accept", zap.String("path", r.URL.Path), zap.String("method", r.Method))
+			service.ServeHTTP(w, r)
+		} else {
+			logger.Info("reject", zap.String("path", r.URL.Path))
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "%s\n", name)
+		}
+	})
+}
+
+// hopByHop headers are removed or handled by httputil.ReverseProxy.
+var hopByHop = map[string]bool{
+	"Connection":          true,
+	"Proxy-Connection":    true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// filterHeaders applies the header allow and strip lists to a request,
+// then adds any upstream credentials.
+func filterHeaders(h http.Header, opts proxyOptions) {
+	if len(opts.HeaderAllow) > 0 {
+		allowed := make(map[string]bool)
+		for _, name := range opts.HeaderAllow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range h {
+			if !allowed[name] && !hopByHop[name] {
+				delete(h, name)
+			}
+		}
+	}
+	for _, name := range opts.HeaderStrip {
+		h.Del(name)
+	}
+	if opts.Authorization != "" {
+		h.Set("Authorization", opts.Authorization)
+	}
+	if !opts.ForwardedFor {
+		// A nil value stops ReverseProxy from adding the header.
+		h["X-Forwarded-For"] = nil
+	}
+}
+
+// pathAllowed matches a cleaned request path against an allow list.
+func pathAllowed(allow []string, p string) bool {
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != p {
+		return false
+	}
+	for _, a := range allow {
+		if p == a || (strings.HasSuffix(a, "/") && strings.HasPrefix(p, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newUpstreamTransport returns the transport used to reach an exporter.
+func newUpstreamTransport(opts proxyOptions) http.RoundTripper {
+	if opts.H2C {
+		var d net.Dialer
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: opts.IdleTimeout,
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	transport.ForceAttemptHTTP2 = opts.HTTP2
+	if !opts.HTTP2 {
+		// A non-nil empty map disables HTTP/2 negotiation.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	}
+	if opts.IdleTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleTimeout
+	}
+	return transport
+}
+
+// stripTimestamps rewrites a text exposition body without sample timestamps.
+func stripTimestamps(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || exposition.IsProtobuf(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	resp.Body = readCloser{
+		Reader: exposition.NewLineReader(resp.Body, exposition.StripTimestamp),
+		Closer: resp.Body,
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// locationRewriter returns a response modifier that turns a redirect to
+// the upstream host into the relative path the tailnet node serves it
+// at, so the scraper follows it back through the node: with an upstream
+// of "http://localhost:9100/stats", a redirect to
+// "http://localhost:9100/stats?x=1" becomes "/metrics?x=1", or
+// "/EXPORTER/metrics?x=1" with -shared.  Allowed paths keep theirs under
+// the mount.  Redirects to other hosts, or to paths the node does not
+// serve, are left alone.
+func locationRewriter(upstream *url.URL, opts proxyOptions) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if !isRedirect(resp.StatusCode) {
+			return nil
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			return nil
+		}
+		if loc.Host != resp.Request.URL.Host {
+			return nil
+		}
+		var p string
+		switch {
+		case loc.Path == upstream.Path:
+			p = "/metrics"
+		case pathAllowed(opts.Allow, loc.Path):
+			p = loc.Path
+		default:
+			return nil
+		}
+		rel := &url.URL{Path: opts.Mount + p, RawQuery: loc.RawQuery}
+		resp.Header.Set("Location", rel.String())
+		return nil
+	}
+}
+
+// redirectTransport follows same-host redirects from the upstream
+// exporter instead of returning them to the scraper.
+type redirectTransport struct {
+	base    http.RoundTripper
+	maxHops int
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for hops := 0; ; hops++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !isRedirect(resp.StatusCode) {
+			return resp, err
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return resp, nil
+		}
+		loc, err := resp.Location()
+		if err != nil || loc.Host != req.URL.Host {
+			return resp, nil
+		}
+		if hops >= t.maxHops {
+			resp.Body.Close()
+			return nil, fmt.Errorf("stopped after %d redirects", t.maxHops)
+		}
+		// Drain a little so the connection can be reused.
+		_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+		resp.Body.Close()
+
+		next := req.Clone(req.Context())
+		next.URL = loc
+		next.Host = ""
+		req = next
+	}
+}
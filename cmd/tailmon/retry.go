@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryTransport retries idempotent upstream requests that fail with a
+// connection error or a retriable status, so an exporter restarting
+// within the scrape timeout does not fail the scrape.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+	status  map[int]bool
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+	deadline := scrapeDeadline(req)
+	backoff := t.backoff
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.retries || !t.retriable(req.Context(), resp, err) {
+			return resp, err
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (t *retryTransport) retriable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled)
+	}
+	return t.status[resp.StatusCode]
+}
+
+// scrapeDeadline uses the timeout Prometheus sends with each scrape,
+// leaving a little room to return the final response.
+func scrapeDeadline(req *http.Request) time.Time {
+	seconds, err := strconv.ParseFloat(req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds * 0.9 * float64(time.Second)))
+}
+
+// parseStatusList parses comma separated status codes like "502,503,504".
+func parseStatusList(s string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, field := range splitList(s) {
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
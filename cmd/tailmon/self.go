@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/version"
+)
+
+// selfPrefix is reserved on every node for tailmon's own endpoints.
+const selfPrefix = "/tailmon/"
+
+var startTime = time.Now()
+
+// about describes a node for people looking at it with a browser.
+type about struct {
+	Node      string          `json:"node"`
+	Version   string          `json:"version"`
+	GoVersion string          `json:"go_version"`
+	Started   time.Time       `json:"started"`
+	Exporters []aboutExporter `json:"exporters"`
+}
+
+type aboutExporter struct {
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Upstream string            `json:"upstream"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+func newAbout(node string, eps []exporter, shared bool) about {
+	a := about{
+		Node:      node,
+		Version:   version.Version(),
+		GoVersion: runtime.Version(),
+		Started:   startTime,
+	}
+	for _, ep := range eps {
+		ae := aboutExporter{
+			Name:     ep.name,
+			Path:     "/metrics",
+			Upstream: ep.UpstreamURL().String(),
+		}
+		if shared {
+			ae.Path = "/" + ep.name + "/metrics"
+		}
+		for k, v := range ep.options {
+			if ae.Options == nil {
+				ae.Options = make(map[string]string)
+			}
+			ae.Options[k] = v[len(v)-1]
+		}
+		a.Exporters = append(a.Exporters, ae)
+	}
+	return a
+}
+
+// withSelfHandlers serves tailmon's own endpoints under selfPrefix,
+// passing every other request to handler.  lastScrape may be nil.
+func withSelfHandlers(handler http.Handler, info about, lastScrape http.Handler) http.Handler {
+	aboutJSON, _ := json.MarshalIndent(info, "", "    ")
+	aboutJSON = append(aboutJSON, '\n')
+
+	mux := http.NewServeMux()
+	mux.Handle(selfPrefix+"metrics", selfMetrics)
+	mux.HandleFunc(selfPrefix+"about", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(aboutJSON)
+	})
+	if lastScrape != nil {
+		mux.Handle(selfPrefix+"debug/last-scrape", lastScrape)
+	}
+	mux.Handle("/", handler)
+	return mux
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale/apitype"
+
+	"github.com/jamessanford/tailmon/internal/metrics"
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+const (
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+)
+
+var (
+	selfMetrics = metrics.NewRegistry()
+
+	serverUp = selfMetrics.Gauge("tailmon_server_up",
+		"Whether the tailnet server for a node is serving.", "node")
+	inflightRequests = selfMetrics.Gauge("tailmon_inflight_requests",
+		"Number of requests currently being served by a node.", "node")
+	serverRestarts = selfMetrics.Counter("tailmon_server_restarts_total",
+		"Number of times the tailnet server for a node was restarted after a failure.", "node")
+)
+
+// supervisor runs a tshttp.Server for one node, restarting it
+// with backoff when it fails, without affecting the other nodes.
+type supervisor struct {
+	logger    *zap.Logger
+	name      string
+	newServer func() *tshttp.Server
+	handler   http.Handler
+
+	mu        sync.Mutex
+	srv       *tshttp.Server
+	hostname  string         // set by SetHostname on renamedSrv
+	renamed   *tshttp.Server // so a restarted server has its name again
+	ready     chan struct{}
+	readyOnce sync.Once
+	stopped   chan struct{}
+}
+
+func newSupervisor(logger *zap.Logger, name string, handler http.Handler, newServer func() *tshttp.Server) *supervisor {
+	s := &supervisor{
+		logger:    logger,
+		name:      name,
+		newServer: newServer,
+		handler:   handler,
+		ready:     make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	inflight := inflightRequests.With(name)
+	selfMetrics.OnScrape(func() {
+		if srv := s.server(); srv != nil {
+			inflight.Set(float64(srv.InFlight()))
+		}
+	})
+	return s
+}
+
+// run keeps a server running until ctx is cancelled, then shuts it down.
+func (s *supervisor) run(ctx context.Context) {
+	defer close(s.stopped)
+	up := serverUp.With(s.name)
+	restarts := serverRestarts.With(s.name)
+	backoff := minRestartBackoff
+
+	for {
+		srv := s.newServer()
+		err := srv.StartContext(ctx, s.handler)
+		if err == nil {
+			s.setServer(srv)
+			up.Set(1)
+			started := time.Now()
+			go func() {
+				select {
+				case <-srv.Ready():
+					s.readyOnce.Do(func() { close(s.ready) })
+				case <-srv.Done():
+				}
+			}()
+
+			select {
+			case <-srv.Done():
+				err = srv.Err()
+			case <-ctx.Done():
+				srv.Shutdown()
+				up.Set(0)
+				return
+			}
+			up.Set(0)
+			if time.Since(started) > maxRestartBackoff {
+				backoff = minRestartBackoff
+			}
+		}
+		if err == nil {
+			err = errors.New("stopped serving")
+		}
+
+		s.logger.Error("server failed, restarting", zap.Error(err), zap.Duration("backoff", backoff))
+		srv.Shutdown()
+		restarts.Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, maxRestartBackoff)
+	}
+}
+
+func (s *supervisor) setServer(srv *tshttp.Server) {
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+}
+
+func (s *supervisor) server() *tshttp.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srv
+}
+
+// Hostname is the running server's hostname: name, unless SetHostname
+// has renamed it.
+func (s *supervisor) Hostname() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv != nil && s.srv == s.renamed {
+		return s.hostname
+	}
+	return s.name
+}
+
+// SetHostname renames the running server.  A restarted server comes
+// back with the original name.
+func (s *supervisor) SetHostname(ctx context.Context, hostname string) error {
+	srv := s.server()
+	if srv == nil {
+		return errors.New(s.name + ": not started")
+	}
+	if err := srv.SetHostname(ctx, hostname); err != nil {
+		return err
+	}
+	s.setHostname(srv, hostname)
+	return nil
+}
+
+func (s *supervisor) setHostname(srv *tshttp.Server, hostname string) {
+	s.mu.Lock()
+	s.hostname, s.renamed = hostname, srv
+	s.mu.Unlock()
+}
+
+// Ready returns a channel closed once the node's tailnet first runs.
+func (s *supervisor) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *supervisor) Healthy(ctx context.Context) error {
+	srv := s.server()
+	if srv == nil {
+		return errors.New(s.name + ": not started")
+	}
+	return srv.Healthy(ctx)
+}
+
+// Dial connects through whichever server is currently running.
+func (s *supervisor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	srv := s.server()
+	if srv == nil {
+		return nil, errors.New(s.name + ": not started")
+	}
+	return srv.Tailnet().Dial(ctx, network, addr)
+}
+
+// Wait returns once run has shut down the server after its
+// context was cancelled.
+func (s *supervisor) Wait() {
+	<-s.stopped
+}
+
+// WhoIs looks up a tailnet peer through whichever server is currently running.
+func (s *supervisor) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	srv := s.server()
+	if srv == nil {
+		return nil, errors.New(s.name + ": not started")
+	}
+	lc, err := srv.Tailnet().LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.WhoIs(ctx, remoteAddr)
+}
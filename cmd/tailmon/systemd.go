@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/sdnotify"
+)
+
+// notifySystemd tells systemd we are ready once every tailnet is running,
+// then sends watchdog pings for as long as they all stay healthy.
+func notifySystemd(ctx context.Context, logger *zap.Logger, srvs []*supervisor) {
+	for _, srv := range srvs {
+		select {
+		case <-srv.Ready():
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := sdnotify.Notify(sdnotify.Ready + "\n" + sdnotify.Status("tailnet running")); err != nil {
+		logger.Error("sd_notify", zap.Error(err))
+	}
+
+	interval := sdnotify.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := healthy(ctx, srvs, interval/4); err != nil {
+			// Skip the ping, systemd restarts us if this persists.
+			logger.Error("unhealthy", zap.Error(err))
+			_ = sdnotify.Notify(sdnotify.Status(err.Error()))
+			continue
+		}
+		if err := sdnotify.Notify(sdnotify.Watchdog); err != nil {
+			logger.Error("sd_notify", zap.Error(err))
+		}
+	}
+}
+
+func healthy(ctx context.Context, srvs []*supervisor, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, srv := range srvs {
+		if err := srv.Healthy(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jamessanford/tailmon/internal/trace"
+	"github.com/jamessanford/tailmon/internal/tshttp"
+)
+
+// traceFlushInterval is how often finished spans are sent to the collector.
+const traceFlushInterval = 5 * time.Second
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// traceHandler records a server span for every request to a node,
+// continuing any trace context sent by the scraper, with a child span
+// for looking up who the tailnet peer is, through tshttp.Identify.
+func traceHandler(tracer *trace.Tracer, node string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(trace.Extract(r.Context(), r.Header), "accept", trace.Server)
+		defer span.End()
+		span.SetAttribute("tailmon.node", node)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("net.peer.addr", r.RemoteAddr)
+
+		if span.Context().Sampled {
+			wctx, wspan := trace.Start(ctx, "whois", trace.Internal)
+			id, err := tshttp.IdentityFrom(r.WithContext(wctx))
+			wspan.SetError(err)
+			if err == nil {
+				span.SetAttribute("tailscale.peer.node", id.WhoIs.Node.Name)
+				if id.LoginName != "" {
+					span.SetAttribute("tailscale.peer.user", id.LoginName)
+				}
+			}
+			wspan.End()
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+	})
+}
+
+// traceTransport records a client span for each upstream request and
+// passes the trace context on to the exporter.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := trace.Start(req.Context(), "upstream", trace.Client)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+
+	req = req.Clone(ctx)
+	trace.Inject(ctx, req.Header)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	return resp, nil
+}
+
+// runTraceExporter flushes finished spans until ctx is done.
+func runTraceExporter(ctx context.Context, logger *zap.Logger, tracer *trace.Tracer) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fctx, cancel := context.WithTimeout(ctx, traceFlushInterval)
+		dropped, err := tracer.Flush(fctx)
+		cancel()
+		if err != nil {
+			logger.Error("export", zap.Error(err))
+		}
+		if dropped > 0 {
+			logger.Warn("dropped spans", zap.Int("count", dropped))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"plugin"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+)
+
+// transformFunc is the signature a transform plugin must export as
+// "Transform".  It is called once per scrape with the exporter name,
+// reads the upstream text exposition from in, and writes what the
+// scraper should see to out.
+type transformFunc = func(exporter string, in io.Reader, out io.Writer) error
+
+// loadTransform opens a Go plugin built with "go build -buildmode=plugin"
+// and returns its Transform function.  The plugin must be built with
+// the same Go version and dependencies as tailmon.
+func loadTransform(path string) (transformFunc, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Transform")
+	if err != nil {
+		return nil, err
+	}
+	switch fn := sym.(type) {
+	case transformFunc:
+		return fn, nil
+	case *transformFunc:
+		return *fn, nil
+	}
+	return nil, fmt.Errorf("%s: Transform is %T, want func(string, io.Reader, io.Writer) error", path, sym)
+}
+
+// transformBody returns a response modifier that streams the body of
+// text exposition responses through transform.  An error from the
+// transform ends the response early, so the scrape fails rather than
+// returning partial metrics as if they were complete.
+func transformBody(transform func(io.Reader, io.Writer) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK || exposition.IsProtobuf(resp.Header.Get("Content-Type")) {
+			return nil
+		}
+		upstream := resp.Body
+		pr, pw := io.Pipe()
+		go func() {
+			err := transform(upstream, pw)
+			upstream.Close()
+			pw.CloseWithError(err)
+		}()
+		resp.Body = pr
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+}
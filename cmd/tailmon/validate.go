@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+)
+
+// peekSize is how much of an upstream body is examined by validateResponse.
+const peekSize = 4096
+
+// validateResponse checks that a successful upstream response looks like
+// a metrics exposition, so that HTML error pages and similar garbage get
+// a clear 502 rather than a parse error inside Prometheus.
+func validateResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if err := exposition.CheckContentType(contentType); err != nil {
+		return fmt.Errorf("upstream response is not metrics: %w", err)
+	}
+	if exposition.IsProtobuf(contentType) {
+		return nil
+	}
+
+	body := newPooledBody(resp.Body)
+	resp.Body = body
+	data, err := body.Peek(peekSize)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return fmt.Errorf("reading upstream response: %w", err)
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		data = gunzipPrefix(data)
+	}
+
+	if err := exposition.CheckPrefix(truncateLine(data)); err != nil {
+		return fmt.Errorf("upstream response is not metrics (content type %q): %w", contentType, err)
+	}
+	return nil
+}
+
+// truncateLine drops a trailing partial line, unless it is the only line.
+func truncateLine(data []byte) []byte {
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		return data[:i+1]
+	}
+	return data
+}
+
+// gunzipPrefix decompresses as much of a gzip prefix as possible.
+func gunzipPrefix(data []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	out, _ := io.ReadAll(io.LimitReader(zr, peekSize))
+	return out
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	upstreamUp = selfMetrics.Gauge("tailmon_upstream_up",
+		"Whether the upstream exporter accepted a connection at the last check.", "name")
+	nodeWithdrawn = selfMetrics.Gauge("tailmon_node_withdrawn",
+		"Whether the node is withdrawn from discovery because its upstream is down.", "node")
+)
+
+// withdrawer renames a node out of the "tailmon/" namespace when its
+// upstream exporters have been unreachable for too long, so that
+// tailmon-discover stops emitting a target that can only fail.
+// Shared nodes drop just the unreachable exporters from their name.
+type withdrawer struct {
+	logger    *zap.Logger
+	sup       *supervisor
+	exporters []exporter
+	shared    bool
+	interval  time.Duration
+	after     time.Duration
+}
+
+func (w *withdrawer) run(ctx context.Context) {
+	downSince := make(map[string]time.Time)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var healthy []exporter
+		for _, ep := range w.exporters {
+			if err := probeUpstream(ctx, ep, w.interval); err != nil {
+				if downSince[ep.name].IsZero() {
+					w.logger.Info("upstream down", zap.String("name", ep.name), zap.Error(err))
+					downSince[ep.name] = time.Now()
+				}
+				upstreamUp.With(ep.name).Set(0)
+			} else {
+				if !downSince[ep.name].IsZero() {
+					w.logger.Info("upstream up", zap.String("name", ep.name))
+				}
+				delete(downSince, ep.name)
+				upstreamUp.With(ep.name).Set(1)
+			}
+			if since := downSince[ep.name]; since.IsZero() || time.Since(since) < w.after {
+				healthy = append(healthy, ep)
+			}
+		}
+
+		if w.sup.server() == nil {
+			continue
+		}
+		want := w.nodeName(healthy)
+		if want == w.sup.Hostname() {
+			continue
+		}
+		if err := w.sup.SetHostname(ctx, want); err != nil {
+			w.logger.Error("SetHostname", zap.String("hostname", want), zap.Error(err))
+			continue
+		}
+		w.logger.Info("renamed node", zap.String("hostname", want))
+		if len(healthy) == 0 {
+			nodeWithdrawn.With(w.sup.name).Set(1)
+		} else {
+			nodeWithdrawn.With(w.sup.name).Set(0)
+		}
+	}
+}
+
+// nodeName is the hostname to present with only the healthy exporters.
+func (w *withdrawer) nodeName(healthy []exporter) string {
+	if len(healthy) == 0 {
+		return "tailmon-withdrawn/" + strings.TrimPrefix(w.sup.name, "tailmon/")
+	}
+	if w.shared {
+		return sharedNodeName(healthy)
+	}
+	return healthy[0].TailscaleNodeName()
+}
+
+// probeUpstream checks that the exporter accepts connections.
+func probeUpstream(ctx context.Context, ep exporter, timeout time.Duration) error {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ep.host, strconv.Itoa(ep.port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
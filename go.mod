@@ -4,6 +4,7 @@ go 1.21
 
 require (
 	go.uber.org/zap v1.24.0
+	golang.org/x/net v0.10.0
 	tailscale.com v1.48.2
 )
 
@@ -67,7 +68,6 @@ require (
 	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090 // indirect
 	golang.org/x/mod v0.11.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/term v0.10.0 // indirect
@@ -0,0 +1,32 @@
+// Package envflag sets command line flags from environment variables.
+package envflag
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Name returns the environment variable for a flag,
+// like TAILMON_CONTROL_URL for "control-url".
+func Name(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// Apply sets every flag in fs that has a matching environment variable.
+// Call it before fs.Parse so that the command line takes precedence.
+func Apply(fs *flag.FlagSet, prefix string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := Name(prefix, f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,154 @@
+// Package exposition has small helpers for the Prometheus text and
+// OpenMetrics exposition formats.  It is not a full parser.
+package exposition
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// CheckContentType returns an error if the media type is not one that
+// Prometheus can ingest.  An empty content type is accepted.
+func CheckContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	switch mediaType {
+	case "text/plain", "application/openmetrics-text", "application/vnd.google.protobuf":
+		return nil
+	}
+	return fmt.Errorf("unexpected content type %q", contentType)
+}
+
+// IsProtobuf reports whether contentType is the protobuf exposition format.
+func IsProtobuf(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/vnd.google.protobuf"
+}
+
+// CheckPrefix does a cheap check of the start of a text exposition.
+// Only the first sample or comment line is examined, so data may be
+// truncated anywhere after it.
+func CheckPrefix(data []byte) error {
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+		if line[0] == '<' {
+			return fmt.Errorf("looks like HTML or XML: %s", Snippet(line))
+		}
+		name := MetricName(line)
+		if name == "" {
+			return fmt.Errorf("invalid metric name: %s", Snippet(line))
+		}
+		rest := line[len(name):]
+		if len(rest) > 0 && rest[0] != '{' && rest[0] != ' ' && rest[0] != '\t' {
+			return fmt.Errorf("invalid sample line: %s", Snippet(line))
+		}
+		return nil
+	}
+	return nil
+}
+
+// MetricName returns the metric name at the start of a sample line,
+// or "" if the line does not start with a valid name.
+func MetricName(line []byte) string {
+	for i, c := range line {
+		switch {
+		case c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return string(line[:i])
+		}
+	}
+	return string(line)
+}
+
+// Snippet returns a short printable excerpt of data for error messages.
+func Snippet(data []byte) string {
+	const max = 120
+	s := string(data)
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '.'
+		}
+		return r
+	}, s)
+}
+
+// StripTimestamp removes the explicit timestamp from a sample line,
+// keeping any trailing exemplar and newline.  The line is modified in
+// place.  Other lines are returned unchanged.
+func StripTimestamp(line []byte) []byte {
+	if len(line) == 0 || line[0] == '#' {
+		return line
+	}
+	name := MetricName(line)
+	if name == "" {
+		return line
+	}
+	i := len(name)
+	if i < len(line) && line[i] == '{' {
+		if i = skipLabels(line, i); i < 0 {
+			return line
+		}
+	}
+	valueStart := skipSpace(line, i)
+	valueEnd := skipToken(line, valueStart)
+	if valueEnd == valueStart {
+		return line
+	}
+	tsStart := skipSpace(line, valueEnd)
+	tsEnd := skipToken(line, tsStart)
+	if tsEnd == tsStart || line[tsStart] == '#' {
+		return line
+	}
+	n := copy(line[valueEnd:], line[tsEnd:])
+	return line[:valueEnd+n]
+}
+
+// skipLabels returns the index just past the label set starting at
+// line[i] == '{', or -1 if it is not terminated.
+func skipLabels(line []byte, i int) int {
+	quoted := false
+	for i++; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '}':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func skipSpace(line []byte, i int) int {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func skipToken(line []byte, i int) int {
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\n' && line[i] != '\r' {
+		i++
+	}
+	return i
+}
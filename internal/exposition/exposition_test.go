@@ -0,0 +1,173 @@
+package exposition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		ok          bool
+	}{
+		{"", true},
+		{"text/plain; version=0.0.4; charset=utf-8", true},
+		{"application/openmetrics-text; version=1.0.0", true},
+		{"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily", true},
+		{"text/html; charset=utf-8", false},
+		{"application/json", false},
+		{"text/plain; =", false},
+	}
+	for _, tt := range tests {
+		err := CheckContentType(tt.contentType)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckContentType(%q) = %v, want ok %v", tt.contentType, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"empty", "", true},
+		{"sample", "up 1\n", true},
+		{"labels", `up{job="x"} 1`, true},
+		{"comments first", "# HELP up Up.\n# TYPE up gauge\n\nup 1\n", true},
+		{"truncated after first sample", "up 1\nhttp_requests_total{code=\"2", true},
+		{"html", "<!DOCTYPE html>\n<html>", false},
+		{"html after comment", "# hi\n  <html>", false},
+		{"bad name", "1up 1\n", false},
+		{"bad separator", "up=1\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPrefix([]byte(tt.data))
+			if (err == nil) != tt.ok {
+				t.Errorf("CheckPrefix(%q) = %v, want ok %v", tt.data, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []*Family
+		wantErr string
+	}{
+		{
+			name:  "untyped",
+			input: "up 1\n",
+			want:  []*Family{{Name: "up", Type: "untyped", Samples: []Sample{{Name: "up", Value: 1}}}},
+		},
+		{
+			name: "counter with help and timestamp",
+			input: `# HELP http_requests_total Requests,\nby code.
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a \"b\""} 3 1700000000000
+`,
+			want: []*Family{{
+				Name: "http_requests_total",
+				Help: "Requests,\nby code.",
+				Type: "counter",
+				Samples: []Sample{{
+					Name:      "http_requests_total",
+					Labels:    []Label{{"code", "200"}, {"path", `/a "b"`}},
+					Value:     3,
+					Timestamp: 1700000000000,
+				}},
+			}},
+		},
+		{
+			name: "openmetrics counter without _total",
+			input: `# TYPE requests counter
+requests_total 2
+`,
+			want: []*Family{{Name: "requests", Type: "counter", Samples: []Sample{{Name: "requests_total", Value: 2}}}},
+		},
+		{
+			name: "histogram",
+			input: `# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 0.7
+latency_count 2
+`,
+			want: []*Family{{Name: "latency", Type: "histogram", Samples: []Sample{
+				{Name: "latency_bucket", Labels: []Label{{"le", "0.5"}}, Value: 1},
+				{Name: "latency_bucket", Labels: []Label{{"le", "+Inf"}}, Value: 2},
+				{Name: "latency_sum", Value: 0.7},
+				{Name: "latency_count", Value: 2},
+			}}},
+		},
+		{
+			name: "suffix of a gauge is its own family",
+			input: `# TYPE temp gauge
+temp_count 1
+`,
+			want: []*Family{
+				{Name: "temp", Type: "gauge"},
+				{Name: "temp_count", Type: "untyped", Samples: []Sample{{Name: "temp_count", Value: 1}}},
+			},
+		},
+		{name: "missing value", input: "up\n", wantErr: "line 1: missing value"},
+		{name: "bad value", input: "\nup x\n", wantErr: "line 2: invalid value"},
+		{name: "bad timestamp", input: "up 1 now\n", wantErr: "invalid timestamp"},
+		{name: "unterminated label", input: `up{job="x} 1`, wantErr: "unterminated value"},
+		{name: "unquoted label", input: `up{job=x} 1`, wantErr: "missing quote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() =\n%+v\nwant\n%+v", deref(got), deref(tt.want))
+			}
+		})
+	}
+}
+
+func deref(families []*Family) []Family {
+	out := make([]Family, len(families))
+	for i, f := range families {
+		out[i] = *f
+	}
+	return out
+}
+
+func TestStripTimestamp(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"up 1 1700000000000\n", "up 1\n"},
+		{"up 1\n", "up 1\n"},
+		{"up 1", "up 1"},
+		{"up\t1\t17\r\n", "up\t1\r\n"},
+		{`up{job="a b",q="}"} 1 17` + "\n", `up{job="a b",q="}"} 1` + "\n"},
+		{`up{job="\"} 1 2"} 1 17` + "\n", `up{job="\"} 1 2"} 1` + "\n"},
+		{`requests_total 3 17 # {trace_id="x"} 1 16` + "\n", `requests_total 3 # {trace_id="x"} 1 16` + "\n"},
+		{`requests_total 3 # {trace_id="x"} 1 16` + "\n", `requests_total 3 # {trace_id="x"} 1 16` + "\n"},
+		{"# TYPE up gauge 1 2\n", "# TYPE up gauge 1 2\n"},
+		{`up{job="x 1 2` + "\n", `up{job="x 1 2` + "\n"},
+		{"\n", "\n"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := string(StripTimestamp([]byte(tt.line))); got != tt.want {
+			t.Errorf("StripTimestamp(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package exposition
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Label is a single label name and value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one sample line.  Timestamp is in milliseconds and is zero
+// when the line did not have one.
+type Sample struct {
+	Name      string
+	Labels    []Label
+	Value     float64
+	Timestamp int64
+}
+
+// Family is a group of samples sharing a metric name from the # TYPE line.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string // counter, gauge, histogram, summary, or untyped
+	Samples []Sample
+}
+
+// Parse reads a Prometheus text format exposition.
+func Parse(r io.Reader) ([]*Family, error) {
+	var families []*Family
+	byName := make(map[string]*Family)
+
+	family := func(name string) *Family {
+		f, ok := byName[name]
+		if !ok {
+			f = &Family{Name: name, Type: "untyped"}
+			byName[name] = f
+			families = append(families, f)
+		}
+		return f
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "HELP":
+				if len(fields) == 4 {
+					family(fields[2]).Help = unescape(fields[3], false)
+				}
+			case "TYPE":
+				if len(fields) == 4 {
+					family(fields[2]).Type = fields[3]
+				}
+			}
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		f := family(familyName(byName, s.Name))
+		f.Samples = append(f.Samples, s)
+	}
+	return families, scanner.Err()
+}
+
+// familyName finds the family a sample belongs to, allowing for the
+// _bucket, _sum, and _count suffixes of histograms and summaries, and
+// the _total suffix of counters.
+func familyName(byName map[string]*Family, name string) string {
+	if _, ok := byName[name]; ok {
+		return name
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total"} {
+		base, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		if f, ok := byName[base]; ok {
+			switch {
+			case suffix == "_total" && f.Type == "counter":
+				return base
+			case suffix != "_total" && (f.Type == "histogram" || f.Type == "summary"):
+				return base
+			}
+		}
+	}
+	return name
+}
+
+func parseSample(line string) (Sample, error) {
+	var s Sample
+	s.Name = MetricName([]byte(line))
+	if s.Name == "" {
+		return s, errors.New("invalid metric name")
+	}
+	rest := line[len(s.Name):]
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		s.Labels, rest, err = parseLabels(rest[1:])
+		if err != nil {
+			return s, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, errors.New("missing value")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value: %w", err)
+	}
+	s.Value = value
+	if len(fields) > 1 {
+		s.Timestamp, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid timestamp: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// parseLabels parses label pairs after the opening brace and returns
+// the remainder of the line after the closing brace.
+func parseLabels(s string) ([]Label, string, error) {
+	var labels []Label
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, "", errors.New("invalid label")
+		}
+		name = strings.TrimSpace(name)
+		rest = strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, "", fmt.Errorf("label %q: missing quote", name)
+		}
+		end := -1
+		for i := 1; i < len(rest); i++ {
+			if rest[i] == '\\' {
+				i++
+			} else if rest[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, "", fmt.Errorf("label %q: unterminated value", name)
+		}
+		labels = append(labels, Label{Name: name, Value: unescape(rest[1:end], true)})
+		s = rest[end+1:]
+	}
+}
+
+// unescape handles the escapes allowed in help text and label values.
+func unescape(s string, quotes bool) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; {
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == '\\':
+			b.WriteByte('\\')
+		case c == '"' && quotes:
+			b.WriteByte('"')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
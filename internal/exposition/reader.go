@@ -0,0 +1,63 @@
+package exposition
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+var bufioReaders = sync.Pool{
+	New: func() any { return bufio.NewReaderSize(nil, 16*1024) },
+}
+
+// lineReader applies a function to each line read from a reader.
+type lineReader struct {
+	br   *bufio.Reader
+	fn   func(line []byte) []byte
+	long []byte // accumulates lines longer than the bufio.Reader
+	buf  []byte
+	err  error
+}
+
+// NewLineReader returns a reader that passes each line of r, including
+// its newline, through fn.  The line passed to fn is only valid until
+// the next call, and fn may modify it in place.
+func NewLineReader(r io.Reader, fn func(line []byte) []byte) io.Reader {
+	br := bufioReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &lineReader{br: br, fn: fn}
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	for len(l.buf) == 0 {
+		if l.err != nil {
+			l.release()
+			return 0, l.err
+		}
+		line, err := l.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			l.long = append(l.long, line...)
+			continue
+		}
+		l.err = err
+		if len(l.long) > 0 {
+			line = append(l.long, line...)
+			l.long = l.long[:0]
+		}
+		if len(line) > 0 {
+			l.buf = l.fn(line)
+		}
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+func (l *lineReader) release() {
+	if l.br != nil {
+		l.br.Reset(nil)
+		bufioReaders.Put(l.br)
+		l.br = nil
+	}
+}
@@ -0,0 +1,45 @@
+package exposition
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLineReader(t *testing.T) {
+	long := "big " + strings.Repeat("x", 40*1024) + " 17\n"
+	tests := []struct {
+		name, input, want string
+	}{
+		{"empty", "", ""},
+		{"lines", "# TYPE up gauge\nup 1 17\nup 2\n", "# TYPE up gauge\nup 1\nup 2\n"},
+		{"no final newline", "up 1\nup 2 17", "up 1\nup 2"},
+		{"longer than the buffer", long + "up 1 17\n", strings.TrimSuffix(long, " 17\n") + "\nup 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte at a time, so a line is returned over many reads.
+			r := iotest.OneByteReader(NewLineReader(strings.NewReader(tt.input), StripTimestamp))
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineReaderError(t *testing.T) {
+	r := NewLineReader(io.MultiReader(strings.NewReader("up 1 17\n"), iotest.ErrReader(io.ErrUnexpectedEOF)), StripTimestamp)
+	got, err := io.ReadAll(r)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if !bytes.Equal(got, []byte("up 1\n")) {
+		t.Errorf("got %q before the error", got)
+	}
+}
@@ -0,0 +1,34 @@
+// Package heartbeat defines what tailmon periodically sends to
+// tailmon-discover about each of its nodes.
+package heartbeat
+
+import "time"
+
+// Path is where tailmon-discover accepts heartbeats.
+const Path = "/heartbeat"
+
+// MaxSize bounds an encoded heartbeat.
+const MaxSize = 64 << 10
+
+type Heartbeat struct {
+	// Node is the tailnet hostname of the sending node.
+	Node string `json:"node"`
+	// Port is the tailnet port the node serves HTTP on.  Every exporter
+	// is served there, at /metrics or, with -shared, /NAME/metrics.
+	Port      int        `json:"port,omitempty"`
+	Version   string     `json:"version"`
+	GoVersion string     `json:"go_version"`
+	Exporters []Exporter `json:"exporters"`
+	// Interval is how often heartbeats are sent, so the receiver can
+	// tell when one is missed.
+	Interval time.Duration `json:"interval"`
+}
+
+type Exporter struct {
+	Name string `json:"name"`
+	// Up is whether the upstream exporter accepted a connection.
+	Up bool `json:"up"`
+	// Labels are added to the exporter's targets.  Names starting with
+	// "__" are reserved and ignored.
+	Labels map[string]string `json:"labels,omitempty"`
+}
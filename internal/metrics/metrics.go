@@ -0,0 +1,241 @@
+// Package metrics is a minimal Prometheus text format registry for
+// tailmon's own metrics.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families and writes them in the text format.
+type Registry struct {
+	mu         sync.Mutex
+	vecs       []*Vec
+	hooks      []func()
+	collectors []func(w *Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a new counter family.
+func (r *Registry) Counter(name, help string, labelNames ...string) *Vec {
+	return r.register(name, help, "counter", labelNames)
+}
+
+// Gauge registers a new gauge family.
+func (r *Registry) Gauge(name, help string, labelNames ...string) *Vec {
+	return r.register(name, help, "gauge", labelNames)
+}
+
+func (r *Registry) register(name, help, typ string, labelNames []string) *Vec {
+	v := &Vec{name: name, help: help, typ: typ, labelNames: labelNames, values: make(map[string]*Value)}
+	r.mu.Lock()
+	r.vecs = append(r.vecs, v)
+	r.mu.Unlock()
+	return v
+}
+
+// OnScrape registers a function to run before metrics are written,
+// for example to update a gauge from current state.
+func (r *Registry) OnScrape(fn func()) {
+	r.mu.Lock()
+	r.hooks = append(r.hooks, fn)
+	r.mu.Unlock()
+}
+
+// Collect registers a function that writes metrics computed at scrape time.
+func (r *Registry) Collect(fn func(w *Writer)) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, fn)
+	r.mu.Unlock()
+}
+
+// WriteTo writes every registered metric.
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.mu.Lock()
+	hooks := make([]func(), len(r.hooks))
+	copy(hooks, r.hooks)
+	vecs := append([]*Vec(nil), r.vecs...)
+	collectors := make([]func(*Writer), len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+
+	w := NewWriter(out)
+	for _, v := range vecs {
+		v.write(w)
+	}
+	for _, fn := range collectors {
+		fn(w)
+	}
+	return w.n, w.Flush()
+}
+
+// ServeHTTP serves the registry in the text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// Vec is a metric family with zero or more labels.
+type Vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*Value
+}
+
+// Value is a single series.  It is safe for concurrent use.
+type Value struct {
+	labelValues []string
+	mu          sync.Mutex
+	v           float64
+}
+
+// With returns the series for the label values, creating it if needed.
+func (v *Vec) With(labelValues ...string) *Value {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	val, ok := v.values[key]
+	if !ok {
+		val = &Value{labelValues: labelValues}
+		v.values[key] = val
+	}
+	return val
+}
+
+// Delete removes the series for the label values.
+func (v *Vec) Delete(labelValues ...string) {
+	v.mu.Lock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+	v.mu.Unlock()
+}
+
+// Reset removes every series.
+func (v *Vec) Reset() {
+	v.mu.Lock()
+	v.values = make(map[string]*Value)
+	v.mu.Unlock()
+}
+
+func (v *Vec) write(w *Writer) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]*Value, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, v.values[k])
+	}
+	v.mu.Unlock()
+
+	w.Header(v.name, v.help, v.typ)
+	for _, val := range values {
+		w.Sample(v.name, Labels(v.labelNames, val.labelValues), val.Get())
+	}
+}
+
+func (val *Value) Add(f float64) {
+	val.mu.Lock()
+	val.v += f
+	val.mu.Unlock()
+}
+
+func (val *Value) Inc() {
+	val.Add(1)
+}
+
+func (val *Value) Set(f float64) {
+	val.mu.Lock()
+	val.v = f
+	val.mu.Unlock()
+}
+
+func (val *Value) Get() float64 {
+	val.mu.Lock()
+	defer val.mu.Unlock()
+	return val.v
+}
+
+// Labels pairs label names with values, as used by Writer.Sample.
+func Labels(names, values []string) []string {
+	pairs := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name, value)
+	}
+	return pairs
+}
+
+// Writer writes metric families in the Prometheus text format.
+type Writer struct {
+	*bufio.Writer
+	n int64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Writer: bufio.NewWriter(w)}
+}
+
+// Header writes the HELP and TYPE lines for a family.
+func (w *Writer) Header(name, help, typ string) {
+	w.write("# HELP ", name, " ", strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help), "\n")
+	w.write("# TYPE ", name, " ", typ, "\n")
+}
+
+// Sample writes one sample.  labels holds name, value pairs.
+func (w *Writer) Sample(name string, labels []string, value float64) {
+	w.write(name)
+	if len(labels) > 0 {
+		w.write("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.write(",")
+			}
+			w.write(labels[i], "=", quote(labels[i+1]))
+		}
+		w.write("}")
+	}
+	w.write(" ", formatFloat(value), "\n")
+}
+
+func (w *Writer) write(parts ...string) {
+	for _, p := range parts {
+		n, _ := w.WriteString(p)
+		w.n += int64(n)
+	}
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,271 @@
+package otlp
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+)
+
+const aggregationCumulative = 2
+
+type MetricsRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+type ScopeMetrics struct {
+	Scope   Scope    `json:"scope"`
+	Metrics []Metric `json:"metrics"`
+}
+
+type Metric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *Gauge     `json:"gauge,omitempty"`
+	Sum         *Sum       `json:"sum,omitempty"`
+	Histogram   *Histogram `json:"histogram,omitempty"`
+	Summary     *Summary   `json:"summary,omitempty"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano fixed64    `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      fixed64    `json:"timeUnixNano"`
+	AsDouble          double     `json:"asDouble"`
+}
+
+type Histogram struct {
+	DataPoints             []HistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano fixed64    `json:"startTimeUnixNano"`
+	TimeUnixNano      fixed64    `json:"timeUnixNano"`
+	Count             fixed64    `json:"count"`
+	Sum               double     `json:"sum"`
+	BucketCounts      []fixed64  `json:"bucketCounts"`
+	ExplicitBounds    []double   `json:"explicitBounds"`
+}
+
+type Summary struct {
+	DataPoints []SummaryDataPoint `json:"dataPoints"`
+}
+
+type SummaryDataPoint struct {
+	Attributes        []KeyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano fixed64         `json:"startTimeUnixNano"`
+	TimeUnixNano      fixed64         `json:"timeUnixNano"`
+	Count             fixed64         `json:"count"`
+	Sum               double          `json:"sum"`
+	QuantileValues    []QuantileValue `json:"quantileValues"`
+}
+
+type QuantileValue struct {
+	Quantile double `json:"quantile"`
+	Value    double `json:"value"`
+}
+
+// ExportMetrics sends metrics to the collector's /v1/metrics.
+func (c *Client) ExportMetrics(ctx context.Context, req *MetricsRequest) error {
+	return c.export(ctx, "/v1/metrics", req)
+}
+
+// ResourceMetricsFromFamilies converts a parsed Prometheus exposition.
+// Cumulative metrics use start as their start time, and samples without
+// an explicit timestamp use now.
+func ResourceMetricsFromFamilies(resource map[string]string, scope Scope, families []*exposition.Family, start, now time.Time) ResourceMetrics {
+	var metrics []Metric
+	for _, f := range families {
+		if len(f.Samples) == 0 {
+			continue
+		}
+		m := Metric{Name: f.Name, Description: f.Help}
+		switch f.Type {
+		case "counter":
+			m.Sum = &Sum{
+				DataPoints:             numberPoints(f.Samples, start, now),
+				AggregationTemporality: aggregationCumulative,
+				IsMonotonic:            true,
+			}
+		case "histogram":
+			m.Histogram = &Histogram{
+				DataPoints:             histogramPoints(f, start, now),
+				AggregationTemporality: aggregationCumulative,
+			}
+		case "summary":
+			m.Summary = &Summary{DataPoints: summaryPoints(f, start, now)}
+		default:
+			m.Gauge = &Gauge{DataPoints: numberPoints(f.Samples, time.Time{}, now)}
+		}
+		metrics = append(metrics, m)
+	}
+	return ResourceMetrics{
+		Resource:     Resource{Attributes: Attributes(resource)},
+		ScopeMetrics: []ScopeMetrics{{Scope: scope, Metrics: metrics}},
+	}
+}
+
+func unixNano(t time.Time) fixed64 {
+	if t.IsZero() {
+		return 0
+	}
+	return fixed64(t.UnixNano())
+}
+
+func sampleTime(s exposition.Sample, now time.Time) fixed64 {
+	if s.Timestamp != 0 {
+		return unixNano(time.UnixMilli(s.Timestamp))
+	}
+	return unixNano(now)
+}
+
+func labelMap(labels []exposition.Label, skip string) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		if l.Name != skip {
+			m[l.Name] = l.Value
+		}
+	}
+	return m
+}
+
+// seriesKey identifies a histogram or summary series without its le or
+// quantile label.
+func seriesKey(labels []exposition.Label, skip string) string {
+	var parts []string
+	for _, l := range labels {
+		if l.Name != skip {
+			parts = append(parts, l.Name+"="+strconv.Quote(l.Value))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func numberPoints(samples []exposition.Sample, start, now time.Time) []NumberDataPoint {
+	points := make([]NumberDataPoint, 0, len(samples))
+	for _, s := range samples {
+		points = append(points, NumberDataPoint{
+			Attributes:        Attributes(labelMap(s.Labels, "")),
+			StartTimeUnixNano: unixNano(start),
+			TimeUnixNano:      sampleTime(s, now),
+			AsDouble:          double(s.Value),
+		})
+	}
+	return points
+}
+
+type bucket struct {
+	le    float64
+	count float64
+}
+
+func histogramPoints(f *exposition.Family, start, now time.Time) []HistogramDataPoint {
+	var order []string
+	points := make(map[string]*HistogramDataPoint)
+	buckets := make(map[string][]bucket)
+
+	for _, s := range f.Samples {
+		key := seriesKey(s.Labels, "le")
+		p, ok := points[key]
+		if !ok {
+			p = &HistogramDataPoint{
+				Attributes:        Attributes(labelMap(s.Labels, "le")),
+				StartTimeUnixNano: unixNano(start),
+				TimeUnixNano:      sampleTime(s, now),
+			}
+			points[key] = p
+			order = append(order, key)
+		}
+		switch s.Name {
+		case f.Name + "_bucket":
+			le, err := strconv.ParseFloat(labelMap(s.Labels, "")["le"], 64)
+			if err == nil {
+				buckets[key] = append(buckets[key], bucket{le: le, count: s.Value})
+			}
+		case f.Name + "_sum":
+			p.Sum = double(s.Value)
+		case f.Name + "_count":
+			p.Count = fixed64(s.Value)
+		}
+	}
+
+	var result []HistogramDataPoint
+	for _, key := range order {
+		p := points[key]
+		bs := buckets[key]
+		sort.Slice(bs, func(i, j int) bool { return bs[i].le < bs[j].le })
+
+		// Prometheus buckets are cumulative, OTLP bucket counts are not.
+		var prev float64
+		for _, b := range bs {
+			if !math.IsInf(b.le, 1) {
+				p.ExplicitBounds = append(p.ExplicitBounds, double(b.le))
+			}
+			p.BucketCounts = append(p.BucketCounts, fixed64(b.count-prev))
+			prev = b.count
+		}
+		if len(bs) == 0 || !math.IsInf(bs[len(bs)-1].le, 1) {
+			p.BucketCounts = append(p.BucketCounts, fixed64(float64(p.Count)-prev))
+		}
+		result = append(result, *p)
+	}
+	return result
+}
+
+func summaryPoints(f *exposition.Family, start, now time.Time) []SummaryDataPoint {
+	var order []string
+	points := make(map[string]*SummaryDataPoint)
+
+	for _, s := range f.Samples {
+		key := seriesKey(s.Labels, "quantile")
+		p, ok := points[key]
+		if !ok {
+			p = &SummaryDataPoint{
+				Attributes:        Attributes(labelMap(s.Labels, "quantile")),
+				StartTimeUnixNano: unixNano(start),
+				TimeUnixNano:      sampleTime(s, now),
+			}
+			points[key] = p
+			order = append(order, key)
+		}
+		switch s.Name {
+		case f.Name:
+			q, err := strconv.ParseFloat(labelMap(s.Labels, "")["quantile"], 64)
+			if err == nil {
+				p.QuantileValues = append(p.QuantileValues, QuantileValue{Quantile: double(q), Value: double(s.Value)})
+			}
+		case f.Name + "_sum":
+			p.Sum = double(s.Value)
+		case f.Name + "_count":
+			p.Count = fixed64(s.Value)
+		}
+	}
+
+	var result []SummaryDataPoint
+	for _, key := range order {
+		result = append(result, *points[key])
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package otlp
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/exposition"
+)
+
+func TestResourceMetricsFromFamilies(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	startNano, nowNano := fixed64(start.UnixNano()), fixed64(now.UnixNano())
+	attrs := func(kv ...string) []KeyValue {
+		m := map[string]string{}
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return Attributes(m)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  []Metric
+	}{
+		{
+			name:  "gauge has no start time",
+			input: "# HELP temp Degrees.\n# TYPE temp gauge\ntemp{room=\"a\"} 21.5\n",
+			want: []Metric{{Name: "temp", Description: "Degrees.", Gauge: &Gauge{DataPoints: []NumberDataPoint{
+				{Attributes: attrs("room", "a"), TimeUnixNano: nowNano, AsDouble: 21.5},
+			}}}},
+		},
+		{
+			name:  "untyped is a gauge",
+			input: "up 1\n",
+			want: []Metric{{Name: "up", Gauge: &Gauge{DataPoints: []NumberDataPoint{
+				{Attributes: attrs(), TimeUnixNano: nowNano, AsDouble: 1},
+			}}}},
+		},
+		{
+			name:  "counter keeps its timestamp",
+			input: "# TYPE requests_total counter\nrequests_total 7 1500000\n",
+			want: []Metric{{Name: "requests_total", Sum: &Sum{
+				DataPoints: []NumberDataPoint{
+					{Attributes: attrs(), StartTimeUnixNano: startNano, TimeUnixNano: fixed64(time.UnixMilli(1500000).UnixNano()), AsDouble: 7},
+				},
+				AggregationTemporality: aggregationCumulative,
+				IsMonotonic:            true,
+			}}},
+		},
+		{
+			name: "histogram buckets become deltas",
+			input: `# TYPE latency histogram
+latency_bucket{path="/",le="1"} 2
+latency_bucket{path="/",le="0.5"} 1
+latency_bucket{path="/",le="+Inf"} 5
+latency_sum{path="/"} 3.5
+latency_count{path="/"} 5
+latency_bucket{path="/x",le="1"} 1
+latency_sum{path="/x"} 0.2
+latency_count{path="/x"} 4
+`,
+			want: []Metric{{Name: "latency", Histogram: &Histogram{
+				DataPoints: []HistogramDataPoint{
+					{
+						Attributes:        attrs("path", "/"),
+						StartTimeUnixNano: startNano,
+						TimeUnixNano:      nowNano,
+						Count:             5,
+						Sum:               3.5,
+						BucketCounts:      []fixed64{1, 1, 3},
+						ExplicitBounds:    []double{0.5, 1},
+					},
+					{
+						// No +Inf bucket: the rest of the count is above the last bound.
+						Attributes:        attrs("path", "/x"),
+						StartTimeUnixNano: startNano,
+						TimeUnixNano:      nowNano,
+						Count:             4,
+						Sum:               0.2,
+						BucketCounts:      []fixed64{1, 3},
+						ExplicitBounds:    []double{1},
+					},
+				},
+				AggregationTemporality: aggregationCumulative,
+			}}},
+		},
+		{
+			name: "summary",
+			input: `# TYPE rpc summary
+rpc{quantile="0.5"} 0.1
+rpc{quantile="0.99"} 0.9
+rpc_sum 12
+rpc_count 40
+`,
+			want: []Metric{{Name: "rpc", Summary: &Summary{DataPoints: []SummaryDataPoint{{
+				Attributes:        attrs(),
+				StartTimeUnixNano: startNano,
+				TimeUnixNano:      nowNano,
+				Count:             40,
+				Sum:               12,
+				QuantileValues:    []QuantileValue{{0.5, 0.1}, {0.99, 0.9}},
+			}}}}},
+		},
+		{
+			name:  "families without samples are left out",
+			input: "# TYPE idle gauge\n",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, err := exposition.Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rm := ResourceMetricsFromFamilies(map[string]string{"service.name": "tailmon"}, Scope{Name: "tailmon"}, families, start, now)
+			if want := attrs("service.name", "tailmon"); !reflect.DeepEqual(rm.Resource.Attributes, want) {
+				t.Errorf("resource = %+v, want %+v", rm.Resource.Attributes, want)
+			}
+			if len(rm.ScopeMetrics) != 1 || rm.ScopeMetrics[0].Scope.Name != "tailmon" {
+				t.Fatalf("scope metrics = %+v", rm.ScopeMetrics)
+			}
+			if got := rm.ScopeMetrics[0].Metrics; !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("metrics =\n%s\nwant\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{fixed64(0), `"0"`},
+		{fixed64(math.MaxUint64), `"18446744073709551615"`},
+		{double(1.5), `1.5`},
+		{double(math.NaN()), `"NaN"`},
+		{double(math.Inf(1)), `"Infinity"`},
+		{double(math.Inf(-1)), `"-Infinity"`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.value)
+		if err != nil {
+			t.Fatalf("Marshal(%v): %v", tt.value, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Marshal(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package otlp sends data to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.  Only the small subset of the protocol needed by
+// tailmon is implemented.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Client posts OTLP requests to a collector.
+type Client struct {
+	// Endpoint is the collector base URL, like "http://otel-collector:4318".
+	// Signal paths such as /v1/metrics are appended to it.
+	Endpoint   string
+	Headers    map[string]string
+	HTTPClient *http.Client
+}
+
+func (c *Client) export(ctx context.Context, path string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(c.Endpoint, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// KeyValue is an OTLP attribute.  Only string values are used.
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+type AnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Attributes converts a map to attributes sorted by key.
+func Attributes(m map[string]string) []KeyValue {
+	attrs := make([]KeyValue, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, KeyValue{Key: k, Value: AnyValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type Scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// fixed64 is how OTLP JSON encodes 64 bit integers.
+type fixed64 uint64
+
+func (f fixed64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatUint(uint64(f), 10) + `"`), nil
+}
+
+// double is a float64 that encodes NaN and infinities as protojson does.
+type double float64
+
+func (d double) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(f)
+}
@@ -0,0 +1,64 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Span kinds and status codes from the OTLP trace protocol.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+
+	StatusOK    = 1
+	StatusError = 2
+)
+
+type TracesRequest struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+type ScopeSpans struct {
+	Scope Scope  `json:"scope"`
+	Spans []Span `json:"spans"`
+}
+
+// Span is a finished span.  OTLP JSON encodes trace and span IDs as
+// lowercase hex rather than base64.
+type Span struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        time.Time  `json:"-"`
+	End          time.Time  `json:"-"`
+	Attributes   []KeyValue `json:"attributes,omitempty"`
+	Status       *Status    `json:"status,omitempty"`
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// ExportTraces sends spans to the collector's /v1/traces.
+func (c *Client) ExportTraces(ctx context.Context, req *TracesRequest) error {
+	return c.export(ctx, "/v1/traces", req)
+}
+
+func (s Span) MarshalJSON() ([]byte, error) {
+	type span Span
+	return json.Marshal(struct {
+		span
+		StartTimeUnixNano fixed64 `json:"startTimeUnixNano"`
+		EndTimeUnixNano   fixed64 `json:"endTimeUnixNano"`
+	}{span(s), unixNano(s.Start), unixNano(s.End)})
+}
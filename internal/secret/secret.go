@@ -0,0 +1,98 @@
+// Package secret reads sensitive values like encryption keys from
+// somewhere other than the command line.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExecTimeout bounds how long an exec: source may run.
+const ExecTimeout = 30 * time.Second
+
+// Read returns the secret named by source, which is one of:
+//
+//	file:PATH     the contents of PATH
+//	cred:NAME     the systemd credential NAME, from LoadCredential=
+//	env:NAME      the value of environment variable NAME
+//	exec:COMMAND  the output of COMMAND, run without a shell
+//
+// A single trailing newline is removed.
+func Read(ctx context.Context, source string) ([]byte, error) {
+	kind, arg, ok := strings.Cut(source, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("secret %q: want file:PATH, cred:NAME, env:NAME or exec:COMMAND", source)
+	}
+
+	var value []byte
+	switch kind {
+	case "file":
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("secret: %w", err)
+		}
+		value = b
+	case "cred":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, errors.New("secret: CREDENTIALS_DIRECTORY is not set, use LoadCredential= in the systemd unit")
+		}
+		if strings.ContainsRune(arg, '/') {
+			return nil, fmt.Errorf("secret: bad credential name %q", arg)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, arg))
+		if err != nil {
+			return nil, fmt.Errorf("secret: %w", err)
+		}
+		value = b
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("secret: %s is not set", arg)
+		}
+		value = []byte(v)
+	case "exec":
+		b, err := run(ctx, arg)
+		if err != nil {
+			return nil, fmt.Errorf("secret: %s: %w", arg, err)
+		}
+		value = b
+	default:
+		return nil, fmt.Errorf("secret %q: unknown source %q", source, kind)
+	}
+
+	value = bytes.TrimSuffix(value, []byte("\n"))
+	value = bytes.TrimSuffix(value, []byte("\r"))
+	if len(value) == 0 {
+		return nil, fmt.Errorf("secret %q is empty", source)
+	}
+	return value, nil
+}
+
+func run(ctx context.Context, command string) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ExecTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,278 @@
+// Package trace records spans and sends them to an OpenTelemetry
+// collector with internal/otlp.  Trace context is propagated with the
+// W3C traceparent header.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamessanford/tailmon/internal/otlp"
+)
+
+type Kind int
+
+const (
+	Internal Kind = otlp.SpanKindInternal
+	Server   Kind = otlp.SpanKindServer
+	Client   Kind = otlp.SpanKindClient
+)
+
+// maxQueued bounds the spans held between flushes.  Spans beyond it
+// are dropped rather than growing without limit while the collector
+// is unreachable.
+const maxQueued = 4096
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid reports whether sc has non-zero IDs.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	// hex.Decode writes past dst for a longer src, so check lengths first.
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// Extract returns ctx carrying the remote parent from h, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get("Traceparent")); ok {
+		return context.WithValue(ctx, remoteKey, sc)
+	}
+	return ctx
+}
+
+// Inject sets traceparent in h for the span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if span := FromContext(ctx); span != nil {
+		h.Set("Traceparent", span.sc.Traceparent())
+	}
+}
+
+// FromContext returns the current span, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// Start begins a child of the span in ctx.  Without a span in ctx
+// nothing is recorded and the returned nil *Span is safe to use.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, kind, parent.sc)
+}
+
+// Tracer collects finished spans until they are flushed.
+type Tracer struct {
+	client   *otlp.Client
+	resource []otlp.KeyValue
+	scope    otlp.Scope
+	sample   float64
+
+	mu      sync.Mutex
+	spans   []otlp.Span
+	dropped int
+}
+
+// NewTracer returns a Tracer that records a fraction sample of new
+// traces.  Traces started elsewhere follow the caller's sampling decision.
+func NewTracer(client *otlp.Client, resource map[string]string, scope otlp.Scope, sample float64) *Tracer {
+	return &Tracer{
+		client:   client,
+		resource: otlp.Attributes(resource),
+		scope:    scope,
+		sample:   sample,
+	}
+}
+
+// Start begins a span that continues a remote parent added by
+// Extract, or a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent, ok := ctx.Value(remoteKey).(SpanContext)
+	if !ok {
+		parent.Sampled = t.sample >= 1 || randomFloat() < t.sample
+		randomBytes(parent.TraceID[:])
+	}
+	return t.start(ctx, name, kind, parent)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind Kind, parent SpanContext) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		sc:     SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled},
+		parent: parent.SpanID,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	randomBytes(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+func (t *Tracer) finish(s otlp.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= maxQueued {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, s)
+}
+
+// Flush sends the finished spans.  It returns how many were dropped
+// since the last flush because the queue was full.
+func (t *Tracer) Flush(ctx context.Context) (dropped int, err error) {
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return dropped, nil
+	}
+	return dropped, t.client.ExportTraces(ctx, &otlp.TracesRequest{
+		ResourceSpans: []otlp.ResourceSpans{{
+			Resource:   otlp.Resource{Attributes: t.resource},
+			ScopeSpans: []otlp.ScopeSpans{{Scope: t.scope, Spans: spans}},
+		}},
+	})
+}
+
+// Span is an operation being timed.  All methods are safe on a nil *Span.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent [8]byte
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   error
+}
+
+// Context returns the span's identity, for propagation.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a string attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span and queues it for export if it is sampled.
+func (s *Span) End() {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlp.Span{
+		TraceID:    hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:     hex.EncodeToString(s.sc.SpanID[:]),
+		Name:       s.name,
+		Kind:       int(s.kind),
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: otlp.Attributes(s.attrs),
+	}
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != nil {
+		span.Status = &otlp.Status{Code: otlp.StatusError, Message: s.err.Error()}
+	}
+	s.tracer.finish(span)
+}
+
+func randomBytes(b []byte) {
+	// crypto/rand does not fail on supported platforms.
+	_, _ = rand.Read(b)
+}
+
+func randomFloat() float64 {
+	var b [8]byte
+	randomBytes(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
@@ -0,0 +1,51 @@
+package trace
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-09", true, true},
+		{"spaces", "  00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"future version with more fields", "cc-" + traceID + "-" + spanID + "-01-what", true, true},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-what", false, false},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"version not hex", "0g-" + traceID + "-" + spanID + "-01", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span ID", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"long trace ID", "00-" + traceID + "ab-" + spanID + "-01", false, false},
+		{"short trace ID", "00-" + traceID[:30] + "-" + spanID + "-01", false, false},
+		{"long span ID", "00-" + traceID + "-" + spanID + "ab-01", false, false},
+		{"odd trace ID", "00-" + traceID[:31] + "x-" + spanID + "-01", false, false},
+		{"bad flags", "00-" + traceID + "-" + spanID + "-1", false, false},
+		{"too few fields", "00-" + traceID + "-" + spanID, false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.Sampled != tt.sampled {
+				t.Errorf("Sampled = %v, want %v", sc.Sampled, tt.sampled)
+			}
+			if got, want := sc.Traceparent()[:52], "00-"+traceID+"-"+spanID; got != want {
+				t.Errorf("Traceparent() = %q, want prefix %q", got, want)
+			}
+		})
+	}
+}
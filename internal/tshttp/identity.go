@@ -0,0 +1,103 @@
+package tshttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// WhoIsFunc looks up the tailnet peer at remoteAddr, an IP:PORT, such as
+// a LocalClient's WhoIs or a cache in front of it.
+type WhoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// Identity is the tailnet peer that sent a request.
+type Identity struct {
+	LoginName string
+	NodeName  string // MagicDNS name, without the trailing dot
+	NodeID    tailcfg.StableNodeID
+	Tags      []string
+
+	// WhoIs is the full answer.  It may be shared; do not modify it.
+	WhoIs *apitype.WhoIsResponse
+}
+
+// ErrNoIdentity is returned by IdentityFrom for requests that did not
+// arrive on the tailnet, such as on LocalAddrs or through Funnel, or
+// that Identify did not see.
+var ErrNoIdentity = errors.New("request has no tailnet identity")
+
+type identityKey struct{}
+
+// lazyIdentity looks up the peer the first time a handler asks.
+type lazyIdentity struct {
+	once   sync.Once
+	lookup WhoIsFunc
+	id     *Identity
+	err    error
+}
+
+// Identify lets handlers learn who sent each tailnet request with
+// IdentityFrom.  The peer is looked up with lookup only when first
+// asked, so requests that never ask cost nothing.
+func Identify(lookup WhoIsFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if onTailnet(r) {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &lazyIdentity{lookup: lookup}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// onTailnet reports whether r arrived on a tailnet listener.  The
+// remote address alone would not do: a peer's address can also reach
+// LocalAddrs.
+func onTailnet(r *http.Request) bool {
+	if FromFunnel(r) {
+		return false
+	}
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	return err == nil && tsaddr.IsTailscaleIP(ap.Addr().Unmap())
+}
+
+// IdentityFrom returns who sent r, looking it up on first use with r's
+// context.  Requests need the Identify middleware.
+func IdentityFrom(r *http.Request) (*Identity, error) {
+	lazy, ok := r.Context().Value(identityKey{}).(*lazyIdentity)
+	if !ok {
+		return nil, ErrNoIdentity
+	}
+	lazy.once.Do(func() {
+		who, err := lazy.lookup(r.Context(), r.RemoteAddr)
+		switch {
+		case err != nil:
+			lazy.err = err
+		case who.Node == nil:
+			lazy.err = errors.New("unknown peer")
+		default:
+			lazy.id = &Identity{
+				NodeName: strings.TrimSuffix(who.Node.Name, "."),
+				NodeID:   who.Node.StableID,
+				Tags:     who.Node.Tags,
+				WhoIs:    who,
+			}
+			if who.UserProfile != nil {
+				lazy.id.LoginName = who.UserProfile.LoginName
+			}
+		}
+	})
+	return lazy.id, lazy.err
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package tshttp
+
+// lockDir does nothing on this platform.
+func lockDir(dir string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,43 @@
+package tshttp
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// Middleware wraps a handler, such as to log, count or authorize its
+// requests.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps handler in middlewares, the first outermost, so it sees
+// each request first.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recover answers 500 to a request whose handler panics, logging the
+// panic and its stack, instead of dropping the connection.
+func Recover(logger *zap.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logger.Error("panic", zap.String("path", r.URL.Path), zap.Any("panic", v), zap.ByteString("stack", debug.Stack()))
+				// Too late if the handler already wrote its header.
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
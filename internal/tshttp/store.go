@@ -0,0 +1,138 @@
+package tshttp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+)
+
+const (
+	plainStateFile     = "tailscaled.state"
+	encryptedStateFile = "tailscaled.state.enc"
+)
+
+// stateAD binds the ciphertext to its purpose, so a file encrypted
+// for something else with the same key is not accepted as state.
+var stateAD = []byte("tailmon tailnet state v1")
+
+// encryptedStore is an ipn.StateStore that keeps the whole state map
+// in one file sealed with AES-256-GCM.  Node keys never touch the disk
+// in the clear.
+type encryptedStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu    sync.Mutex
+	cache map[ipn.StateKey][]byte
+}
+
+// newEncryptedStore opens the encrypted state in dir, creating it if
+// needed.  An existing unencrypted tailscaled.state is moved into the
+// encrypted file and removed, so turning on encryption keeps the node.
+func newEncryptedStore(dir string, key []byte) (*encryptedStore, error) {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &encryptedStore{
+		path:  filepath.Join(dir, encryptedStateFile),
+		aead:  aead,
+		cache: make(map[ipn.StateKey][]byte),
+	}
+
+	sealed, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		if err := s.open(sealed); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		return s, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	plainPath := filepath.Join(dir, plainStateFile)
+	plain, err := os.ReadFile(plainPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(plain)) > 0 {
+		if err := json.Unmarshal(plain, &s.cache); err != nil {
+			return nil, fmt.Errorf("%s: %w", plainPath, err)
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(plainPath); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *encryptedStore) open(sealed []byte) error {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return errors.New("state file is truncated")
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], stateAD)
+	if err != nil {
+		return errors.New("unable to decrypt state, wrong key?")
+	}
+	return json.Unmarshal(plain, &s.cache)
+}
+
+func (s *encryptedStore) save() error {
+	plain, err := json.Marshal(s.cache)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, s.aead.Seal(nonce, nonce, plain, stateAD), 0o600)
+}
+
+func (s *encryptedStore) String() string { return "encryptedStore(" + s.path + ")" }
+
+// ReadState implements ipn.StateStore.
+func (s *encryptedStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.cache[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bytes.Clone(bs), nil
+}
+
+// WriteState implements ipn.StateStore.
+func (s *encryptedStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.cache[id]; ok && bytes.Equal(old, bs) {
+		return nil
+	}
+	s.cache[id] = bytes.Clone(bs)
+	return s.save()
+}
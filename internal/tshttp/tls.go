@@ -0,0 +1,165 @@
+package tshttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+const (
+	// tlsRetryInterval is how often ListenTLS and ListenFunnel are
+	// retried, such as while HTTPS or Funnel are not yet enabled.
+	tlsRetryInterval = 1 * time.Minute
+
+	// certCheckInterval is how often the certificate is fetched, so
+	// tailscale renews it ahead of expiry even without handshakes.
+	certCheckInterval = 12 * time.Hour
+
+	// certExpiryWarning is when an unrenewed certificate is logged.
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+// serveTLS serves HTTPS on TLSPort, waiting for the tailnet to run,
+// since certificates need its MagicDNS name.  tsnet fetches the
+// certificate for each handshake from tailscale, which issues it on
+// first use and renews it in the background as it nears expiry.
+func (s *Server) serveTLS(httpsrv *http.Server) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return
+	}
+	addr := ":" + strconv.Itoa(s.TLSPort)
+	listen := s.listenRetry("ListenTLS", addr, func() (net.Listener, error) {
+		return s.tailnet.ListenTLS("tcp", addr)
+	})
+	if listen == nil {
+		return
+	}
+	go s.watchCert()
+	s.Logger.Info("serving TLS", zap.Int("port", s.TLSPort), zap.Strings("domains", s.tailnet.CertDomains()))
+	serve(s.Logger, httpsrv, addr, listen)
+}
+
+// serveFunnel serves funnelsrv to the public internet on FunnelPort.
+func (s *Server) serveFunnel(funnelsrv *http.Server) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return
+	}
+	addr := ":" + strconv.Itoa(s.FunnelPort)
+	listen := s.listenRetry("ListenFunnel", addr, func() (net.Listener, error) {
+		return s.tailnet.ListenFunnel("tcp", addr, tsnet.FunnelOnly())
+	})
+	if listen == nil {
+		return
+	}
+	var urls []string
+	for _, domain := range s.tailnet.CertDomains() {
+		urls = append(urls, "https://"+net.JoinHostPort(domain, strconv.Itoa(s.FunnelPort))+"/")
+	}
+	s.Logger.Warn("serving to the public internet through Funnel", zap.Strings("urls", urls))
+	serve(s.Logger, funnelsrv, addr, listen)
+}
+
+// listenRetry calls listen every tlsRetryInterval until it works,
+// returning nil if the server stops first.
+func (s *Server) listenRetry(what, addr string, listen func() (net.Listener, error)) net.Listener {
+	for {
+		l, err := listen()
+		if err == nil {
+			return l
+		}
+		s.Logger.Error(what+", retrying", zap.Error(&ListenError{Addr: addr, Err: err}), zap.Duration("retry", tlsRetryInterval))
+		select {
+		case <-time.After(tlsRetryInterval):
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func serve(logger *zap.Logger, httpsrv *http.Server, addr string, listen net.Listener) {
+	err := httpsrv.Serve(listen)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("http.Serve", zap.Error(&ListenError{Addr: addr, Err: err}))
+	}
+}
+
+type funnelKey struct{}
+
+// FromFunnel reports whether r came from the public internet through
+// Funnel, rather than from the tailnet or LocalAddrs.
+func FromFunnel(r *http.Request) bool {
+	v, _ := r.Context().Value(funnelKey{}).(bool)
+	return v
+}
+
+// watchCert fetches the certificate now, so the first client does not
+// wait for it to be issued, and then every certCheckInterval, logging
+// renewals and certificates close to expiring.
+func (s *Server) watchCert() {
+	domains := s.tailnet.CertDomains()
+	if len(domains) == 0 {
+		return
+	}
+	lc, err := s.tailnet.LocalClient()
+	if err != nil {
+		s.Logger.Error("LocalClient", zap.Error(err))
+		return
+	}
+	var notAfter time.Time
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		expiry, err := certExpiry(ctx, lc, domains[0])
+		cancel()
+		switch {
+		case err != nil:
+			s.Logger.Error("certificate", zap.String("domain", domains[0]), zap.Error(err))
+		case notAfter.IsZero():
+			s.Logger.Info("certificate", zap.String("domain", domains[0]), zap.Time("expires", expiry))
+		case expiry.After(notAfter):
+			s.Logger.Info("certificate renewed", zap.String("domain", domains[0]), zap.Time("expires", expiry))
+		}
+		if err == nil {
+			notAfter = expiry
+			if time.Until(expiry) < certExpiryWarning {
+				s.Logger.Warn("certificate expires soon", zap.String("domain", domains[0]), zap.Time("expires", expiry))
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// certExpiry fetches domain's certificate and returns when it expires.
+func certExpiry(ctx context.Context, lc *tailscale.LocalClient, domain string) (time.Time, error) {
+	certPEM, keyPEM, err := lc.CertPair(ctx, domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"go.uber.org/zap"
+	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
 	taillogger "tailscale.com/types/logger"
 )
@@ -23,11 +28,94 @@ type Server struct {
 	ControlURL string
 	StateDir   string
 	Debug      bool
-	tailnet    *tsnet.Server
-	cancel     context.CancelFunc
-	initOnce   sync.Once
+
+	// Port is the tailnet port to serve HTTP on.  The default is 80.
+	Port int
+
+	// Addrs, if set, are the tailnet addresses to serve HTTP on
+	// instead of Port, like ":80" and ":9090".
+	Addrs []string
+
+	// TLSPort, if set, also serves HTTPS on this tailnet port once the
+	// tailnet is running, with a certificate tailscale issues for the
+	// node's MagicDNS name and renews before it expires.  HTTPS must be
+	// enabled for the tailnet; until it is, listening is retried.
+	TLSPort int
+
+	// FunnelPort, if set, also serves HTTPS to the public internet on
+	// this port, 443, 8443 or 10000, through Tailscale Funnel once the
+	// tailnet is running.  Anyone can then reach the handler, so it must
+	// authenticate requests; FromFunnel tells them apart.  Funnel must be
+	// allowed for the node in the tailnet policy; until it is, listening
+	// is retried.
+	FunnelPort int
+
+	// LocalAddrs also serve the same handler on normal interfaces,
+	// like "127.0.0.1:8080" or "192.168.1.5:8080", for clients off the
+	// tailnet.
+	LocalAddrs []string
+
+	// AuthKey, if set, is used to log in a node without state.
+	AuthKey string
+
+	// StateKey, if set, encrypts the tailnet state at rest.  Any
+	// existing unencrypted state is converted on first use.
+	StateKey []byte
+
+	// ShutdownTimeout is how long Shutdown waits for in-flight
+	// requests to finish.  The default is one second.
+	ShutdownTimeout time.Duration
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout, IdleTimeout and
+	// MaxHeaderBytes are those of the http.Server.  Zero picks defaults
+	// for scrapes, which are small and quick: 10 seconds to read the
+	// headers, 30 to read a request or write a response, 5 idle, and
+	// 64 KiB of headers.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// Middlewares wrap the handler given to Start, the first outermost.
+	Middlewares []Middleware
+
+	// ErrorLog receives the http.Server's errors, such as failed TLS
+	// handshakes.  The default logs them to Logger.
+	ErrorLog *log.Logger
+
+	tailnet  *tsnet.Server
+	inflight atomic.Int64
+	cancel   context.CancelFunc
+	stop     context.CancelFunc // ends the status goroutine
+	unlock   func()
+	initOnce sync.Once
+	initErr  error
+	ready    chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+// ListenError is why one of the server's listeners could not listen or
+// stopped serving.  Start joins one per failed listener.
+type ListenError struct {
+	// Addr is the listener's address, on the tailnet unless Local.
+	Addr  string
+	Local bool
+	Err   error
+}
+
+func (e *ListenError) Error() string {
+	where := "tailnet"
+	if e.Local {
+		where = "local"
+	}
+	return fmt.Sprintf("%s %s: %v", where, e.Addr, e.Err)
 }
 
+func (e *ListenError) Unwrap() error { return e.Err }
+
 func sanitize(path string) string {
 	return strings.Map(func(r rune) rune {
 		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == rune('-') {
@@ -47,7 +135,12 @@ func (s *Server) init() {
 	if s.StateDir == "" {
 		s.StateDir = "."
 	}
+	if s.Port == 0 {
+		s.Port = 80
+	}
 	s.Logger.Debug("tshttp init")
+	s.ready = make(chan struct{})
+	s.done = make(chan struct{})
 
 	var logf taillogger.Logf
 	if s.Debug || s.Logger.Core().Enabled(zap.DebugLevel) {
@@ -58,15 +151,26 @@ func (s *Server) init() {
 
 	dir := fmt.Sprintf("%s/data-%s", s.StateDir, sanitize(s.Name))
 	if err := os.MkdirAll(dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
-		s.Logger.Fatal("unable to create state dir", zap.Error(err))
+		s.initErr = fmt.Errorf("unable to create state dir: %w", err)
+	} else if s.unlock, err = lockDir(dir); err != nil {
+		s.initErr = err
 	}
 
 	s.tailnet = &tsnet.Server{
 		Dir:        dir,
 		Hostname:   s.Name,
 		ControlURL: s.ControlURL,
+		AuthKey:    s.AuthKey,
 		Logf:       logf,
 	}
+	if len(s.StateKey) > 0 && s.initErr == nil {
+		store, err := newEncryptedStore(dir, s.StateKey)
+		if err != nil {
+			s.initErr = fmt.Errorf("unable to open encrypted state: %w", err)
+		} else {
+			s.tailnet.Store = store
+		}
+	}
 }
 
 // Tailnet returns the tsnet.Server which you might want access to
@@ -77,67 +181,210 @@ func (s *Server) Tailnet() *tsnet.Server {
 	return s.tailnet
 }
 
-// Start brings up the tailnet and starts serving HTTP on port 80.
-// When authentication is needed to continue, a repeating log message
-// will be output.  Use Shutdown when ready to stop HTTP and the tailnet.
+// Start is StartContext with a context that is never cancelled.
 func (s *Server) Start(handler http.Handler) error {
+	return s.StartContext(context.Background(), handler)
+}
+
+// StartContext brings up the tailnet and starts serving HTTP on Addrs or
+// Port, and LocalAddrs.  If any of them cannot listen, none are served,
+// the tailnet is closed, and the error joins a *ListenError for each.
+// When authentication is needed to continue, a repeating log message
+// will be output until the tailnet is running, ctx is cancelled, or
+// Shutdown is called.  Cancelling ctx does not stop serving; use
+// Shutdown when ready to stop HTTP and the tailnet.
+func (s *Server) StartContext(ctx context.Context, handler http.Handler) error {
 	s.initOnce.Do(s.init)
+	if s.initErr != nil {
+		return s.initErr
+	}
+
+	switch s.FunnelPort {
+	case 0, 443, 8443, 10000:
+	default:
+		return fmt.Errorf("funnel port %d is not 443, 8443 or 10000", s.FunnelPort)
+	}
+	if s.FunnelPort != 0 && s.FunnelPort == s.TLSPort {
+		return fmt.Errorf("funnel port %d is also the TLS port", s.FunnelPort)
+	}
 
 	logger := s.Logger
 
 	logger.Info("tailnet starting")
 
-	// Helper to show AuthURL when necessary.
-	go func() {
-		lc, err := s.tailnet.LocalClient()
+	ctx, s.stop = context.WithCancel(ctx)
+	go s.watchStatus(ctx)
+
+	addrs := s.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{":" + strconv.Itoa(s.Port)}
+	}
+	var listens, locals []net.Listener
+	var errs []error
+	for _, addr := range addrs {
+		logger.Debug("listen", zap.String("addr", addr))
+		listen, err := s.tailnet.Listen("tcp", addr)
 		if err != nil {
-			logger.Error("LocalClient", zap.Error(err))
-			return
+			errs = append(errs, &ListenError{Addr: addr, Err: err})
+			continue
 		}
-		for ; ; time.Sleep(1 * time.Second) {
-			// TODO: There should be a context to cancel to stop this goroutine.
-			ss, err := lc.StatusWithoutPeers(context.Background())
-			if err != nil {
-				logger.Error("StatusWithoutPeers", zap.Error(err))
-				continue
-			}
-			logger.Debug("status",
-				zap.String("BackendState", ss.BackendState),
-				zap.Strings("Health", ss.Health),
-				zap.String("AuthURL", ss.AuthURL),
-			)
-			if ss.BackendState == "Running" {
-				var ips []string
-				for _, ip := range ss.TailscaleIPs {
-					ips = append(ips, ip.String())
-				}
-				logger.Info("tailnet running",
-					zap.String("id", fmt.Sprintf("%v", ss.Self.ID)),
-					zap.String("dns", ss.Self.DNSName),
-					zap.Strings("ips", ips),
-				)
-				// TODO: Instead of exiting, keep this goroutine around and log error events.
-				break
-			}
-			if ss.AuthURL != "" {
-				logger.Error("Needs authentication", zap.String("url", ss.AuthURL))
+		listens = append(listens, listen)
+	}
+	for _, addr := range s.LocalAddrs {
+		local, err := net.Listen("tcp", addr)
+		if err != nil {
+			errs = append(errs, &ListenError{Addr: addr, Local: true, Err: err})
+			continue
+		}
+		locals = append(locals, local)
+	}
+	if len(errs) > 0 {
+		for _, l := range append(listens, locals...) {
+			l.Close()
+		}
+		s.stop()
+		// Listen has started the engine; stop it before giving up the
+		// state dir, so a restart never runs two on the same state.
+		s.tailnet.Close()
+		if s.unlock != nil {
+			s.unlock()
+			s.unlock = nil
+		}
+		return errors.Join(errs...)
+	}
+
+	handler = s.track(Chain(handler, s.Middlewares...))
+	httpsrv := s.newHTTPServer(handler)
+	servers := []*http.Server{httpsrv}
+	var funnelsrv *http.Server
+	if s.FunnelPort != 0 {
+		// Its own server, to mark its requests.
+		funnelsrv = s.newHTTPServer(handler)
+		funnelsrv.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, funnelKey{}, true)
+		}
+		servers = append(servers, funnelsrv)
+	}
+
+	s.cancel = func() {
+		timeout := s.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = 1 * time.Second
+		}
+		if n := s.inflight.Load(); n > 0 {
+			logger.Info("draining", zap.Int64("inflight", n), zap.Duration("timeout", timeout))
+		}
+		httpctx, cancel := context.WithTimeout(context.Background(), timeout)
+		for _, srv := range servers {
+			if err := srv.Shutdown(httpctx); err != nil {
+				logger.Error("drain incomplete", zap.Int64("inflight", s.inflight.Load()), zap.Error(err))
 			}
 		}
-	}()
+		cancel()
+		for _, l := range append(listens, locals...) {
+			l.Close()
+		}
+		s.tailnet.Close()
+		logger.Info("shutdown")
+	}
 
-	logger.Debug("listen", zap.Int("port", 80))
+	for _, local := range locals {
+		go func(local net.Listener) {
+			logger.Info("serving locally", zap.Stringer("addr", local.Addr()))
+			err := httpsrv.Serve(local)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("http.Serve", zap.Stringer("addr", local.Addr()), zap.Error(err))
+			}
+		}(local)
+	}
+
+	if s.TLSPort != 0 {
+		go s.serveTLS(httpsrv)
+	}
+	if funnelsrv != nil {
+		go s.serveFunnel(funnelsrv)
+	}
 
-	listen, err := s.tailnet.Listen("tcp", ":80")
+	// The first tailnet listener to stop, failing or from Shutdown,
+	// stops the server.
+	for i, listen := range listens {
+		go func(addr string, listen net.Listener) {
+			logger.Debug("serving", zap.String("addr", addr))
+			err := httpsrv.Serve(listen)
+			s.doneOnce.Do(func() {
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Error("http.Serve", zap.String("addr", addr), zap.Error(err))
+					s.err = &ListenError{Addr: addr, Err: err}
+				} else {
+					logger.Info("shutting down")
+				}
+				close(s.done)
+			})
+		}(addrs[i], listen)
+	}
+
+	return nil
+}
+
+// watchStatus logs the AuthURL while the tailnet needs authentication,
+// and closes ready once it is running.
+func (s *Server) watchStatus(ctx context.Context) {
+	logger := s.Logger
+	lc, err := s.tailnet.LocalClient()
 	if err != nil {
-		return err
+		logger.Error("LocalClient", zap.Error(err))
+		return
+	}
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		if ctx.Err() != nil {
+			return
+		}
+		ss, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("StatusWithoutPeers", zap.Error(err))
+			}
+			continue
+		}
+		logger.Debug("status",
+			zap.String("BackendState", ss.BackendState),
+			zap.Strings("Health", ss.Health),
+			zap.String("AuthURL", ss.AuthURL),
+		)
+		if ss.BackendState == "Running" {
+			var ips []string
+			for _, ip := range ss.TailscaleIPs {
+				ips = append(ips, ip.String())
+			}
+			logger.Info("tailnet running",
+				zap.String("id", fmt.Sprintf("%v", ss.Self.ID)),
+				zap.String("dns", ss.Self.DNSName),
+				zap.Strings("ips", ips),
+			)
+			close(s.ready)
+			// TODO: Instead of exiting, keep this goroutine around and log error events.
+			return
+		}
+		if ss.AuthURL != "" {
+			logger.Error("Needs authentication", zap.String("url", ss.AuthURL))
+		}
 	}
+}
 
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
 	httpsrv := &http.Server{
-		Handler:      handler,
-		ErrorLog:     zap.NewStdLog(s.Logger.Named("http.Server")),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  5 * time.Second,
+		Handler:           handler,
+		ErrorLog:          s.ErrorLog,
+		ReadHeaderTimeout: orDefault(s.ReadHeaderTimeout, 10*time.Second),
+		ReadTimeout:       orDefault(s.ReadTimeout, 30*time.Second),
+		WriteTimeout:      orDefault(s.WriteTimeout, 30*time.Second),
+		IdleTimeout:       orDefault(s.IdleTimeout, 5*time.Second),
+		MaxHeaderBytes:    orDefault(s.MaxHeaderBytes, 64<<10),
+	}
+	if httpsrv.ErrorLog == nil {
+		httpsrv.ErrorLog = zap.NewStdLog(s.Logger.Named("http.Server"))
 	}
 
 	// NOTE: BUG workaround: This server is leaving connections open despite the IdleTimeout.
@@ -145,32 +392,92 @@ func (s *Server) Start(handler http.Handler) error {
 	//
 	// Until idle connections are town down properly, force one request per connection.
 	httpsrv.SetKeepAlivesEnabled(false)
+	return httpsrv
+}
 
-	s.cancel = func() {
-		httpctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		httpsrv.Shutdown(httpctx)
-		cancel()
-		listen.Close()
-		s.tailnet.Close()
-		logger.Info("shutdown")
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
 	}
+	return v
+}
 
-	go func() {
-		logger.Debug("serving", zap.Int("port", 80))
-		err = httpsrv.Serve(listen)
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("http.Serve", zap.Error(err))
-		} else {
-			logger.Info("shutting down")
-		}
-	}()
+// track counts in-flight requests so Shutdown can report on draining.
+func (s *Server) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// InFlight returns the number of requests currently being served.
+func (s *Server) InFlight() int64 {
+	return s.inflight.Load()
+}
 
+// Ready returns a channel that is closed once the tailnet is running.
+func (s *Server) Ready() <-chan struct{} {
+	s.initOnce.Do(s.init)
+	return s.ready
+}
+
+// Healthy returns an error unless the tailnet is currently running.
+func (s *Server) Healthy(ctx context.Context) error {
+	lc, err := s.Tailnet().LocalClient()
+	if err != nil {
+		return err
+	}
+	ss, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if ss.BackendState != "Running" {
+		return fmt.Errorf("tailnet is %s", ss.BackendState)
+	}
 	return nil
 }
 
+// Done returns a channel that is closed when the server stops serving,
+// either from Shutdown or a failure.
+func (s *Server) Done() <-chan struct{} {
+	s.initOnce.Do(s.init)
+	return s.done
+}
+
+// Err returns why serving failed, a *ListenError, or nil.  It is only set
+// after Done is closed.
+func (s *Server) Err() error {
+	return s.err
+}
+
+// SetHostname changes the hostname the node presents to the tailnet.
+// It is reset to Name when the server is restarted.
+func (s *Server) SetHostname(ctx context.Context, hostname string) error {
+	lc, err := s.Tailnet().LocalClient()
+	if err != nil {
+		return err
+	}
+	_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: hostname},
+		HostnameSet: true,
+	})
+	return err
+}
+
 // Shutdown is safe to call anytime after Start() has returned.
 func (s *Server) Shutdown() {
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
 	if s.cancel != nil {
 		s.cancel()
+		s.cancel = nil
+	}
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
 	}
 }
@@ -0,0 +1,30 @@
+// Package version reports how the running binary was built.
+package version
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+var get = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	if version == "" || version == "(devel)" {
+		version = "devel"
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				version += "-" + s.Value[:12]
+			}
+		}
+	}
+	return version
+})
+
+// Version returns the module version, or "devel" with the VCS revision
+// for binaries built from a checkout.
+func Version() string {
+	return get()
+}